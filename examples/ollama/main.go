@@ -21,10 +21,10 @@ var (
 func main() {
 
 	// Configure the Ollama backend for both embedding and generation
-	embeddingBackend := backend.NewOllamaBackend(ollamaEmdHost, ollamaEmbModel, time.Duration(10*time.Second))
+	var embeddingBackend backend.Embedder = backend.NewOllamaBackend(ollamaEmdHost, ollamaEmbModel, time.Duration(10*time.Second))
 	log.Printf("Embedding backend LLM: %s", ollamaEmbModel)
 
-	generationBackend := backend.NewOllamaBackend(ollamaHost, ollamaGenModel, time.Duration(10*time.Second))
+	var generationBackend backend.Generator = backend.NewOllamaBackend(ollamaHost, ollamaGenModel, time.Duration(10*time.Second))
 	log.Printf("Generation backend: %s", ollamaGenModel)
 
 	// Initialize the vector database
@@ -48,12 +48,8 @@ func main() {
 	ragContent := "According to the Space Exploration Organization's official records, the moon landing occurred on July 20, 2023, during the Artemis Program. This mission marked the first successful crewed lunar landing since the Apollo program."
 	query := "When was the moon landing?."
 
-	headers := map[string]string{
-		"Content-Type": "application/json",
-	}
-
 	// Embed the query using Ollama Embedding backend
-	embedding, err := embeddingBackend.Embed(ctx, ragContent, headers)
+	embedding, err := embeddingBackend.Embed(ctx, ragContent)
 	if err != nil {
 		log.Fatalf("Error generating embedding: %v", err)
 	}
@@ -67,7 +63,7 @@ func main() {
 	log.Println("Vector Document generated")
 
 	// Embed the query using the specified embedding backend
-	queryEmbedding, err := embeddingBackend.Embed(ctx, query, headers)
+	queryEmbedding, err := embeddingBackend.Embed(ctx, query)
 	if err != nil {
 		log.Fatalf("Error generating query embedding: %v", err)
 	}
@@ -25,8 +25,8 @@ func main() {
 	}
 
 	// Select backends based on config
-	var embeddingBackend backend.Backend
-	var generationBackend backend.Backend
+	var embeddingBackend backend.Embedder
+	var generationBackend backend.Generator
 
 	// Choose the backend for embeddings based on the config
 
@@ -23,10 +23,10 @@ func main() {
 	// Initialize Qdrant vector connection
 
 	// Configure the Ollama backend for both embedding and generation
-	embeddingBackend := backend.NewOllamaBackend(ollamaEmdHost, ollamaEmbModel, time.Duration(10*time.Second))
+	var embeddingBackend backend.Embedder = backend.NewOllamaBackend(ollamaEmdHost, ollamaEmbModel, time.Duration(10*time.Second))
 	log.Printf("Embedding backend LLM: %s", ollamaEmbModel)
 
-	generationBackend := backend.NewOllamaBackend(ollamaHost, ollamaGenModel, time.Duration(10*time.Second))
+	var generationBackend backend.Generator = backend.NewOllamaBackend(ollamaHost, ollamaGenModel, time.Duration(10*time.Second))
 	log.Printf("Generation backend: %s", ollamaGenModel)
 
 	vectorDB, err := db.NewQdrantVector("localhost", 6334)
@@ -52,13 +52,8 @@ func main() {
 	ragContent := "According to the Space Exploration Organization's official records, the moon landing occurred on July 20, 2023, during the Artemis Program. This mission marked the first successful crewed lunar landing since the Apollo program."
 	userQuery := "When was the moon landing?."
 
-	// Set the headers for the embedding request
-	headers := map[string]string{
-		"Content-Type": "application/json",
-	}
-
 	// Embed the query using Ollama Embedding backend
-	embedding, err := embeddingBackend.Embed(ctx, ragContent, headers)
+	embedding, err := embeddingBackend.Embed(ctx, ragContent)
 	if err != nil {
 		log.Fatalf("Error generating embedding: %v", err)
 	}
@@ -75,7 +70,7 @@ func main() {
 	log.Println("Document inserted successfully.")
 
 	// Embed the query using the specified embedding backend
-	queryEmbedding, err := embeddingBackend.Embed(ctx, userQuery, headers)
+	queryEmbedding, err := embeddingBackend.Embed(ctx, userQuery)
 	if err != nil {
 		log.Fatalf("Error generating query embedding: %v", err)
 	}
@@ -0,0 +1,481 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	anthropicMessagesEndpoint = "/v1/messages"
+	anthropicDefaultVersion   = "2023-06-01"
+
+	// anthropicDefaultMaxTokens is sent as max_tokens, which the Messages API
+	// requires, when the prompt does not set MaxTokens.
+	anthropicDefaultMaxTokens = 1024
+)
+
+// Ensure AnthropicBackend implements the generation interfaces. Anthropic does
+// not offer embeddings, so it is not a full Backend.
+var (
+	_ Generator = (*AnthropicBackend)(nil)
+	_ Streamer  = (*AnthropicBackend)(nil)
+)
+
+// AnthropicBackend represents a backend for generating responses with the
+// Anthropic Messages API. It only supports generation; pair it with another
+// backend for embeddings.
+type AnthropicBackend struct {
+	APIKey     string
+	Model      string
+	HTTPClient *http.Client
+	BaseURL    string
+	// Version is sent as the anthropic-version header. If empty, 2023-06-01 is used.
+	Version string
+	// DefaultMaxTokens is used when the prompt does not set MaxTokens, as the
+	// Messages API requires a limit. If zero, a default of 1024 is used.
+	DefaultMaxTokens int
+	// Retry configures retries of transient failures. If nil, requests are not retried.
+	Retry *RetryPolicy
+}
+
+// AnthropicContentBlock is a single block of message content in the Anthropic
+// wire format: text, a tool_use request from the model, or a tool_result.
+type AnthropicContentBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   string          `json:"content,omitempty"`
+	// Source holds the image of an image block.
+	Source *AnthropicImageSource `json:"source,omitempty"`
+}
+
+// AnthropicImageSource is the source of an image content block: either base64
+// data with its media type, or a URL.
+type AnthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// AnthropicResponse represents the structure of the response received from the
+// Anthropic Messages API.
+type AnthropicResponse struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []AnthropicContentBlock `json:"content"`
+	StopReason   string                  `json:"stop_reason"`
+	StopSequence string                  `json:"stop_sequence"`
+	Usage        struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+// anthropicMessage is the Anthropic wire representation of a Message.
+type anthropicMessage struct {
+	Role    string                  `json:"role"`
+	Content []AnthropicContentBlock `json:"content"`
+}
+
+// NewAnthropicBackend creates and returns a new AnthropicBackend instance with a custom timeout.
+//
+// Parameters:
+//   - apiKey: The API key for authenticating with the Anthropic API.
+//   - model: The name of the Claude model to use for generating responses.
+//   - timeout: The duration for the HTTP client timeout. If zero, the default timeout is used.
+//
+// Returns:
+//   - A pointer to a new AnthropicBackend instance configured with the provided API key, model, and timeout.
+func NewAnthropicBackend(apiKey, model string, timeout time.Duration) *AnthropicBackend {
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	return &AnthropicBackend{
+		APIKey: apiKey,
+		Model:  model,
+		HTTPClient: &http.Client{
+			Timeout: timeout,
+		},
+		BaseURL: "https://api.anthropic.com",
+	}
+}
+
+// Generate sends a structured prompt to the Anthropic Messages API and returns the
+// generated response. System messages are sent as the top-level system prompt.
+//
+// Parameters:
+//   - ctx: The context for the API request, which can be used for cancellation.
+//   - prompt: A structured prompt containing messages and parameters.
+//
+// Returns:
+//   - A string containing the generated response from the Claude model.
+//   - An error if the API request fails or if there's an issue processing the response.
+func (a *AnthropicBackend) Generate(ctx context.Context, prompt *Prompt) (string, error) {
+	result, err := a.GenerateWithResult(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	return result.Content(), nil
+}
+
+// GenerateWithResult sends a structured prompt to the Anthropic Messages API and
+// returns the response together with the finish reason, token usage, latency and
+// the request ID from the request-id response header.
+//
+// Parameters:
+//   - ctx: The context for the API request, which can be used for cancellation.
+//   - prompt: A structured prompt containing messages, parameters and tools.
+//
+// Returns:
+//   - The generation result, including the assistant message and any tool calls the model requested.
+//   - An error if the API request fails or if there's an issue processing the response.
+func (a *AnthropicBackend) GenerateWithResult(ctx context.Context, prompt *Prompt) (*GenerateResult, error) {
+	reqBody, err := a.messagesRequestBody(prompt, false)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := a.send(ctx, a.HTTPClient, defaultTimeout, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate response from Anthropic: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result AnthropicResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	message := Message{Role: "assistant"}
+	var text []string
+	for _, block := range result.Content {
+		switch block.Type {
+		case "text":
+			text = append(text, block.Text)
+		case "tool_use":
+			arguments := block.Input
+			if len(arguments) == 0 {
+				arguments = json.RawMessage("{}")
+			}
+			message.ToolCalls = append(message.ToolCalls, ToolCall{
+				ID:       block.ID,
+				Type:     "function",
+				Function: FunctionCall{Name: block.Name, Arguments: arguments},
+			})
+		}
+	}
+	message.Content = strings.Join(text, "")
+
+	return &GenerateResult{
+		Message:      message,
+		FinishReason: anthropicFinishReason(result.StopReason),
+		Usage: Usage{
+			PromptTokens:     result.Usage.InputTokens,
+			CompletionTokens: result.Usage.OutputTokens,
+			TotalTokens:      result.Usage.InputTokens + result.Usage.OutputTokens,
+		},
+		Model:     result.Model,
+		Latency:   time.Since(start),
+		RequestID: resp.Header.Get("Request-Id"),
+	}, nil
+}
+
+// anthropicFinishReason maps Anthropic's stop reason onto a FinishReason.
+func anthropicFinishReason(reason string) FinishReason {
+	switch reason {
+	case "":
+		return ""
+	case "max_tokens":
+		return FinishReasonLength
+	case "tool_use":
+		return FinishReasonToolCalls
+	case "refusal":
+		return FinishReasonContentFilter
+	default:
+		return FinishReasonStop
+	}
+}
+
+// anthropicStreamEvent represents the payload of a single server-sent event of a
+// streamed Messages API response.
+type anthropicStreamEvent struct {
+	Type  string `json:"type"`
+	Delta struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"delta"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// GenerateStream sends a structured prompt to the Anthropic Messages API and
+// delivers the response in chunks as it is generated. Anthropic streams
+// server-sent events; text deltas are forwarded and the stream ends with a
+// message_stop event.
+//
+// Unlike Generate, the request is bounded by ctx only, so long generations are
+// not cut off by the default timeout.
+//
+// Parameters:
+//   - ctx: The context for the API request, which can be used for cancellation.
+//   - prompt: A structured prompt containing messages and parameters.
+//
+// Returns:
+//   - A channel receiving the response chunks, closed when the stream ends.
+//   - An error if the request could not be started.
+func (a *AnthropicBackend) GenerateStream(ctx context.Context, prompt *Prompt) (<-chan StreamChunk, error) {
+	reqBody, err := a.messagesRequestBody(prompt, true)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.send(ctx, streamingClient(a.HTTPClient), 0, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate response from Anthropic: %w", err)
+	}
+
+	chunks := make(chan StreamChunk)
+	go func() {
+		defer close(chunks)
+		defer resp.Body.Close()
+
+		done := false
+		err := scanSSE(resp.Body, func(data []byte) bool {
+			var event anthropicStreamEvent
+			if err := json.Unmarshal(data, &event); err != nil {
+				sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("failed to decode stream chunk: %w", err)})
+				return false
+			}
+
+			switch event.Type {
+			case "error":
+				apiErr := anthropicErrorBody(data)
+				sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("anthropic stream error: %w", classifyError(apiErr, 0))})
+				return false
+			case "content_block_delta":
+				if event.Delta.Type != "text_delta" || event.Delta.Text == "" {
+					return true
+				}
+				return sendChunk(ctx, chunks, StreamChunk{Content: event.Delta.Text})
+			case "message_stop":
+				done = true
+				sendChunk(ctx, chunks, StreamChunk{Done: true})
+				return false
+			default:
+				return true
+			}
+		})
+		if err != nil {
+			sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("failed to read stream: %w", err)})
+			return
+		}
+		if !done && ctx.Err() == nil {
+			sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("stream ended before completion: %w", io.ErrUnexpectedEOF)})
+		}
+	}()
+
+	return chunks, nil
+}
+
+// messagesRequestBody builds the JSON body of a Messages API request for the given prompt.
+func (a *AnthropicBackend) messagesRequestBody(prompt *Prompt, stream bool) ([]byte, error) {
+	system, messages := anthropicMessages(prompt.Messages)
+
+	maxTokens := prompt.Parameters.MaxTokens
+	if maxTokens == 0 {
+		maxTokens = a.DefaultMaxTokens
+	}
+	if maxTokens == 0 {
+		maxTokens = anthropicDefaultMaxTokens
+	}
+
+	reqBody := map[string]interface{}{
+		"model":      a.Model,
+		"messages":   messages,
+		"max_tokens": maxTokens,
+	}
+	if format := prompt.ResponseFormat; format != nil {
+		// The Messages API has no JSON mode, so the schema is stated in the system prompt
+		schema, err := json.Marshal(format.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal response schema: %w", err)
+		}
+		instruction := "Respond only with a JSON value that conforms to this JSON Schema:\n" + string(schema)
+		system = strings.TrimSpace(system + "\n\n" + instruction)
+	}
+	if system != "" {
+		reqBody["system"] = system
+	}
+	if prompt.Parameters.Temperature != 0 {
+		reqBody["temperature"] = prompt.Parameters.Temperature
+	}
+	if prompt.Parameters.TopP != 0 {
+		reqBody["top_p"] = prompt.Parameters.TopP
+	}
+	if len(prompt.Tools) > 0 {
+		reqBody["tools"] = anthropicTools(prompt.Tools)
+	}
+	if stream {
+		reqBody["stream"] = true
+	}
+
+	reqBodyBytes, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	return reqBodyBytes, nil
+}
+
+// anthropicMessages converts prompt messages into the Anthropic wire format. System
+// messages are joined into the returned system prompt, tool results become
+// tool_result blocks of a user message, and consecutive messages with the same role
+// are merged, as the Messages API requires the roles to alternate.
+func anthropicMessages(messages []Message) (string, []anthropicMessage) {
+	var system []string
+	result := make([]anthropicMessage, 0, len(messages))
+	for _, message := range messages {
+		role := message.Role
+		var blocks []AnthropicContentBlock
+		switch role {
+		case "system":
+			system = append(system, message.Text())
+			continue
+		case "tool":
+			role = "user"
+			blocks = append(blocks, AnthropicContentBlock{
+				Type:      "tool_result",
+				ToolUseID: message.ToolCallID,
+				Content:   message.Content,
+			})
+		default:
+			// The API rejects empty text blocks
+			if message.Content != "" {
+				blocks = append(blocks, AnthropicContentBlock{Type: "text", Text: message.Content})
+			}
+			blocks = append(blocks, anthropicParts(message.Parts)...)
+			for _, call := range message.ToolCalls {
+				input := call.Function.Arguments
+				if len(input) == 0 {
+					input = json.RawMessage("{}")
+				}
+				blocks = append(blocks, AnthropicContentBlock{
+					Type:  "tool_use",
+					ID:    call.ID,
+					Name:  call.Function.Name,
+					Input: input,
+				})
+			}
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+
+		if last := len(result) - 1; last >= 0 && result[last].Role == role {
+			result[last].Content = append(result[last].Content, blocks...)
+			continue
+		}
+		result = append(result, anthropicMessage{Role: role, Content: blocks})
+	}
+	return strings.Join(system, "\n\n"), result
+}
+
+// anthropicParts converts content parts into text and image blocks.
+func anthropicParts(parts []ContentPart) []AnthropicContentBlock {
+	blocks := make([]AnthropicContentBlock, 0, len(parts))
+	for _, part := range parts {
+		switch part.Type {
+		case ContentPartText:
+			if part.Text == "" {
+				continue
+			}
+			blocks = append(blocks, AnthropicContentBlock{Type: "text", Text: part.Text})
+		case ContentPartImage:
+			source := &AnthropicImageSource{Type: "url", URL: part.URL}
+			if part.URL == "" {
+				source = &AnthropicImageSource{
+					Type:      "base64",
+					MediaType: part.mediaType(),
+					Data:      base64.StdEncoding.EncodeToString(part.Data),
+				}
+			}
+			blocks = append(blocks, AnthropicContentBlock{Type: "image", Source: source})
+		}
+	}
+	return blocks
+}
+
+// anthropicTools converts tool declarations into the Anthropic tool format.
+func anthropicTools(tools []Tool) []map[string]interface{} {
+	payload := make([]map[string]interface{}, 0, len(tools))
+	for _, tool := range tools {
+		schema := tool.Parameters
+		if schema == nil {
+			// input_schema is required, even for tools without arguments
+			schema = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+		}
+		t := map[string]interface{}{
+			"name":         tool.Name,
+			"input_schema": schema,
+		}
+		if tool.Description != "" {
+			t["description"] = tool.Description
+		}
+		payload = append(payload, t)
+	}
+	return payload
+}
+
+// send posts body to the Messages API and returns the successful response,
+// retrying transient failures according to the backend's retry policy. If
+// attemptTimeout is non-zero it bounds each attempt.
+func (a *AnthropicBackend) send(
+	ctx context.Context, client *http.Client, attemptTimeout time.Duration, body []byte,
+) (*http.Response, error) {
+	version := a.Version
+	if version == "" {
+		version = anthropicDefaultVersion
+	}
+
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.BaseURL+anthropicMessagesEndpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Api-Key", a.APIKey)
+		req.Header.Set("Anthropic-Version", version)
+		return req, nil
+	}
+	return sendWithRetry(ctx, a.Retry, client, attemptTimeout, newRequest, newAnthropicError)
+}
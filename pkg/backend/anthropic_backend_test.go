@@ -0,0 +1,314 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAnthropicGenerate(t *testing.T) {
+	t.Parallel()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/v1/messages" {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("X-Api-Key") != "test-api-key" {
+			t.Errorf("Expected x-api-key test-api-key, got %s", r.Header.Get("X-Api-Key"))
+		}
+		if r.Header.Get("Anthropic-Version") != "2023-06-01" {
+			t.Errorf("Expected anthropic-version 2023-06-01, got %s", r.Header.Get("Anthropic-Version"))
+		}
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("Expected no Authorization header, got %s", r.Header.Get("Authorization"))
+		}
+
+		var reqBody struct {
+			System    string             `json:"system"`
+			MaxTokens int                `json:"max_tokens"`
+			Messages  []anthropicMessage `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		if reqBody.System != "You are an AI assistant." {
+			t.Errorf("Expected the system prompt to be hoisted, got %q", reqBody.System)
+		}
+		if reqBody.MaxTokens != 1024 {
+			t.Errorf("Expected default max_tokens 1024, got %d", reqBody.MaxTokens)
+		}
+		if len(reqBody.Messages) != 1 || reqBody.Messages[0].Role != "user" ||
+			reqBody.Messages[0].Content[0].Text != "Hello, Claude!" {
+			t.Errorf("Unexpected messages: %+v", reqBody.Messages)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Request-Id", "req_123")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-3-5-sonnet",`+
+			`"content":[{"type":"text","text":"This is a test response."}],"stop_reason":"end_turn",`+
+			`"usage":{"input_tokens":12,"output_tokens":6}}`)
+	}))
+	defer mockServer.Close()
+
+	backend := &AnthropicBackend{
+		APIKey:     "test-api-key",
+		Model:      "claude-3-5-sonnet",
+		HTTPClient: mockServer.Client(),
+		BaseURL:    mockServer.URL,
+	}
+
+	prompt := NewPrompt().
+		AddMessage("system", "You are an AI assistant.").
+		AddMessage("user", "Hello, Claude!")
+
+	result, err := backend.GenerateWithResult(context.Background(), prompt)
+	if err != nil {
+		t.Fatalf("GenerateWithResult returned error: %v", err)
+	}
+
+	if result.Content() != "This is a test response." {
+		t.Errorf("Expected response 'This is a test response.', got '%s'", result.Content())
+	}
+	if result.FinishReason != FinishReasonStop {
+		t.Errorf("Expected finish reason stop, got %s", result.FinishReason)
+	}
+	if result.Usage.PromptTokens != 12 || result.Usage.CompletionTokens != 6 || result.Usage.TotalTokens != 18 {
+		t.Errorf("Unexpected usage: %+v", result.Usage)
+	}
+	if result.RequestID != "req_123" {
+		t.Errorf("Expected request ID req_123, got %s", result.RequestID)
+	}
+}
+
+func TestAnthropicGenerateWithResultToolCalls(t *testing.T) {
+	t.Parallel()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody struct {
+			Messages []anthropicMessage       `json:"messages"`
+			Tools    []map[string]interface{} `json:"tools"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		if len(reqBody.Tools) != 1 || reqBody.Tools[0]["input_schema"] == nil {
+			t.Errorf("Expected one tool with an input_schema, got %v", reqBody.Tools)
+		}
+
+		// The tool result must be sent back as a tool_result block of a user message
+		if len(reqBody.Messages) != 3 {
+			t.Fatalf("Expected 3 messages, got %d", len(reqBody.Messages))
+		}
+		assistant, toolResult := reqBody.Messages[1], reqBody.Messages[2]
+		if assistant.Role != "assistant" || assistant.Content[0].Type != "tool_use" || assistant.Content[0].ID != "toolu_1" {
+			t.Errorf("Unexpected assistant message: %+v", assistant)
+		}
+		if toolResult.Role != "user" || toolResult.Content[0].Type != "tool_result" ||
+			toolResult.Content[0].ToolUseID != "toolu_1" || toolResult.Content[0].Content != "18°C" {
+			t.Errorf("Unexpected tool result message: %+v", toolResult)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"role":"assistant","content":[{"type":"text","text":"Let me check again."},`+
+			`{"type":"tool_use","id":"toolu_2","name":"get_weather","input":{"city":"Paris"}}],"stop_reason":"tool_use"}`)
+	}))
+	defer mockServer.Close()
+
+	backend := &AnthropicBackend{
+		APIKey:     "test-api-key",
+		Model:      "claude-3-5-sonnet",
+		HTTPClient: mockServer.Client(),
+		BaseURL:    mockServer.URL,
+	}
+
+	prompt := NewPrompt().
+		AddMessage("user", "What's the weather in Paris?").
+		AddTool(Tool{Name: "get_weather", Description: "Get the current weather"}).
+		AppendMessage(Message{
+			Role: "assistant",
+			ToolCalls: []ToolCall{{
+				ID:       "toolu_1",
+				Function: FunctionCall{Name: "get_weather", Arguments: json.RawMessage(`{"city":"Paris"}`)},
+			}},
+		}).
+		AddToolResult("toolu_1", "18°C")
+
+	result, err := backend.GenerateWithResult(context.Background(), prompt)
+	if err != nil {
+		t.Fatalf("GenerateWithResult returned error: %v", err)
+	}
+	message := result.Message
+
+	if message.Content != "Let me check again." {
+		t.Errorf("Expected content 'Let me check again.', got '%s'", message.Content)
+	}
+	if len(message.ToolCalls) != 1 {
+		t.Fatalf("Expected 1 tool call, got %d", len(message.ToolCalls))
+	}
+	call := message.ToolCalls[0]
+	if call.ID != "toolu_2" || call.Function.Name != "get_weather" || string(call.Function.Arguments) != `{"city":"Paris"}` {
+		t.Errorf("Unexpected tool call: %+v", call)
+	}
+}
+
+func TestAnthropicGenerateStream(t *testing.T) {
+	t.Parallel()
+	events := []struct{ name, data string }{
+		{"message_start", `{"type":"message_start","message":{"id":"msg_1","role":"assistant","content":[]}}`},
+		{"content_block_start", `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`},
+		{"ping", `{"type":"ping"}`},
+		{"content_block_delta", `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"This is "}}`},
+		{"content_block_delta", `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"a test response."}}`},
+		{"content_block_stop", `{"type":"content_block_stop","index":0}`},
+		{"message_delta", `{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":6}}`},
+		{"message_stop", `{"type":"message_stop"}`},
+	}
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		if reqBody["stream"] != true {
+			t.Errorf("Expected stream to be true, got %v", reqBody["stream"])
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.name, event.data)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer mockServer.Close()
+
+	backend := &AnthropicBackend{
+		APIKey:     "test-api-key",
+		Model:      "claude-3-5-sonnet",
+		HTTPClient: mockServer.Client(),
+		BaseURL:    mockServer.URL,
+	}
+
+	stream, err := backend.GenerateStream(context.Background(), NewPrompt().AddMessage("user", "Hello, Claude!"))
+	if err != nil {
+		t.Fatalf("GenerateStream returned error: %v", err)
+	}
+
+	var response string
+	var done bool
+	for chunk := range stream {
+		if chunk.Err != nil {
+			t.Fatalf("Stream returned error: %v", chunk.Err)
+		}
+		response += chunk.Content
+		done = chunk.Done
+	}
+
+	if !done {
+		t.Error("Expected the last chunk to be marked as done")
+	}
+	if expected := "This is a test response."; response != expected {
+		t.Errorf("Expected response '%s', got '%s'", expected, response)
+	}
+}
+
+func TestAnthropicErrors(t *testing.T) {
+	t.Parallel()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(529)
+		fmt.Fprint(w, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`)
+	}))
+	defer mockServer.Close()
+
+	backend := &AnthropicBackend{
+		APIKey:     "test-api-key",
+		Model:      "claude-3-5-sonnet",
+		HTTPClient: mockServer.Client(),
+		BaseURL:    mockServer.URL,
+	}
+
+	_, err := backend.Generate(context.Background(), NewPrompt().AddMessage("user", "Hello, Claude!"))
+
+	var serverErr *ServerUnavailableError
+	if !errors.As(err, &serverErr) {
+		t.Fatalf("Expected ServerUnavailableError, got %T: %v", err, err)
+	}
+	if serverErr.Provider != "anthropic" || serverErr.Type != "overloaded_error" || serverErr.Message != "Overloaded" {
+		t.Errorf("Unexpected error details: %+v", serverErr.APIError)
+	}
+}
+
+func TestAnthropicMessagesWithImages(t *testing.T) {
+	t.Parallel()
+	image := []byte("\xff\xd8\xff\xe0fake jpeg")
+	_, messages := anthropicMessages([]Message{{
+		Role: "user",
+		Parts: []ContentPart{
+			TextPart("What is in this photo?"),
+			ImagePart(image, "image/jpeg"),
+			ImageURLPart("https://example.com/b.png"),
+		},
+	}})
+
+	if len(messages) != 1 || len(messages[0].Content) != 3 {
+		t.Fatalf("Expected one message with three blocks, got %+v", messages)
+	}
+	blocks := messages[0].Content
+	if blocks[0].Type != "text" || blocks[0].Text != "What is in this photo?" {
+		t.Errorf("Unexpected text block: %+v", blocks[0])
+	}
+	if blocks[1].Type != "image" || blocks[1].Source == nil || blocks[1].Source.Type != "base64" ||
+		blocks[1].Source.MediaType != "image/jpeg" || blocks[1].Source.Data != base64.StdEncoding.EncodeToString(image) {
+		t.Errorf("Unexpected base64 image block: %+v", blocks[1])
+	}
+	if blocks[2].Type != "image" || blocks[2].Source == nil || blocks[2].Source.Type != "url" ||
+		blocks[2].Source.URL != "https://example.com/b.png" {
+		t.Errorf("Unexpected URL image block: %+v", blocks[2])
+	}
+}
+
+func TestAnthropicMessagesSkipEmptyText(t *testing.T) {
+	t.Parallel()
+	_, messages := anthropicMessages([]Message{
+		{Role: "user", Content: "What is the weather in Paris?"},
+		{Role: "assistant", ToolCalls: []ToolCall{{
+			ID:       "toolu_1",
+			Function: FunctionCall{Name: "get_weather", Arguments: json.RawMessage(`{"city":"Paris"}`)},
+		}}},
+		{Role: "tool", Content: "Sunny", ToolCallID: "toolu_1"},
+		{Role: "assistant", Parts: []ContentPart{TextPart("")}},
+		{Role: "user", Content: "Thanks"},
+	})
+
+	if len(messages) != 3 {
+		t.Fatalf("Expected the empty assistant turn to be dropped, got %+v", messages)
+	}
+	for _, message := range messages {
+		for _, block := range message.Content {
+			if block.Type == "text" && block.Text == "" {
+				t.Errorf("Expected no empty text blocks, got %+v", message)
+			}
+		}
+	}
+	if len(messages[1].Content) != 1 || messages[1].Content[0].Type != "tool_use" {
+		t.Errorf("Expected the tool-only turn to hold just its tool_use block, got %+v", messages[1].Content)
+	}
+	if messages[2].Role != "user" || len(messages[2].Content) != 2 {
+		t.Errorf("Expected the tool result and the next user message to be merged, got %+v", messages[2])
+	}
+}
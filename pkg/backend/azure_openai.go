@@ -0,0 +1,89 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// azureDefaultAPIVersion is the Azure OpenAI API version used when AzureConfig.APIVersion is empty.
+const azureDefaultAPIVersion = "2024-06-01"
+
+// AzureConfig configures an OpenAIBackend to send requests to an Azure OpenAI
+// resource. Requests are addressed to a deployment rather than a model, and are
+// authenticated with the api-key header or, if TokenProvider is set, with a
+// Microsoft Entra ID bearer token.
+type AzureConfig struct {
+	// Deployment is the name of the model deployment that serves the requests.
+	Deployment string
+	// APIVersion is sent as the api-version query parameter. If empty, 2024-06-01 is used.
+	APIVersion string
+	// TokenProvider, when set, returns an Entra ID access token for each request,
+	// which is sent as a bearer token instead of the api-key header.
+	TokenProvider func(ctx context.Context) (string, error)
+}
+
+// NewAzureOpenAIBackend creates and returns a new OpenAIBackend that sends requests
+// to a deployment of an Azure OpenAI resource, authenticated with an API key. To
+// authenticate with Entra ID instead, set Azure.TokenProvider on the result.
+//
+// Parameters:
+//   - endpoint: The resource endpoint, such as https://my-resource.openai.azure.com.
+//   - deployment: The name of the model deployment to use.
+//   - apiKey: The API key of the Azure OpenAI resource.
+//   - apiVersion: The Azure OpenAI API version. If empty, a default version is used.
+//   - timeout: The duration for the HTTP client timeout. If zero, the default timeout is used.
+//
+// Returns:
+//   - A pointer to a new OpenAIBackend instance configured for the Azure deployment.
+func NewAzureOpenAIBackend(endpoint, deployment, apiKey, apiVersion string, timeout time.Duration) *OpenAIBackend {
+	backend := NewOpenAIBackend(apiKey, deployment, timeout)
+	backend.BaseURL = strings.TrimSuffix(endpoint, "/")
+	backend.Azure = &AzureConfig{
+		Deployment: deployment,
+		APIVersion: apiVersion,
+	}
+	return backend
+}
+
+// endpointURL returns the deployment-scoped URL of the given API operation.
+func (c *AzureConfig) endpointURL(baseURL, operation string) string {
+	version := c.APIVersion
+	if version == "" {
+		version = azureDefaultAPIVersion
+	}
+	return baseURL + "/openai/deployments/" + url.PathEscape(c.Deployment) + operation +
+		"?api-version=" + url.QueryEscape(version)
+}
+
+// authorize sets the credentials of req, using a token from TokenProvider if one
+// is configured and apiKey otherwise.
+func (c *AzureConfig) authorize(ctx context.Context, req *http.Request, apiKey string) error {
+	if c.TokenProvider == nil {
+		req.Header.Set("Api-Key", apiKey)
+		return nil
+	}
+
+	token, err := c.TokenProvider(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get Azure access token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
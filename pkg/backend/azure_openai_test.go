@@ -0,0 +1,107 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAzureOpenAIGenerate(t *testing.T) {
+	t.Parallel()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/openai/deployments/gpt-4o-prod/chat/completions" {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+		if version := r.URL.Query().Get("api-version"); version != "2024-10-21" {
+			t.Errorf("Expected api-version 2024-10-21, got %s", version)
+		}
+		if r.Header.Get("Api-Key") != "azure-key" {
+			t.Errorf("Expected api-key azure-key, got %s", r.Header.Get("Api-Key"))
+		}
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("Expected no Authorization header, got %s", r.Header.Get("Authorization"))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Apim-Request-Id", "apim-123")
+		fmt.Fprint(w, `{"model":"gpt-4o","choices":[{"index":0,"finish_reason":"stop",`+
+			`"message":{"role":"assistant","content":"Hello"},`+
+			`"content_filter_results":{"hate":{"filtered":false,"severity":"safe"},"violence":{"filtered":false,"severity":"low"}}}],`+
+			`"prompt_filter_results":[{"prompt_index":0,"content_filter_results":{"jailbreak":{"filtered":false,"detected":true}}}]}`)
+	}))
+	defer mockServer.Close()
+
+	backend := NewAzureOpenAIBackend(mockServer.URL+"/", "gpt-4o-prod", "azure-key", "2024-10-21", 10*time.Second)
+
+	result, err := backend.GenerateWithResult(context.Background(), NewPrompt().AddMessage("user", "Hi"))
+	if err != nil {
+		t.Fatalf("GenerateWithResult returned error: %v", err)
+	}
+
+	if result.Content() != "Hello" {
+		t.Errorf("Expected response 'Hello', got '%s'", result.Content())
+	}
+	if result.RequestID != "apim-123" {
+		t.Errorf("Expected request ID apim-123, got %s", result.RequestID)
+	}
+	if got := result.CompletionFilterResults["violence"]; got.Severity != "low" || got.Filtered {
+		t.Errorf("Unexpected violence filter result: %+v", got)
+	}
+	if result.CompletionFilterResults.Filtered() {
+		t.Error("Expected the completion not to be filtered")
+	}
+	if !result.PromptFilterResults["jailbreak"].Detected {
+		t.Errorf("Expected a jailbreak to be detected, got %+v", result.PromptFilterResults)
+	}
+}
+
+func TestAzureOpenAITokenProvider(t *testing.T) {
+	t.Parallel()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/openai/deployments/embeddings/embeddings" {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+		if version := r.URL.Query().Get("api-version"); version != azureDefaultAPIVersion {
+			t.Errorf("Expected default api-version, got %s", version)
+		}
+		if r.Header.Get("Authorization") != "Bearer entra-token" {
+			t.Errorf("Expected Authorization Bearer entra-token, got %s", r.Header.Get("Authorization"))
+		}
+		if r.Header.Get("Api-Key") != "" {
+			t.Errorf("Expected no api-key header, got %s", r.Header.Get("Api-Key"))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"data":[{"index":0,"embedding":[0.1,0.2,0.3]}]}`)
+	}))
+	defer mockServer.Close()
+
+	backend := NewAzureOpenAIBackend(mockServer.URL, "embeddings", "", "", 10*time.Second)
+	backend.Azure.TokenProvider = func(context.Context) (string, error) {
+		return "entra-token", nil
+	}
+
+	embedding, err := backend.Embed(context.Background(), "Hello")
+	if err != nil {
+		t.Fatalf("Embed returned error: %v", err)
+	}
+	if len(embedding) != 3 {
+		t.Errorf("Expected 3 dimensions, got %d", len(embedding))
+	}
+}
@@ -13,18 +13,59 @@
 // limitations under the License.
 package backend
 
-import "context"
+import (
+	"context"
+	"fmt"
+)
 
-// Backend defines the interface for interacting with various LLM backends.
-type Backend interface {
+// Generator is implemented by backends that can generate a response to a prompt.
+//
+// Generate returns only the generated text, while GenerateWithResult also reports
+// the finish reason, token usage and other metadata about the generation.
+type Generator interface {
 	Generate(ctx context.Context, prompt *Prompt) (string, error)
+	GenerateWithResult(ctx context.Context, prompt *Prompt) (*GenerateResult, error)
+}
+
+// Embedder is implemented by backends that can turn text into embedding vectors.
+//
+// EmbedBatch embeds several inputs at once, splitting them into as many requests
+// as the provider's limits require, and returns the embeddings in input order.
+type Embedder interface {
 	Embed(ctx context.Context, input string) ([]float32, error)
+	EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error)
+}
+
+// Backend defines the interface for interacting with various LLM backends that
+// support both generation and embeddings.
+type Backend interface {
+	Generator
+	Embedder
+}
+
+// Streamer is implemented by backends that can stream a generation as it is produced.
+//
+// GenerateStream returns a channel that receives the response in chunks. The channel
+// is closed after the final chunk, which either has Done set or carries an error.
+// Cancelling ctx aborts the underlying request and closes the channel.
+type Streamer interface {
+	GenerateStream(ctx context.Context, prompt *Prompt) (<-chan StreamChunk, error)
 }
 
 // Message represents a single role-based message in the conversation.
+//
+// Assistant messages may carry ToolCalls requested by the model. The result of
+// running a tool is sent back as a message with the "tool" role and the
+// ToolCallID of the call it answers.
+//
+// Multimodal messages carry Parts, such as images, which follow Content. Backends
+// that only handle text send the message's Text and reject images.
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role       string        `json:"role"`
+	Content    string        `json:"content"`
+	Parts      []ContentPart `json:"parts,omitempty"`
+	ToolCalls  []ToolCall    `json:"tool_calls,omitempty"`
+	ToolCallID string        `json:"tool_call_id,omitempty"`
 }
 
 // Parameters defines generation settings for LLM completions.
@@ -34,12 +75,31 @@ type Parameters struct {
 	TopP             float64 `json:"top_p"`
 	FrequencyPenalty float64 `json:"frequency_penalty"`
 	PresencePenalty  float64 `json:"presence_penalty"`
+	// RepeatPenalty, Seed and NumCtx are honoured by backends that support them,
+	// such as Ollama, and ignored otherwise.
+	RepeatPenalty float64 `json:"repeat_penalty,omitempty"`
+	Seed          int     `json:"seed,omitempty"`
+	NumCtx        int     `json:"num_ctx,omitempty"`
 }
 
 // Prompt represents a structured prompt with role-based messages and parameters.
 type Prompt struct {
 	Messages   []Message  `json:"messages"`
 	Parameters Parameters `json:"parameters"`
+	Tools      []Tool     `json:"tools,omitempty"`
+	// ResponseFormat, when set, constrains the response to JSON matching a schema.
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+}
+
+// ResponseFormat describes the JSON Schema the generated response must conform to.
+// It is sent as OpenAI's json_schema response format and as Ollama's format field.
+type ResponseFormat struct {
+	// Name identifies the schema; OpenAI requires one.
+	Name string `json:"name"`
+	// Schema is the JSON Schema of the expected response.
+	Schema map[string]interface{} `json:"schema"`
+	// Strict asks backends that support it to enforce the schema exactly.
+	Strict bool `json:"strict,omitempty"`
 }
 
 // NewPrompt creates and returns a new Prompt.
@@ -47,14 +107,70 @@ func NewPrompt() *Prompt {
 	return &Prompt{}
 }
 
+// Clone returns a copy of the prompt whose messages and tools can be modified
+// without affecting the original.
+func (p *Prompt) Clone() *Prompt {
+	clone := *p
+	clone.Messages = append([]Message(nil), p.Messages...)
+	clone.Tools = append([]Tool(nil), p.Tools...)
+	return &clone
+}
+
 // AddMessage adds a message with a specific role to the prompt.
 func (p *Prompt) AddMessage(role, content string) *Prompt {
 	p.Messages = append(p.Messages, Message{Role: role, Content: content})
 	return p
 }
 
+// AddMessageWithParts adds a multimodal message made of content parts, such as
+// text and images, to the prompt.
+func (p *Prompt) AddMessageWithParts(role string, parts ...ContentPart) *Prompt {
+	p.Messages = append(p.Messages, Message{Role: role, Parts: parts})
+	return p
+}
+
+// AppendMessage appends a complete message to the prompt, such as an assistant
+// reply carrying tool calls.
+func (p *Prompt) AppendMessage(message Message) *Prompt {
+	p.Messages = append(p.Messages, message)
+	return p
+}
+
+// AddToolResult adds the result of a tool call to the prompt as a "tool" message.
+func (p *Prompt) AddToolResult(toolCallID, content string) *Prompt {
+	p.Messages = append(p.Messages, Message{Role: "tool", Content: content, ToolCallID: toolCallID})
+	return p
+}
+
+// AddTool declares a tool that the model may call.
+func (p *Prompt) AddTool(tool Tool) *Prompt {
+	p.Tools = append(p.Tools, tool)
+	return p
+}
+
 // SetParameters sets the generation parameters for the prompt.
 func (p *Prompt) SetParameters(params Parameters) *Prompt {
 	p.Parameters = params
 	return p
 }
+
+// embedInBatches embeds inputs in consecutive batches of at most size inputs using
+// embed, and returns the embeddings in input order.
+func embedInBatches(
+	ctx context.Context, inputs []string, size int,
+	embed func(ctx context.Context, batch []string) ([][]float32, error),
+) ([][]float32, error) {
+	embeddings := make([][]float32, 0, len(inputs))
+	for start := 0; start < len(inputs); start += size {
+		end := min(start+size, len(inputs))
+		batch, err := embed(ctx, inputs[start:end])
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) != end-start {
+			return nil, fmt.Errorf("expected %d embeddings, got %d", end-start, len(batch))
+		}
+		embeddings = append(embeddings, batch...)
+	}
+	return embeddings, nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backendtest
+
+import (
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Embedding returns a deterministic, unit-length embedding of text with the given
+// number of dimensions.
+//
+// The embedding is a hashed bag of words: every lower-cased word, and with a
+// smaller weight every character trigram of it, is hashed onto a dimension and
+// a sign. Texts that share words therefore have a high cosine similarity, and
+// unrelated texts are close to orthogonal. Text without any words embeds to the
+// zero vector.
+func Embedding(text string, dimensions int) []float32 {
+	if dimensions <= 0 {
+		dimensions = DefaultDimensions
+	}
+
+	vector := make([]float64, dimensions)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, word := range words {
+		addFeature(vector, "w:"+word, 1)
+		padded := []rune("^" + word + "$")
+		for i := 0; i+3 <= len(padded); i++ {
+			addFeature(vector, "t:"+string(padded[i:i+3]), 0.25)
+		}
+	}
+
+	var norm float64
+	for _, v := range vector {
+		norm += v * v
+	}
+	norm = math.Sqrt(norm)
+
+	embedding := make([]float32, dimensions)
+	if norm == 0 {
+		return embedding
+	}
+	for i, v := range vector {
+		embedding[i] = float32(v / norm)
+	}
+	return embedding
+}
+
+// addFeature adds weight to the dimension the feature hashes to, with a sign
+// taken from the hash so that collisions cancel out on average.
+func addFeature(vector []float64, feature string, weight float64) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(feature))
+	sum := h.Sum64()
+
+	index := int(sum % uint64(len(vector)))
+	if sum>>63 == 1 {
+		weight = -weight
+	}
+	vector[index] += weight
+}
@@ -0,0 +1,352 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backendtest provides a scriptable fake backend for testing code built
+// on gorag without running a model. The fake returns canned or rule-based
+// responses, computes deterministic embeddings in which similar texts are close
+// together, records every request, and can inject errors and latency.
+package backendtest
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stackloklabs/gorag/pkg/backend"
+)
+
+const (
+	// DefaultDimensions is the size of the embeddings returned by a Fake unless
+	// WithDimensions is used.
+	DefaultDimensions = 256
+	// DefaultResponse is the response of a Fake when no canned response or rule applies.
+	DefaultResponse = "This is a fake response."
+	// Model is the model name reported in the results of a Fake.
+	Model = "fake"
+)
+
+// Ensure Fake implements the backend interfaces.
+var (
+	_ backend.Backend  = (*Fake)(nil)
+	_ backend.Streamer = (*Fake)(nil)
+)
+
+// Responder computes the response to a prompt.
+type Responder func(prompt *backend.Prompt) (string, error)
+
+// Option represents an option for New.
+type Option func(*Fake)
+
+type rule struct {
+	contains string
+	response string
+}
+
+// Fake is a deterministic, in-memory backend for tests. It is safe for concurrent use.
+//
+// Responses are chosen in this order: the queue of canned responses set with
+// WithResponses, the first matching rule added with WithRule, the Responder set
+// with WithResponder, and finally the default response.
+type Fake struct {
+	mu              sync.Mutex
+	responses       []string
+	rules           []rule
+	responder       Responder
+	defaultResponse string
+	dimensions      int
+	latency         time.Duration
+	err             error
+	errs            []error
+
+	prompts []*backend.Prompt
+	embeds  []string
+}
+
+// New creates a new Fake configured with the given options.
+func New(opts ...Option) *Fake {
+	f := &Fake{
+		defaultResponse: DefaultResponse,
+		dimensions:      DefaultDimensions,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// WithResponses queues canned responses that are returned, in order, by
+// successive generations.
+func WithResponses(responses ...string) Option {
+	return func(f *Fake) {
+		f.responses = append(f.responses, responses...)
+	}
+}
+
+// WithRule returns response for prompts whose last user message contains the
+// given text, ignoring case. Rules are tried in the order they were added.
+func WithRule(contains, response string) Option {
+	return func(f *Fake) {
+		f.rules = append(f.rules, rule{contains: strings.ToLower(contains), response: response})
+	}
+}
+
+// WithResponder computes responses with fn when no canned response or rule applies.
+func WithResponder(fn Responder) Option {
+	return func(f *Fake) {
+		f.responder = fn
+	}
+}
+
+// WithDefaultResponse sets the response returned when nothing else applies.
+func WithDefaultResponse(response string) Option {
+	return func(f *Fake) {
+		f.defaultResponse = response
+	}
+}
+
+// WithDimensions sets the size of the embeddings.
+func WithDimensions(dimensions int) Option {
+	return func(f *Fake) {
+		f.dimensions = dimensions
+	}
+}
+
+// WithLatency delays every call by d, or until the context is done.
+func WithLatency(d time.Duration) Option {
+	return func(f *Fake) {
+		f.latency = d
+	}
+}
+
+// WithError makes every call fail with err.
+func WithError(err error) Option {
+	return func(f *Fake) {
+		f.err = err
+	}
+}
+
+// WithErrors makes successive calls fail with the given errors, in order. A nil
+// entry lets the corresponding call succeed. Once the errors are used up, calls
+// succeed. This is useful to test retries, for example with a
+// *backend.RateLimitError followed by success.
+func WithErrors(errs ...error) Option {
+	return func(f *Fake) {
+		f.errs = append(f.errs, errs...)
+	}
+}
+
+// SetError makes every subsequent call fail with err, or succeed again if err is nil.
+func (f *Fake) SetError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// Prompts returns copies of the prompts received by the generation methods, in
+// the order they were received.
+func (f *Fake) Prompts() []*backend.Prompt {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	prompts := make([]*backend.Prompt, len(f.prompts))
+	for i, p := range f.prompts {
+		prompts[i] = p.Clone()
+	}
+	return prompts
+}
+
+// LastPrompt returns a copy of the last prompt received, or nil if there was none.
+func (f *Fake) LastPrompt() *backend.Prompt {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.prompts) == 0 {
+		return nil
+	}
+	return f.prompts[len(f.prompts)-1].Clone()
+}
+
+// EmbeddedTexts returns the texts received by Embed and EmbedBatch, in order.
+func (f *Fake) EmbeddedTexts() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.embeds...)
+}
+
+// Reset forgets the recorded prompts and embedded texts.
+func (f *Fake) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prompts = nil
+	f.embeds = nil
+}
+
+// Generate returns the scripted response to the prompt.
+func (f *Fake) Generate(ctx context.Context, prompt *backend.Prompt) (string, error) {
+	result, err := f.GenerateWithResult(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	return result.Content(), nil
+}
+
+// GenerateWithResult returns the scripted response to the prompt. Token usage
+// is estimated by counting words.
+func (f *Fake) GenerateWithResult(ctx context.Context, prompt *backend.Prompt) (*backend.GenerateResult, error) {
+	start := time.Now()
+	response, err := f.generate(ctx, prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	promptTokens := 0
+	for _, message := range prompt.Messages {
+		promptTokens += len(strings.Fields(message.Text()))
+	}
+	completionTokens := len(strings.Fields(response))
+
+	return &backend.GenerateResult{
+		Message:      backend.Message{Role: "assistant", Content: response},
+		FinishReason: backend.FinishReasonStop,
+		Usage: backend.Usage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
+		},
+		Model:   Model,
+		Latency: time.Since(start),
+	}, nil
+}
+
+// GenerateStream delivers the scripted response to the prompt one word at a time.
+func (f *Fake) GenerateStream(ctx context.Context, prompt *backend.Prompt) (<-chan backend.StreamChunk, error) {
+	response, err := f.generate(ctx, prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := make(chan backend.StreamChunk)
+	go func() {
+		defer close(chunks)
+		for _, word := range strings.SplitAfter(response, " ") {
+			if word == "" {
+				continue
+			}
+			select {
+			case chunks <- backend.StreamChunk{Content: word}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case chunks <- backend.StreamChunk{Done: true}:
+		case <-ctx.Done():
+		}
+	}()
+	return chunks, nil
+}
+
+// Embed returns the deterministic embedding of input.
+func (f *Fake) Embed(ctx context.Context, input string) ([]float32, error) {
+	if err := f.call(ctx, func() { f.embeds = append(f.embeds, input) }); err != nil {
+		return nil, err
+	}
+	return Embedding(input, f.dims()), nil
+}
+
+// EmbedBatch returns the deterministic embeddings of inputs.
+func (f *Fake) EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	if err := f.call(ctx, func() { f.embeds = append(f.embeds, inputs...) }); err != nil {
+		return nil, err
+	}
+	dimensions := f.dims()
+	embeddings := make([][]float32, len(inputs))
+	for i, input := range inputs {
+		embeddings[i] = Embedding(input, dimensions)
+	}
+	return embeddings, nil
+}
+
+func (f *Fake) dims() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dimensions
+}
+
+// generate records the prompt and picks its response.
+func (f *Fake) generate(ctx context.Context, prompt *backend.Prompt) (string, error) {
+	if err := f.call(ctx, func() { f.prompts = append(f.prompts, prompt.Clone()) }); err != nil {
+		return "", err
+	}
+
+	f.mu.Lock()
+	if len(f.responses) > 0 {
+		response := f.responses[0]
+		f.responses = f.responses[1:]
+		f.mu.Unlock()
+		return response, nil
+	}
+	last := strings.ToLower(lastUserMessage(prompt))
+	for _, r := range f.rules {
+		if strings.Contains(last, r.contains) {
+			f.mu.Unlock()
+			return r.response, nil
+		}
+	}
+	responder, response := f.responder, f.defaultResponse
+	f.mu.Unlock()
+
+	if responder != nil {
+		return responder(prompt)
+	}
+	return response, nil
+}
+
+// call records a request with record, waits for the configured latency and
+// returns the injected error for the call, if any.
+func (f *Fake) call(ctx context.Context, record func()) error {
+	f.mu.Lock()
+	record()
+	latency := f.latency
+	err := f.err
+	if len(f.errs) > 0 {
+		if err == nil {
+			err = f.errs[0]
+		}
+		f.errs = f.errs[1:]
+	}
+	f.mu.Unlock()
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+func lastUserMessage(prompt *backend.Prompt) string {
+	for i := len(prompt.Messages) - 1; i >= 0; i-- {
+		if prompt.Messages[i].Role == "user" {
+			return prompt.Messages[i].Text()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backendtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stackloklabs/gorag/pkg/backend"
+)
+
+func TestFakeResponses(t *testing.T) {
+	t.Parallel()
+	fake := New(
+		WithResponses("first", "second"),
+		WithRule("moon landing", "July 20, 1969"),
+		WithDefaultResponse("no idea"),
+	)
+	ctx := context.Background()
+
+	expected := []string{"first", "second", "July 20, 1969", "no idea"}
+	questions := []string{"a", "b", "When was the MOON LANDING?", "What is the meaning of life?"}
+	for i, question := range questions {
+		response, err := fake.Generate(ctx, backend.NewPrompt().AddMessage("user", question))
+		if err != nil {
+			t.Fatalf("Generate returned error: %v", err)
+		}
+		if response != expected[i] {
+			t.Errorf("Expected response %q, got %q", expected[i], response)
+		}
+	}
+
+	prompts := fake.Prompts()
+	if len(prompts) != len(questions) {
+		t.Fatalf("Expected %d recorded prompts, got %d", len(questions), len(prompts))
+	}
+	if got := fake.LastPrompt().Messages[0].Content; got != questions[3] {
+		t.Errorf("Expected the last prompt to be %q, got %q", questions[3], got)
+	}
+}
+
+func TestFakeStream(t *testing.T) {
+	t.Parallel()
+	fake := New(WithResponses("streamed fake response"))
+
+	stream, err := fake.GenerateStream(context.Background(), backend.NewPrompt().AddMessage("user", "Hi"))
+	if err != nil {
+		t.Fatalf("GenerateStream returned error: %v", err)
+	}
+
+	var response string
+	var chunks int
+	var done bool
+	for chunk := range stream {
+		response += chunk.Content
+		done = chunk.Done
+		chunks++
+	}
+	if response != "streamed fake response" || !done || chunks != 4 {
+		t.Errorf("Unexpected stream: %q in %d chunks, done=%v", response, chunks, done)
+	}
+}
+
+func TestFakeEmbeddingSimilarity(t *testing.T) {
+	t.Parallel()
+	fake := New(WithDimensions(128))
+
+	embeddings, err := fake.EmbedBatch(context.Background(), []string{
+		"The moon landing happened in 1969.",
+		"When did the moon landing happen?",
+		"Bake the bread at 220 degrees for forty minutes.",
+	})
+	if err != nil {
+		t.Fatalf("EmbedBatch returned error: %v", err)
+	}
+	if len(embeddings[0]) != 128 {
+		t.Fatalf("Expected 128 dimensions, got %d", len(embeddings[0]))
+	}
+
+	similar := cosine(embeddings[0], embeddings[1])
+	unrelated := cosine(embeddings[0], embeddings[2])
+	if similar <= unrelated+0.2 {
+		t.Errorf("Expected related texts to be closer: similar=%f unrelated=%f", similar, unrelated)
+	}
+
+	again, err := fake.Embed(context.Background(), "The moon landing happened in 1969.")
+	if err != nil {
+		t.Fatalf("Embed returned error: %v", err)
+	}
+	if cosine(again, embeddings[0]) < 0.9999 {
+		t.Error("Expected embeddings to be deterministic")
+	}
+	if got := len(fake.EmbeddedTexts()); got != 4 {
+		t.Errorf("Expected 4 recorded texts, got %d", got)
+	}
+}
+
+func TestFakeErrorsAndLatency(t *testing.T) {
+	t.Parallel()
+	rateLimited := &backend.RateLimitError{}
+	fake := New(WithErrors(rateLimited, nil), WithLatency(time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := fake.Embed(ctx, "Hi"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded while waiting, got %v", err)
+	}
+
+	fake = New(WithErrors(rateLimited, nil))
+	prompt := backend.NewPrompt().AddMessage("user", "Hi")
+	if _, err := fake.Generate(context.Background(), prompt); !errors.Is(err, rateLimited) {
+		t.Errorf("Expected the injected error, got %v", err)
+	}
+	if _, err := fake.Generate(context.Background(), prompt); err != nil {
+		t.Errorf("Expected the second call to succeed, got %v", err)
+	}
+
+	failure := errors.New("boom")
+	fake.SetError(failure)
+	if _, err := fake.EmbedBatch(context.Background(), []string{"Hi"}); !errors.Is(err, failure) {
+		t.Errorf("Expected %v, got %v", failure, err)
+	}
+}
+
+func cosine(a, b []float32) float64 {
+	var dot float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+	}
+	return dot
+}
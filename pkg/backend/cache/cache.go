@@ -0,0 +1,312 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache caches embeddings and, when asked to, deterministic generations
+// of a backend, so that re-running ingestion over an unchanged corpus or
+// repeating an evaluation does not call the model again.
+//
+// The cache is a backend.Middleware backed by a Store. The package provides an
+// in-memory LRU store and a persistent file-backed store:
+//
+//	store, err := cache.NewFileStore(".cache/embeddings")
+//	...
+//	cached := backend.Wrap(ollama, cache.Middleware(store, ollama.Model, cache.WithTTL(30*24*time.Hour)))
+//	embedding, err := cached.Embed(ctx, chunk)
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/stackloklabs/gorag/pkg/backend"
+)
+
+// keyVersion is part of every key, so that changing the key format invalidates
+// old entries instead of misreading them.
+const keyVersion = 2
+
+// Store holds cached values by key. Implementations must be safe for concurrent use.
+type Store interface {
+	// Get returns the value stored under key, and whether there was an unexpired one.
+	Get(key string) ([]byte, bool, error)
+	// Set stores value under key. It expires after ttl, or never if ttl is zero.
+	Set(key string, value []byte, ttl time.Duration) error
+}
+
+// Option represents an option for Middleware.
+type Option func(*config)
+
+type config struct {
+	ttl           time.Duration
+	deterministic func(prompt *backend.Prompt) bool
+	onError       func(err error)
+}
+
+// WithTTL sets how long cached values are kept. By default they never expire.
+func WithTTL(ttl time.Duration) Option {
+	return func(c *config) {
+		c.ttl = ttl
+	}
+}
+
+// WithGenerateFilter sets the function that decides whether a generation is
+// deterministic enough to be cached. By default no generation is cached, as
+// whether a prompt gives the same answer every time depends on the backend;
+// IsDeterministic is a filter for backends that send a zero temperature.
+func WithGenerateFilter(deterministic func(prompt *backend.Prompt) bool) Option {
+	return func(c *config) {
+		c.deterministic = deterministic
+	}
+}
+
+// WithErrorHandler sets a function that is called with the errors of the store.
+// Store errors never fail a call: a failed lookup is treated as a miss and a
+// failed write is dropped. By default they are ignored.
+func WithErrorHandler(onError func(err error)) Option {
+	return func(c *config) {
+		c.onError = onError
+	}
+}
+
+// IsDeterministic reports whether a generation is expected to give the same
+// answer every time: its temperature is zero and it declares no tools.
+//
+// It only holds for backends that send a zero temperature, such as OpenAI and
+// Ollama. Anthropic and llama.cpp leave it out and sample with the server's
+// default, so do not use this filter for them.
+//
+// Some backends, such as Ollama, treat a zero temperature as unset and sample
+// with the model's default; use WithGenerateFilter to require a Seed for them.
+func IsDeterministic(prompt *backend.Prompt) bool {
+	return prompt.Parameters.Temperature == 0 && len(prompt.Tools) == 0
+}
+
+type bypassKey struct{}
+
+type bypassMode int
+
+const (
+	bypassNone bypassMode = iota
+	bypassAll
+	bypassRead
+)
+
+// Bypass returns a context for which the cache is neither read nor written.
+func Bypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassKey{}, bypassAll)
+}
+
+// Refresh returns a context for which the cache is not read, but fresh results
+// are stored, replacing the cached ones.
+func Refresh(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassKey{}, bypassRead)
+}
+
+func bypassOf(ctx context.Context) bypassMode {
+	mode, _ := ctx.Value(bypassKey{}).(bypassMode)
+	return mode
+}
+
+// Middleware returns middleware that caches the embeddings of a backend in store,
+// and the generations accepted by the filter set with WithGenerateFilter. Keys combine model, the operation, the
+// input without trailing whitespace and the generation parameters; use a
+// distinct model name for every model sharing a store. Streams are not cached.
+//
+// Parameters:
+//   - store: Where cached values are kept.
+//   - model: The model of the wrapped backend, which is part of every key.
+//   - opts: Options setting the TTL, the generation filter and error handling.
+//
+// Returns:
+//   - The caching middleware, to be applied with backend.Wrap.
+func Middleware(store Store, model string, opts ...Option) backend.Middleware {
+	c := &cacher{
+		store: store,
+		model: model,
+		config: config{
+			deterministic: func(*backend.Prompt) bool { return false },
+			onError:       func(error) {},
+		},
+	}
+	for _, opt := range opts {
+		opt(&c.config)
+	}
+
+	return backend.Middleware{
+		Generate: func(next backend.GenerateFunc) backend.GenerateFunc {
+			return func(ctx context.Context, prompt *backend.Prompt) (*backend.GenerateResult, error) {
+				return c.generate(ctx, next, prompt)
+			}
+		},
+		Embed: func(next backend.EmbedFunc) backend.EmbedFunc {
+			return func(ctx context.Context, inputs []string) ([][]float32, error) {
+				return c.embed(ctx, next, inputs)
+			}
+		},
+	}
+}
+
+type cacher struct {
+	config
+	store Store
+	model string
+}
+
+func (c *cacher) generate(
+	ctx context.Context, next backend.GenerateFunc, prompt *backend.Prompt,
+) (*backend.GenerateResult, error) {
+	mode := bypassOf(ctx)
+	if mode == bypassAll || !c.deterministic(prompt) {
+		return next(ctx, prompt)
+	}
+
+	key, err := c.key("generate", generateKeyInput(prompt))
+	if err != nil {
+		c.onError(err)
+		return next(ctx, prompt)
+	}
+	if mode != bypassRead {
+		var result backend.GenerateResult
+		if c.lookup(key, &result) {
+			return &result, nil
+		}
+	}
+
+	result, err := next(ctx, prompt)
+	if err != nil {
+		return nil, err
+	}
+	c.save(key, result)
+	return result, nil
+}
+
+func (c *cacher) embed(ctx context.Context, next backend.EmbedFunc, inputs []string) ([][]float32, error) {
+	mode := bypassOf(ctx)
+	if mode == bypassAll {
+		return next(ctx, inputs)
+	}
+
+	embeddings := make([][]float32, len(inputs))
+	keys := make([]string, len(inputs))
+	var missing []int
+	for i, input := range inputs {
+		key, err := c.key("embed", normalizeText(input))
+		if err != nil {
+			c.onError(err)
+		}
+		keys[i] = key
+		if mode == bypassRead || key == "" || !c.lookup(key, &embeddings[i]) {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 {
+		return embeddings, nil
+	}
+
+	batch := make([]string, len(missing))
+	for j, i := range missing {
+		batch[j] = inputs[i]
+	}
+	computed, err := next(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+	if len(computed) != len(batch) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(batch), len(computed))
+	}
+	for j, i := range missing {
+		embeddings[i] = computed[j]
+		if keys[i] != "" {
+			c.save(keys[i], computed[j])
+		}
+	}
+	return embeddings, nil
+}
+
+// lookup decodes the value stored under key into out and reports whether it was found.
+func (c *cacher) lookup(key string, out interface{}) bool {
+	data, ok, err := c.store.Get(key)
+	if err != nil {
+		c.onError(fmt.Errorf("failed to read from cache: %w", err))
+		return false
+	}
+	if !ok {
+		return false
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		c.onError(fmt.Errorf("failed to decode cached value: %w", err))
+		return false
+	}
+	return true
+}
+
+// save encodes value and stores it under key.
+func (c *cacher) save(key string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		c.onError(fmt.Errorf("failed to encode value for cache: %w", err))
+		return
+	}
+	if err := c.store.Set(key, data, c.ttl); err != nil {
+		c.onError(fmt.Errorf("failed to write to cache: %w", err))
+	}
+}
+
+// key hashes the model, operation and input into a cache key.
+func (c *cacher) key(operation string, input interface{}) (string, error) {
+	data, err := json.Marshal(struct {
+		Version   int         `json:"v"`
+		Model     string      `json:"model"`
+		Operation string      `json:"op"`
+		Input     interface{} `json:"input"`
+	}{keyVersion, c.model, operation, input})
+	if err != nil {
+		return "", fmt.Errorf("failed to compute cache key: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// generateKeyInput returns the parts of a prompt that determine its result, with
+// trailing whitespace removed from the text of messages.
+func generateKeyInput(prompt *backend.Prompt) interface{} {
+	messages := make([]backend.Message, len(prompt.Messages))
+	for i, message := range prompt.Messages {
+		message.Content = normalizeText(message.Content)
+		message.Parts = append([]backend.ContentPart(nil), message.Parts...)
+		for j := range message.Parts {
+			message.Parts[j].Text = normalizeText(message.Parts[j].Text)
+		}
+		messages[i] = message
+	}
+	return struct {
+		Messages       []backend.Message       `json:"messages"`
+		Parameters     backend.Parameters      `json:"parameters"`
+		Tools          []backend.Tool          `json:"tools,omitempty"`
+		ResponseFormat *backend.ResponseFormat `json:"response_format,omitempty"`
+	}{messages, prompt.Parameters, prompt.Tools, prompt.ResponseFormat}
+}
+
+// normalizeText removes trailing whitespace, such as a final newline, which does
+// not change the meaning of text. Other whitespace is kept, as indentation is
+// significant in code and YAML.
+func normalizeText(text string) string {
+	return strings.TrimRightFunc(text, unicode.IsSpace)
+}
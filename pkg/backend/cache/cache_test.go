@@ -0,0 +1,243 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stackloklabs/gorag/pkg/backend"
+)
+
+// countingBackend answers every prompt with the number of calls made so far,
+// and embeds inputs as their length, recording every input it is sent.
+type countingBackend struct {
+	generations int
+	inputs      []string
+}
+
+func (b *countingBackend) Generate(ctx context.Context, prompt *backend.Prompt) (string, error) {
+	result, err := b.GenerateWithResult(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	return result.Content(), nil
+}
+
+func (b *countingBackend) GenerateWithResult(_ context.Context, _ *backend.Prompt) (*backend.GenerateResult, error) {
+	b.generations++
+	return &backend.GenerateResult{
+		Message:      backend.Message{Role: "assistant", Content: string(rune('0' + b.generations))},
+		FinishReason: "stop",
+		Model:        "test-model",
+	}, nil
+}
+
+func (b *countingBackend) Embed(ctx context.Context, input string) ([]float32, error) {
+	embeddings, err := b.EmbedBatch(ctx, []string{input})
+	if err != nil {
+		return nil, err
+	}
+	return embeddings[0], nil
+}
+
+func (b *countingBackend) EmbedBatch(_ context.Context, inputs []string) ([][]float32, error) {
+	b.inputs = append(b.inputs, inputs...)
+	embeddings := make([][]float32, len(inputs))
+	for i, input := range inputs {
+		embeddings[i] = []float32{float32(len(input))}
+	}
+	return embeddings, nil
+}
+
+// failingStore fails every read and write.
+type failingStore struct{}
+
+func (failingStore) Get(string) ([]byte, bool, error) {
+	return nil, false, errors.New("read failed")
+}
+
+func (failingStore) Set(string, []byte, time.Duration) error {
+	return errors.New("write failed")
+}
+
+func TestGenerateCaching(t *testing.T) {
+	t.Parallel()
+	inner := &countingBackend{}
+	cached := backend.Wrap(inner, Middleware(NewLRU(10), "test-model", WithGenerateFilter(IsDeterministic)))
+	ctx := context.Background()
+
+	first, err := cached.GenerateWithResult(ctx, backend.NewPrompt().AddMessage("user", "What is  RAG?"))
+	if err != nil {
+		t.Fatalf("GenerateWithResult returned error: %v", err)
+	}
+	second, err := cached.GenerateWithResult(ctx, backend.NewPrompt().AddMessage("user", "What is  RAG?\n"))
+	if err != nil {
+		t.Fatalf("GenerateWithResult returned error: %v", err)
+	}
+	if inner.generations != 1 {
+		t.Errorf("Expected 1 generation, got %d", inner.generations)
+	}
+	if second.Content() != first.Content() || second.FinishReason != "stop" || second.Model != "test-model" {
+		t.Errorf("Expected the cached result %+v, got %+v", first, second)
+	}
+
+	other := backend.NewPrompt().AddMessage("user", "What is  RAG?")
+	other.Parameters.MaxTokens = 10
+	if _, err := cached.Generate(ctx, other); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if inner.generations != 2 {
+		t.Errorf("Expected different parameters to miss the cache, got %d generations", inner.generations)
+	}
+
+	indented := backend.NewPrompt().AddMessage("user", "Fix:\n  if x:\n    y()")
+	flat := backend.NewPrompt().AddMessage("user", "Fix:\nif x:\ny()")
+	for _, prompt := range []*backend.Prompt{indented, flat} {
+		if _, err := cached.Generate(ctx, prompt); err != nil {
+			t.Fatalf("Generate returned error: %v", err)
+		}
+	}
+	if inner.generations != 4 {
+		t.Errorf("Expected prompts differing in indentation to miss the cache, got %d generations", inner.generations)
+	}
+
+	sampled := backend.NewPrompt().AddMessage("user", "What is RAG?")
+	sampled.Parameters.Temperature = 0.7
+	for i := 0; i < 2; i++ {
+		if _, err := cached.Generate(ctx, sampled); err != nil {
+			t.Fatalf("Generate returned error: %v", err)
+		}
+	}
+	if inner.generations != 6 {
+		t.Errorf("Expected non-deterministic prompts not to be cached, got %d generations", inner.generations)
+	}
+}
+
+func TestGenerateCachingIsOptIn(t *testing.T) {
+	t.Parallel()
+	inner := &countingBackend{}
+	cached := backend.Wrap(inner, Middleware(NewLRU(10), "test-model"))
+	for i := 0; i < 2; i++ {
+		if _, err := cached.Generate(context.Background(), backend.NewPrompt().AddMessage("user", "Hello")); err != nil {
+			t.Fatalf("Generate returned error: %v", err)
+		}
+	}
+	if inner.generations != 2 {
+		t.Errorf("Expected generations not to be cached by default, got %d generations", inner.generations)
+	}
+}
+
+func TestEmbedCachingPerInput(t *testing.T) {
+	t.Parallel()
+	inner := &countingBackend{}
+	cached := backend.Wrap(inner, Middleware(NewLRU(10), "embed-model"))
+	ctx := context.Background()
+
+	if _, err := cached.EmbedBatch(ctx, []string{"alpha", "beta"}); err != nil {
+		t.Fatalf("EmbedBatch returned error: %v", err)
+	}
+	embeddings, err := cached.EmbedBatch(ctx, []string{"beta", "gamma!", "alpha"})
+	if err != nil {
+		t.Fatalf("EmbedBatch returned error: %v", err)
+	}
+
+	expected := []float32{4, 6, 5}
+	for i, embedding := range embeddings {
+		if len(embedding) != 1 || embedding[0] != expected[i] {
+			t.Errorf("Expected embedding %d to be [%v], got %v", i, expected[i], embedding)
+		}
+	}
+	if len(inner.inputs) != 3 || inner.inputs[2] != "gamma!" {
+		t.Errorf("Expected only the missing input to be embedded, got %q", inner.inputs)
+	}
+}
+
+func TestBypassAndRefresh(t *testing.T) {
+	t.Parallel()
+	inner := &countingBackend{}
+	store := NewLRU(10)
+	cached := backend.Wrap(inner, Middleware(store, "test-model", WithGenerateFilter(IsDeterministic)))
+	prompt := backend.NewPrompt().AddMessage("user", "Hello")
+
+	if _, err := cached.Generate(Bypass(context.Background()), prompt); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if store.Len() != 0 {
+		t.Errorf("Expected a bypassed call not to be stored")
+	}
+
+	if _, err := cached.Generate(context.Background(), prompt); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	refreshed, err := cached.Generate(Refresh(context.Background()), prompt)
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if refreshed != "3" || inner.generations != 3 {
+		t.Errorf("Expected a refreshed call to reach the backend, got %q after %d generations", refreshed, inner.generations)
+	}
+	latest, err := cached.Generate(context.Background(), prompt)
+	if err != nil || latest != "3" {
+		t.Errorf("Expected the refreshed result to be cached, got %q, %v", latest, err)
+	}
+}
+
+func TestStoreErrorsAreNotFatal(t *testing.T) {
+	t.Parallel()
+	var errs []error
+	inner := &countingBackend{}
+	onError := WithErrorHandler(func(err error) {
+		errs = append(errs, err)
+	})
+	cached := backend.Wrap(inner, Middleware(failingStore{}, "test-model", WithGenerateFilter(IsDeterministic), onError))
+
+	if _, err := cached.Generate(context.Background(), backend.NewPrompt().AddMessage("user", "Hello")); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if _, err := cached.Embed(context.Background(), "Hello"); err != nil {
+		t.Fatalf("Embed returned error: %v", err)
+	}
+	if len(errs) != 4 {
+		t.Errorf("Expected a read and a write error per call, got %v", errs)
+	}
+}
+
+func TestWithGenerateFilter(t *testing.T) {
+	t.Parallel()
+	inner := &countingBackend{}
+	seeded := func(prompt *backend.Prompt) bool {
+		return IsDeterministic(prompt) && prompt.Parameters.Seed != 0
+	}
+	cached := backend.Wrap(inner, Middleware(NewLRU(10), "test-model", WithGenerateFilter(seeded)))
+	prompt := backend.NewPrompt().AddMessage("user", "Hello")
+
+	for i := 0; i < 2; i++ {
+		if _, err := cached.Generate(context.Background(), prompt); err != nil {
+			t.Fatalf("Generate returned error: %v", err)
+		}
+	}
+	prompt.Parameters.Seed = 42
+	for i := 0; i < 2; i++ {
+		if _, err := cached.Generate(context.Background(), prompt); err != nil {
+			t.Fatalf("Generate returned error: %v", err)
+		}
+	}
+	if inner.generations != 3 {
+		t.Errorf("Expected only seeded prompts to be cached, got %d generations", inner.generations)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// tempPrefix starts the names of the files that entries are written to
+	// before they are renamed into place.
+	tempPrefix = ".tmp-"
+	// staleTempAge is the age after which Prune deletes temporary files.
+	staleTempAge = time.Hour
+)
+
+// Ensure FileStore implements the Store interface.
+var _ Store = (*FileStore)(nil)
+
+// FileStore is a Store that keeps every entry in its own file under a
+// directory, so that the cache survives restarts and can be shared between
+// processes. Writes are atomic; concurrent writers of the same key leave one of
+// the values.
+type FileStore struct {
+	dir string
+	now func() time.Time
+}
+
+type fileEntry struct {
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Value     []byte     `json:"value"`
+}
+
+// NewFileStore creates a file-backed store in dir, creating the directory if needed.
+//
+// Parameters:
+//   - dir: The directory holding the cache files.
+//
+// Returns:
+//   - A pointer to a new FileStore instance.
+//   - An error if the directory could not be created.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	return &FileStore{dir: dir, now: time.Now}, nil
+}
+
+// Get returns the value stored under key, and whether there was an unexpired
+// one. Expired entries are deleted.
+func (s *FileStore) Get(key string) ([]byte, bool, error) {
+	path := s.path(key)
+	data, err := os.ReadFile(path) // #nosec G304 -- the path is derived from a hash
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read cache entry: %w", err)
+	}
+
+	var entry fileEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false, fmt.Errorf("failed to decode cache entry: %w", err)
+	}
+	if s.expired(entry) {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, false, fmt.Errorf("failed to remove expired cache entry: %w", err)
+		}
+		return nil, false, nil
+	}
+	return entry.Value, true, nil
+}
+
+// Set stores value under key. It expires after ttl, or never if ttl is zero.
+func (s *FileStore) Set(key string, value []byte, ttl time.Duration) error {
+	entry := fileEntry{Value: value}
+	if ttl > 0 {
+		expiresAt := s.now().Add(ttl)
+		entry.ExpiresAt = &expiresAt
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache entry: %w", err)
+	}
+
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), tempPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("failed to create cache entry: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	return nil
+}
+
+// Prune deletes all expired entries, and the temporary files of writes that
+// were interrupted, such as by a crash, more than an hour ago.
+//
+// Returns:
+//   - The number of files deleted.
+//   - An error if the directory could not be walked or a file not removed.
+func (s *FileStore) Prune() (int, error) {
+	pruned := 0
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), tempPrefix) {
+			return s.pruneTemp(path, d, &pruned)
+		}
+		if filepath.Ext(path) != ".json" {
+			return nil
+		}
+		data, err := os.ReadFile(path) // #nosec G304 -- the path is inside the cache directory
+		if err != nil {
+			return err
+		}
+		var entry fileEntry
+		if json.Unmarshal(data, &entry) == nil && !s.expired(entry) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		pruned++
+		return nil
+	})
+	if err != nil {
+		return pruned, fmt.Errorf("failed to prune cache: %w", err)
+	}
+	return pruned, nil
+}
+
+// pruneTemp deletes the temporary file at path if it is stale. Recent ones may
+// belong to a write in progress.
+func (s *FileStore) pruneTemp(path string, d fs.DirEntry, pruned *int) error {
+	info, err := d.Info()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if s.now().Sub(info.ModTime()) < staleTempAge {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	*pruned++
+	return nil
+}
+
+func (s *FileStore) expired(entry fileEntry) bool {
+	return entry.ExpiresAt != nil && !s.now().Before(*entry.ExpiresAt)
+}
+
+// path returns the file of key, sharded by its first byte to keep directories
+// small. The hex digests that Middleware uses as keys are file names as they
+// are; other keys are hashed so that any string is a safe file name.
+func (s *FileStore) path(key string) string {
+	name := key
+	if !isDigest(key) {
+		sum := sha256.Sum256([]byte(key))
+		name = hex.EncodeToString(sum[:])
+	}
+	return filepath.Join(s.dir, name[:2], name+".json")
+}
+
+// isDigest reports whether key is a lowercase hex SHA-256 digest.
+func isDigest(key string) bool {
+	if len(key) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range key {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
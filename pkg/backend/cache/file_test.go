@@ -0,0 +1,145 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stackloklabs/gorag/pkg/backend"
+)
+
+func TestFileStorePersists(t *testing.T) {
+	t.Parallel()
+	dir := filepath.Join(t.TempDir(), "cache")
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore returned error: %v", err)
+	}
+	if err := store.Set("../key with/odd chars", []byte("value"), 0); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	reopened, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore returned error: %v", err)
+	}
+	value, ok, err := reopened.Get("../key with/odd chars")
+	if err != nil || !ok || string(value) != "value" {
+		t.Errorf("Expected the value to persist, got %q, %v, %v", value, ok, err)
+	}
+	if _, ok, err := reopened.Get("missing"); ok || err != nil {
+		t.Errorf("Expected a miss for an unknown key, got %v, %v", ok, err)
+	}
+
+	inner := &countingBackend{}
+	first := backend.Wrap(inner, Middleware(store, "embed-model"))
+	if _, err := first.Embed(context.Background(), "chunk"); err != nil {
+		t.Fatalf("Embed returned error: %v", err)
+	}
+	second := backend.Wrap(inner, Middleware(reopened, "embed-model"))
+	if _, err := second.Embed(context.Background(), "chunk"); err != nil {
+		t.Fatalf("Embed returned error: %v", err)
+	}
+	if len(inner.inputs) != 1 {
+		t.Errorf("Expected the embedding to be read from disk, got %d calls", len(inner.inputs))
+	}
+}
+
+func TestFileStoreExpiry(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore returned error: %v", err)
+	}
+	store.now = func() time.Time { return now }
+
+	for _, key := range []string{"a", "b"} {
+		if err := store.Set(key, []byte(key), time.Minute); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	if err := store.Set("c", []byte("c"), 0); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	now = now.Add(time.Hour)
+
+	if _, ok, err := store.Get("a"); ok || err != nil {
+		t.Errorf("Expected the entry to have expired, got %v, %v", ok, err)
+	}
+	pruned, err := store.Prune()
+	if err != nil || pruned != 1 {
+		t.Errorf("Expected Prune to remove 1 entry, got %d, %v", pruned, err)
+	}
+	if _, ok, _ := store.Get("c"); !ok {
+		t.Errorf("Expected the entry without TTL to be kept")
+	}
+}
+
+func TestFileStorePrunesStaleTempFiles(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore returned error: %v", err)
+	}
+	store.now = func() time.Time { return now }
+
+	stale := filepath.Join(dir, "ab", ".tmp-1")
+	fresh := filepath.Join(dir, "ab", ".tmp-2")
+	if err := os.MkdirAll(filepath.Dir(stale), 0o755); err != nil {
+		t.Fatalf("MkdirAll returned error: %v", err)
+	}
+	for path, modified := range map[string]time.Time{stale: now.Add(-2 * time.Hour), fresh: now.Add(-time.Minute)} {
+		if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+			t.Fatalf("WriteFile returned error: %v", err)
+		}
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatalf("Chtimes returned error: %v", err)
+		}
+	}
+
+	pruned, err := store.Prune()
+	if err != nil || pruned != 1 {
+		t.Errorf("Expected Prune to remove 1 file, got %d, %v", pruned, err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Expected the stale temporary file to be removed, got %v", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("Expected the recent temporary file to be kept, got %v", err)
+	}
+}
+
+func TestFileStoreUsesDigestKeysAsNames(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore returned error: %v", err)
+	}
+	key := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	if err := store.Set(key, []byte("value"), 0); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "01", key+".json")); err != nil {
+		t.Errorf("Expected the digest to be the file name, got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUEviction(t *testing.T) {
+	t.Parallel()
+	lru := NewLRU(2)
+	_ = lru.Set("a", []byte("1"), 0)
+	_ = lru.Set("b", []byte("2"), 0)
+	if _, ok, _ := lru.Get("a"); !ok {
+		t.Fatalf("Expected a to be cached")
+	}
+	_ = lru.Set("c", []byte("3"), 0)
+
+	if _, ok, _ := lru.Get("b"); ok {
+		t.Errorf("Expected the least recently used entry to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok, _ := lru.Get(key); !ok {
+			t.Errorf("Expected %s to be cached", key)
+		}
+	}
+	if lru.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %d", lru.Len())
+	}
+	lru.Purge()
+	if lru.Len() != 0 {
+		t.Errorf("Expected no entries after Purge, got %d", lru.Len())
+	}
+}
+
+func TestLRUExpiry(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	lru := NewLRU(0)
+	lru.now = func() time.Time { return now }
+
+	_ = lru.Set("short", []byte("1"), time.Minute)
+	_ = lru.Set("forever", []byte("2"), 0)
+	now = now.Add(time.Hour)
+
+	if _, ok, _ := lru.Get("short"); ok {
+		t.Errorf("Expected the entry to have expired")
+	}
+	if value, ok, _ := lru.Get("forever"); !ok || string(value) != "2" {
+		t.Errorf("Expected the entry without TTL to be kept, got %q", value)
+	}
+	if lru.Len() != 1 {
+		t.Errorf("Expected the expired entry to be removed, got %d entries", lru.Len())
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cassette provides an http.RoundTripper that records HTTP interactions
+// with a provider to a file and replays them later, so that integration tests of
+// backends can run without network access or credentials.
+//
+// Record a session once against the real service:
+//
+//	rec, err := cassette.New("testdata/rag.json", cassette.ModeRecord)
+//	...
+//	defer rec.Save()
+//	ollama := backend.NewOllamaBackend(host, model, timeout)
+//	ollama.Client = rec.Client()
+//
+// and replay it in CI by creating the recorder with ModeReplay instead.
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Mode selects whether a Recorder records or replays interactions.
+type Mode int
+
+const (
+	// ModeReplay serves responses from the cassette file and never contacts the network.
+	ModeReplay Mode = iota
+	// ModeRecord forwards requests to the real transport and records the interactions.
+	ModeRecord
+)
+
+// redacted replaces the values of scrubbed headers and query parameters.
+const redacted = "REDACTED"
+
+// ErrNoInteraction is returned in replay mode when no unused recorded interaction
+// matches a request.
+var ErrNoInteraction = errors.New("cassette: no recorded interaction matches the request")
+
+// defaultScrubbedHeaders carry the credentials of the supported providers.
+var defaultScrubbedHeaders = []string{"Authorization", "Api-Key", "X-Api-Key", "Cookie", "Set-Cookie"}
+
+// defaultScrubbedParams are the query parameters that carry credentials, such
+// as Azure's api-key and Gemini's key.
+var defaultScrubbedParams = []string{"api-key", "api_key", "key", "access_token"}
+
+// Interaction is a recorded request together with the response it received.
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// Request is the recorded form of an HTTP request.
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+}
+
+// Response is the recorded form of an HTTP response.
+type Response struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+}
+
+type cassetteFile struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Option represents an option for New.
+type Option func(*Recorder)
+
+// WithTransport sets the transport that requests are forwarded to in record
+// mode. It defaults to http.DefaultTransport.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(r *Recorder) {
+		r.transport = transport
+	}
+}
+
+// WithScrubbedHeaders adds request and response headers whose values are
+// redacted before they are written to the cassette. Authorization, Api-Key,
+// X-Api-Key and cookies are always scrubbed.
+func WithScrubbedHeaders(names ...string) Option {
+	return func(r *Recorder) {
+		r.scrubbed = append(r.scrubbed, names...)
+	}
+}
+
+// WithScrubbedParams adds URL query parameters whose values are redacted before
+// the URL is written to the cassette. api-key, api_key, key and access_token are
+// always scrubbed. Names are matched case-insensitively.
+func WithScrubbedParams(names ...string) Option {
+	return func(r *Recorder) {
+		r.scrubbedParams = append(r.scrubbedParams, names...)
+	}
+}
+
+// Recorder is an http.RoundTripper that records or replays HTTP interactions.
+// It is safe for concurrent use.
+type Recorder struct {
+	path           string
+	mode           Mode
+	transport      http.RoundTripper
+	scrubbed       []string
+	scrubbedParams []string
+
+	mu           sync.Mutex
+	interactions []Interaction
+	used         []bool
+}
+
+// New creates a Recorder backed by the cassette file at path. In replay mode the
+// file is loaded and must exist; in record mode it is written by Save.
+func New(path string, mode Mode, opts ...Option) (*Recorder, error) {
+	r := &Recorder{
+		path:           path,
+		mode:           mode,
+		transport:      http.DefaultTransport,
+		scrubbed:       append([]string(nil), defaultScrubbedHeaders...),
+		scrubbedParams: append([]string(nil), defaultScrubbedParams...),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if mode == ModeReplay {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cassette: %w", err)
+		}
+		var file cassetteFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("failed to decode cassette %s: %w", path, err)
+		}
+		r.interactions = file.Interactions
+		r.used = make([]bool, len(file.Interactions))
+	}
+	return r, nil
+}
+
+// Client returns an HTTP client that sends its requests through the recorder.
+func (r *Recorder) Client() *http.Client {
+	return &http.Client{Transport: r}
+}
+
+// Interactions returns the interactions recorded or loaded so far.
+func (r *Recorder) Interactions() []Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Interaction(nil), r.interactions...)
+}
+
+// Save writes the recorded interactions to the cassette file, creating its
+// directory if needed. It does nothing in replay mode.
+func (r *Recorder) Save() error {
+	if r.mode != ModeRecord {
+		return nil
+	}
+
+	r.mu.Lock()
+	data, err := json.MarshalIndent(cassetteFile{Interactions: r.interactions}, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode cassette: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o750); err != nil {
+		return fmt.Errorf("failed to create cassette directory: %w", err)
+	}
+	if err := os.WriteFile(r.path, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("failed to write cassette: %w", err)
+	}
+	return nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.mode == ModeRecord {
+		return r.record(req, body)
+	}
+	return r.replay(req, body)
+}
+
+func (r *Recorder) record(req *http.Request, body []byte) (*http.Response, error) {
+	forwarded := req.Clone(req.Context())
+	forwarded.Body = io.NopCloser(bytes.NewReader(body))
+
+	resp, err := r.transport.RoundTrip(forwarded)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	interaction := Interaction{
+		Request: Request{
+			Method: req.Method,
+			URL:    r.scrubURL(req.URL),
+			Header: r.scrub(req.Header),
+			Body:   string(body),
+		},
+		Response: Response{
+			StatusCode: resp.StatusCode,
+			Header:     r.scrub(resp.Header),
+			Body:       string(respBody),
+		},
+	}
+
+	r.mu.Lock()
+	r.interactions = append(r.interactions, interaction)
+	r.mu.Unlock()
+
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	return resp, nil
+}
+
+func (r *Recorder) replay(req *http.Request, body []byte) (*http.Response, error) {
+	key := normalizeBody(body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, interaction := range r.interactions {
+		if r.used[i] || !matches(interaction.Request, req, key) {
+			continue
+		}
+		r.used[i] = true
+
+		recorded := interaction.Response
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", recorded.StatusCode, http.StatusText(recorded.StatusCode)),
+			StatusCode:    recorded.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        recorded.Header.Clone(),
+			Body:          io.NopCloser(bytes.NewReader([]byte(recorded.Body))),
+			ContentLength: int64(len(recorded.Body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: %s %s", ErrNoInteraction, req.Method, req.URL.Path)
+}
+
+// matches reports whether a recorded request has the method, path and
+// normalized body of req.
+func matches(recorded Request, req *http.Request, normalizedBody string) bool {
+	if recorded.Method != req.Method {
+		return false
+	}
+	recordedURL, err := req.URL.Parse(recorded.URL)
+	if err != nil || recordedURL.Path != req.URL.Path {
+		return false
+	}
+	return normalizeBody([]byte(recorded.Body)) == normalizedBody
+}
+
+// normalizeBody returns a canonical form of a request body, so that JSON bodies
+// match regardless of key order and whitespace.
+func normalizeBody(body []byte) string {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return string(bytes.TrimSpace(body))
+	}
+	canonical, err := json.Marshal(value)
+	if err != nil {
+		return string(bytes.TrimSpace(body))
+	}
+	return string(canonical)
+}
+
+// scrubURL returns u with the values of secret query parameters redacted. URLs
+// without them are returned as they are.
+func (r *Recorder) scrubURL(u *url.URL) string {
+	query := u.Query()
+	found := false
+	for name, values := range query {
+		for _, secret := range r.scrubbedParams {
+			if strings.EqualFold(name, secret) {
+				for i := range values {
+					values[i] = redacted
+				}
+				found = true
+			}
+		}
+	}
+	if !found {
+		return u.String()
+	}
+	scrubbed := *u
+	scrubbed.RawQuery = query.Encode()
+	return scrubbed.String()
+}
+
+// scrub returns a copy of header with the values of secret headers redacted.
+func (r *Recorder) scrub(header http.Header) http.Header {
+	scrubbed := header.Clone()
+	for _, name := range r.scrubbed {
+		if scrubbed.Get(name) != "" {
+			scrubbed.Set(name, redacted)
+		}
+	}
+	return scrubbed
+}
+
+// readBody reads and closes the request body.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	defer req.Body.Close()
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	return body, nil
+}
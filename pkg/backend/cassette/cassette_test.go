@@ -0,0 +1,200 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cassette
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stackloklabs/gorag/pkg/backend"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	t.Parallel()
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("Authorization") != "Bearer sk-secret" {
+			t.Errorf("Expected the real credentials to reach the server")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/chat/completions":
+			_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"Recorded answer"}}]}`))
+		case "/v1/embeddings":
+			_, _ = w.Write([]byte(`{"data":[{"embedding":[0.1,0.2,0.3]}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	path := filepath.Join(t.TempDir(), "cassettes", "openai.json")
+
+	rec, err := New(path, ModeRecord)
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+	openai := backend.NewOpenAIBackend("sk-secret", "gpt-4o-mini", 10*time.Second)
+	openai.BaseURL = server.URL
+	openai.HTTPClient = rec.Client()
+
+	ctx := context.Background()
+	prompt := backend.NewPrompt().AddMessage("user", "What is RAG?")
+	if response, err := openai.Generate(ctx, prompt); err != nil || response != "Recorded answer" {
+		t.Fatalf("Generate while recording returned %q, %v", response, err)
+	}
+	if _, err := openai.Embed(ctx, "What is RAG?"); err != nil {
+		t.Fatalf("Embed while recording returned error: %v", err)
+	}
+	if err := rec.Save(); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	server.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read cassette: %v", err)
+	}
+	if strings.Contains(string(data), "sk-secret") {
+		t.Errorf("Expected the API key to be scrubbed from the cassette")
+	}
+
+	replayer, err := New(path, ModeReplay)
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+	openai.HTTPClient = replayer.Client()
+	if response, err := openai.Generate(ctx, prompt); err != nil || response != "Recorded answer" {
+		t.Errorf("Generate while replaying returned %q, %v", response, err)
+	}
+	embedding, err := openai.Embed(ctx, "What is RAG?")
+	if err != nil || len(embedding) != 3 {
+		t.Errorf("Embed while replaying returned %v, %v", embedding, err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected the server to be called twice, got %d", calls)
+	}
+
+	if _, err := openai.Generate(ctx, prompt); !errors.Is(err, ErrNoInteraction) {
+		t.Errorf("Expected ErrNoInteraction once the interactions are used up, got %v", err)
+	}
+}
+
+func TestRecordScrubsQueryParams(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.RawQuery, redacted) {
+			t.Errorf("Expected the real credentials to reach the server, got %s", r.URL.RawQuery)
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "azure.json")
+
+	rec, err := New(path, ModeRecord, WithScrubbedParams("sig"))
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+	for _, query := range []string{"api-version=2024-06-01&api-key=azure-secret", "Key=gemini-secret&sig=signed"} {
+		resp, err := rec.Client().Get(server.URL + "/v1/models?" + query)
+		if err != nil {
+			t.Fatalf("Get returned error: %v", err)
+		}
+		resp.Body.Close()
+	}
+	if err := rec.Save(); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read cassette: %v", err)
+	}
+	for _, secret := range []string{"azure-secret", "gemini-secret", "signed"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("Expected %q to be scrubbed from the cassette", secret)
+		}
+	}
+	if !strings.Contains(string(data), "api-version=2024-06-01") {
+		t.Errorf("Expected other query parameters to be kept, got %s", data)
+	}
+}
+
+func TestReplayMatchesNormalizedBody(t *testing.T) {
+	t.Parallel()
+	cassette := cassetteFile{Interactions: []Interaction{
+		{
+			Request:  Request{Method: http.MethodPost, URL: "http://recorded:11434/api/embed", Body: `{"model":"m","input":"a"}`},
+			Response: Response{StatusCode: http.StatusOK, Body: `{"embeddings":[[1]]}`},
+		},
+		{
+			Request:  Request{Method: http.MethodPost, URL: "http://recorded:11434/api/embed", Body: `{"model":"m","input":"b"}`},
+			Response: Response{StatusCode: http.StatusOK, Body: `{"embeddings":[[2]]}`},
+		},
+	}}
+	data, err := json.Marshal(cassette)
+	if err != nil {
+		t.Fatalf("Failed to encode cassette: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "ollama.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("Failed to write cassette: %v", err)
+	}
+
+	rec, err := New(path, ModeReplay)
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+	client := rec.Client()
+
+	tests := []struct {
+		body     string
+		expected string
+	}{
+		{body: "{\n  \"input\": \"b\",\n  \"model\": \"m\"\n}", expected: `{"embeddings":[[2]]}`},
+		{body: `{"input":"a","model":"m"}`, expected: `{"embeddings":[[1]]}`},
+	}
+	for _, tt := range tests {
+		resp, err := client.Post("http://localhost:11434/api/embed", "application/json", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatalf("Post returned error: %v", err)
+		}
+		var body json.RawMessage
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		resp.Body.Close()
+		if string(body) != tt.expected {
+			t.Errorf("Expected response %s for body %s, got %s", tt.expected, tt.body, body)
+		}
+	}
+
+	if _, err := client.Post("http://localhost:11434/api/chat", "application/json", strings.NewReader(`{}`)); err == nil {
+		t.Errorf("Expected an error for a request that was not recorded")
+	}
+}
+
+func TestNewReplayMissingCassette(t *testing.T) {
+	t.Parallel()
+	if _, err := New(filepath.Join(t.TempDir(), "missing.json"), ModeReplay); err == nil {
+		t.Errorf("Expected an error for a missing cassette")
+	}
+}
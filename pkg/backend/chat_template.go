@@ -0,0 +1,129 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ChatTemplate renders role-based messages into the raw prompt string a model
+// was trained on, for backends that only expose a plain text completion endpoint.
+//
+// Rendered prompts end with the header of an assistant turn, so the model
+// continues with its reply. They do not include the beginning-of-sequence token,
+// which servers add when tokenizing the prompt.
+type ChatTemplate interface {
+	// Render returns the prompt for the given messages.
+	Render(messages []Message) (string, error)
+	// StopSequences returns the strings that mark the end of an assistant turn.
+	StopSequences() []string
+}
+
+var (
+	// Llama3Template renders prompts for Llama 3 instruct models. Tool results
+	// are sent with the ipython role used by Llama 3.1.
+	Llama3Template ChatTemplate = llama3Template{}
+	// ChatMLTemplate renders prompts in the ChatML format used by Qwen, Yi,
+	// Hermes and many other fine-tunes.
+	ChatMLTemplate ChatTemplate = chatMLTemplate{}
+	// MistralTemplate renders prompts for Mistral and Mixtral instruct models.
+	// These models have no system role, so system messages are prepended to the
+	// first user message.
+	MistralTemplate ChatTemplate = mistralTemplate{}
+)
+
+type llama3Template struct{}
+
+func (llama3Template) Render(messages []Message) (string, error) {
+	var b strings.Builder
+	for _, message := range messages {
+		role := message.Role
+		switch role {
+		case "system", "user", "assistant":
+		case "tool":
+			role = "ipython"
+		default:
+			return "", fmt.Errorf("unsupported role %q in Llama 3 template", message.Role)
+		}
+		fmt.Fprintf(&b, "<|start_header_id|>%s<|end_header_id|>\n\n%s<|eot_id|>", role, strings.TrimSpace(message.Text()))
+	}
+	b.WriteString("<|start_header_id|>assistant<|end_header_id|>\n\n")
+	return b.String(), nil
+}
+
+func (llama3Template) StopSequences() []string {
+	return []string{"<|eot_id|>"}
+}
+
+type chatMLTemplate struct{}
+
+func (chatMLTemplate) Render(messages []Message) (string, error) {
+	var b strings.Builder
+	for _, message := range messages {
+		switch message.Role {
+		case "system", "user", "assistant", "tool":
+		default:
+			return "", fmt.Errorf("unsupported role %q in ChatML template", message.Role)
+		}
+		fmt.Fprintf(&b, "<|im_start|>%s\n%s<|im_end|>\n", message.Role, message.Text())
+	}
+	b.WriteString("<|im_start|>assistant\n")
+	return b.String(), nil
+}
+
+func (chatMLTemplate) StopSequences() []string {
+	return []string{"<|im_end|>"}
+}
+
+type mistralTemplate struct{}
+
+func (mistralTemplate) Render(messages []Message) (string, error) {
+	var system []string
+	var b strings.Builder
+	expectUser := true
+	for _, message := range messages {
+		switch message.Role {
+		case "system":
+			system = append(system, strings.TrimSpace(message.Text()))
+		case "user":
+			if !expectUser {
+				return "", fmt.Errorf("mistral template requires alternating user and assistant messages")
+			}
+			content := strings.TrimSpace(message.Text())
+			if len(system) > 0 {
+				content = strings.Join(system, "\n\n") + "\n\n" + content
+				system = nil
+			}
+			fmt.Fprintf(&b, "[INST] %s [/INST]", content)
+			expectUser = false
+		case "assistant":
+			if expectUser {
+				return "", fmt.Errorf("mistral template requires alternating user and assistant messages")
+			}
+			fmt.Fprintf(&b, " %s</s>", strings.TrimSpace(message.Text()))
+			expectUser = true
+		default:
+			return "", fmt.Errorf("unsupported role %q in Mistral template", message.Role)
+		}
+	}
+	if expectUser || len(system) > 0 {
+		return "", fmt.Errorf("mistral template requires the last message to be from the user")
+	}
+	return b.String(), nil
+}
+
+func (mistralTemplate) StopSequences() []string {
+	return []string{"</s>", "[INST]"}
+}
@@ -0,0 +1,80 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import "testing"
+
+func TestChatTemplates(t *testing.T) {
+	t.Parallel()
+	conversation := []Message{
+		{Role: "system", Content: "You are terse."},
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant", Content: "Hello."},
+		{Role: "user", Content: "Bye"},
+	}
+
+	tests := []struct {
+		name     string
+		template ChatTemplate
+		expected string
+	}{
+		{
+			name:     "llama3",
+			template: Llama3Template,
+			expected: "<|start_header_id|>system<|end_header_id|>\n\nYou are terse.<|eot_id|>" +
+				"<|start_header_id|>user<|end_header_id|>\n\nHi<|eot_id|>" +
+				"<|start_header_id|>assistant<|end_header_id|>\n\nHello.<|eot_id|>" +
+				"<|start_header_id|>user<|end_header_id|>\n\nBye<|eot_id|>" +
+				"<|start_header_id|>assistant<|end_header_id|>\n\n",
+		},
+		{
+			name:     "chatml",
+			template: ChatMLTemplate,
+			expected: "<|im_start|>system\nYou are terse.<|im_end|>\n" +
+				"<|im_start|>user\nHi<|im_end|>\n" +
+				"<|im_start|>assistant\nHello.<|im_end|>\n" +
+				"<|im_start|>user\nBye<|im_end|>\n" +
+				"<|im_start|>assistant\n",
+		},
+		{
+			name:     "mistral",
+			template: MistralTemplate,
+			expected: "[INST] You are terse.\n\nHi [/INST] Hello.</s>[INST] Bye [/INST]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			rendered, err := tt.template.Render(conversation)
+			if err != nil {
+				t.Fatalf("Render returned error: %v", err)
+			}
+			if rendered != tt.expected {
+				t.Errorf("Unexpected prompt:\n got: %q\nwant: %q", rendered, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMistralTemplateRequiresAlternatingRoles(t *testing.T) {
+	t.Parallel()
+	messages := []Message{
+		{Role: "user", Content: "Hi"},
+		{Role: "user", Content: "Are you there?"},
+	}
+	if _, err := MistralTemplate.Render(messages); err == nil {
+		t.Error("Expected an error for consecutive user messages")
+	}
+}
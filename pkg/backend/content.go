@@ -0,0 +1,112 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ContentPartType identifies the kind of a ContentPart.
+type ContentPartType string
+
+const (
+	// ContentPartText is a part holding text.
+	ContentPartText ContentPartType = "text"
+	// ContentPartImage is a part holding an image, either as bytes or as a URL.
+	ContentPartImage ContentPartType = "image"
+)
+
+// ContentPart is one part of a multimodal message, such as a piece of text or
+// an image. Create parts with TextPart, ImagePart and ImageURLPart.
+type ContentPart struct {
+	Type ContentPartType `json:"type"`
+	// Text is the text of a text part.
+	Text string `json:"text,omitempty"`
+	// Data holds the encoded bytes of an image, for example a PNG or JPEG file.
+	Data []byte `json:"data,omitempty"`
+	// MIMEType is the media type of Data, such as "image/png". It is detected
+	// from the data when empty.
+	MIMEType string `json:"mime_type,omitempty"`
+	// URL refers to an image instead of Data.
+	URL string `json:"url,omitempty"`
+}
+
+// TextPart returns a content part holding text.
+func TextPart(text string) ContentPart {
+	return ContentPart{Type: ContentPartText, Text: text}
+}
+
+// ImagePart returns a content part holding an encoded image. If mimeType is
+// empty it is detected from the data.
+func ImagePart(data []byte, mimeType string) ContentPart {
+	return ContentPart{Type: ContentPartImage, Data: data, MIMEType: mimeType}
+}
+
+// ImageURLPart returns a content part referring to an image by URL. Not every
+// backend can fetch images; Ollama, for example, only accepts image bytes.
+func ImageURLPart(url string) ContentPart {
+	return ContentPart{Type: ContentPartImage, URL: url}
+}
+
+// mediaType returns the MIME type of an image part's data.
+func (p ContentPart) mediaType() string {
+	if p.MIMEType != "" {
+		return p.MIMEType
+	}
+	return http.DetectContentType(p.Data)
+}
+
+// dataURL returns the image data of the part encoded as a data URL.
+func (p ContentPart) dataURL() string {
+	return "data:" + p.mediaType() + ";base64," + base64.StdEncoding.EncodeToString(p.Data)
+}
+
+// Text returns the text of the message: its Content followed by its text parts,
+// separated by newlines. Images are left out.
+func (m Message) Text() string {
+	texts := make([]string, 0, len(m.Parts)+1)
+	if m.Content != "" {
+		texts = append(texts, m.Content)
+	}
+	for _, part := range m.Parts {
+		if part.Type == ContentPartText && part.Text != "" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// HasImages reports whether the message has an image part.
+func (m Message) HasImages() bool {
+	for _, part := range m.Parts {
+		if part.Type == ContentPartImage {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTextOnly returns an error if any message has image parts, for backends
+// that can only send text.
+func checkTextOnly(messages []Message, backendName string) error {
+	for _, message := range messages {
+		if message.HasImages() {
+			return fmt.Errorf("images are not supported by the %s backend", backendName)
+		}
+	}
+	return nil
+}
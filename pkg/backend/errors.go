@@ -0,0 +1,313 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	providerOpenAI    = "openai"
+	providerOllama    = "ollama"
+	providerAnthropic = "anthropic"
+	providerLlamaCpp  = "llamacpp"
+	providerHF        = "huggingface"
+)
+
+// APIError is the error returned when a provider rejects a request. The more
+// specific error types below wrap an APIError, so errors.As can be used either
+// to check for a particular failure or to inspect the provider's response.
+type APIError struct {
+	// Provider names the backend that returned the error, such as "openai".
+	Provider string
+	// StatusCode is the HTTP status code of the response, or 0 for errors
+	// reported in the middle of a stream.
+	StatusCode int
+	// Type and Code are the provider's error classification, when it sends one.
+	Type string
+	Code string
+	// Message is the provider's error message, or the raw response body if it
+	// could not be parsed.
+	Message string
+}
+
+// Error implements the error interface.
+func (e *APIError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Provider)
+	if e.StatusCode != 0 {
+		fmt.Fprintf(&b, ": status code %d", e.StatusCode)
+	}
+	if e.Code != "" {
+		fmt.Fprintf(&b, " (%s)", e.Code)
+	} else if e.Type != "" {
+		fmt.Fprintf(&b, " (%s)", e.Type)
+	}
+	if e.Message != "" {
+		b.WriteString(": ")
+		b.WriteString(e.Message)
+	}
+	return b.String()
+}
+
+// RateLimitError is returned when the provider rejects a request because a rate
+// limit was exceeded.
+type RateLimitError struct {
+	APIError
+	// RetryAfter is how long the provider asked to wait before retrying, or zero if it did not say.
+	RetryAfter time.Duration
+}
+
+// Unwrap returns the underlying APIError.
+func (e *RateLimitError) Unwrap() error { return &e.APIError }
+
+// AuthenticationError is returned when the credentials are missing, invalid or
+// lack permission for the request.
+type AuthenticationError struct {
+	APIError
+}
+
+// Unwrap returns the underlying APIError.
+func (e *AuthenticationError) Unwrap() error { return &e.APIError }
+
+// ModelNotFoundError is returned when the requested model does not exist or has
+// not been pulled.
+type ModelNotFoundError struct {
+	APIError
+}
+
+// Unwrap returns the underlying APIError.
+func (e *ModelNotFoundError) Unwrap() error { return &e.APIError }
+
+// ContextLengthExceededError is returned when the prompt, together with the
+// requested completion, does not fit in the model's context window.
+type ContextLengthExceededError struct {
+	APIError
+}
+
+// Unwrap returns the underlying APIError.
+func (e *ContextLengthExceededError) Unwrap() error { return &e.APIError }
+
+// ContentFilterError is returned when the provider's content filter rejected the
+// prompt or the response.
+type ContentFilterError struct {
+	APIError
+}
+
+// Unwrap returns the underlying APIError.
+func (e *ContentFilterError) Unwrap() error { return &e.APIError }
+
+// ServerUnavailableError is returned when the provider failed with a server-side
+// error or is temporarily unable to serve the request.
+type ServerUnavailableError struct {
+	APIError
+	// RetryAfter is how long the provider asked to wait before retrying, or zero if it did not say.
+	RetryAfter time.Duration
+}
+
+// Unwrap returns the underlying APIError.
+func (e *ServerUnavailableError) Unwrap() error { return &e.APIError }
+
+// newOpenAIError converts an error response from the OpenAI API into a typed error.
+func newOpenAIError(resp *http.Response, body []byte) error {
+	apiErr := openAIErrorBody(body)
+	apiErr.StatusCode = resp.StatusCode
+	return classifyError(apiErr, retryAfter(resp.Header))
+}
+
+// openAIErrorBody parses OpenAI's {"error": {...}} error payload. If the body does
+// not have that shape, the raw body is used as the message.
+func openAIErrorBody(body []byte) APIError {
+	apiErr := APIError{Provider: providerOpenAI, Message: strings.TrimSpace(string(body))}
+
+	var payload struct {
+		Error *struct {
+			Message string      `json:"message"`
+			Type    string      `json:"type"`
+			Code    interface{} `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Error == nil {
+		return apiErr
+	}
+
+	apiErr.Message = payload.Error.Message
+	apiErr.Type = payload.Error.Type
+	if payload.Error.Code != nil {
+		apiErr.Code = fmt.Sprint(payload.Error.Code)
+	}
+	return apiErr
+}
+
+// newOllamaError converts an error response from the Ollama API into a typed error.
+func newOllamaError(resp *http.Response, body []byte) error {
+	apiErr := ollamaErrorBody(body)
+	apiErr.StatusCode = resp.StatusCode
+	return classifyError(apiErr, retryAfter(resp.Header))
+}
+
+// ollamaErrorBody parses Ollama's {"error": "..."} error payload. If the body does
+// not have that shape, the raw body is used as the message.
+func ollamaErrorBody(body []byte) APIError {
+	apiErr := APIError{Provider: providerOllama, Message: strings.TrimSpace(string(body))}
+
+	var payload struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil && payload.Error != "" {
+		apiErr.Message = payload.Error
+	}
+	return apiErr
+}
+
+// newAnthropicError converts an error response from the Anthropic API into a typed error.
+func newAnthropicError(resp *http.Response, body []byte) error {
+	apiErr := anthropicErrorBody(body)
+	apiErr.StatusCode = resp.StatusCode
+	return classifyError(apiErr, retryAfter(resp.Header))
+}
+
+// anthropicErrorBody parses Anthropic's {"type": "error", "error": {...}} error
+// payload. If the body does not have that shape, the raw body is used as the message.
+func anthropicErrorBody(body []byte) APIError {
+	apiErr := APIError{Provider: providerAnthropic, Message: strings.TrimSpace(string(body))}
+
+	var payload struct {
+		Error *struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Error == nil {
+		return apiErr
+	}
+
+	apiErr.Message = payload.Error.Message
+	apiErr.Type = payload.Error.Type
+	return apiErr
+}
+
+// newLlamaCppError converts an error response from the llama.cpp server into a typed error.
+func newLlamaCppError(resp *http.Response, body []byte) error {
+	apiErr := llamaCppErrorBody(body)
+	apiErr.StatusCode = resp.StatusCode
+	return classifyError(apiErr, retryAfter(resp.Header))
+}
+
+// llamaCppErrorBody parses the llama.cpp server's error payload, which has the
+// same shape as OpenAI's except that the code is the HTTP status code.
+func llamaCppErrorBody(body []byte) APIError {
+	apiErr := openAIErrorBody(body)
+	apiErr.Provider = providerLlamaCpp
+	if _, err := strconv.Atoi(apiErr.Code); err == nil {
+		apiErr.Code = ""
+	}
+	return apiErr
+}
+
+// newHFError converts an error response from a Hugging Face inference server
+// (TEI or TGI) into a typed error.
+func newHFError(resp *http.Response, body []byte) error {
+	apiErr := hfErrorBody(body)
+	apiErr.StatusCode = resp.StatusCode
+	return classifyError(apiErr, retryAfter(resp.Header))
+}
+
+// hfErrorBody parses the {"error": "...", "error_type": "..."} error payload of
+// the Hugging Face inference servers. If the body does not have that shape, the
+// raw body is used as the message.
+func hfErrorBody(body []byte) APIError {
+	apiErr := APIError{Provider: providerHF, Message: strings.TrimSpace(string(body))}
+
+	var payload struct {
+		Error     string `json:"error"`
+		ErrorType string `json:"error_type"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil && payload.Error != "" {
+		apiErr.Message = payload.Error
+		apiErr.Type = payload.ErrorType
+	}
+	return apiErr
+}
+
+// classifyError wraps apiErr in the most specific error type that matches the
+// status code, the provider's error code and type, or well-known messages.
+func classifyError(apiErr APIError, retryAfter time.Duration) error {
+	message := strings.ToLower(apiErr.Message)
+
+	switch {
+	case apiErr.Code == "context_length_exceeded" ||
+		strings.Contains(message, "maximum context length") ||
+		strings.Contains(message, "context length exceeded") ||
+		strings.Contains(message, "exceeds the context") ||
+		strings.Contains(message, "prompt is too long") ||
+		(strings.Contains(message, "tokens") &&
+			(strings.Contains(message, "must have less than") || strings.Contains(message, "must be <="))):
+		return &ContextLengthExceededError{APIError: apiErr}
+	case apiErr.Code == "content_filter" || apiErr.Code == "content_policy_violation":
+		return &ContentFilterError{APIError: apiErr}
+	case apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden ||
+		apiErr.Code == "invalid_api_key" || apiErr.Type == "authentication_error" || apiErr.Type == "permission_error":
+		return &AuthenticationError{APIError: apiErr}
+	case apiErr.Code == "model_not_found" ||
+		(apiErr.StatusCode == http.StatusNotFound && strings.Contains(message, "model")):
+		return &ModelNotFoundError{APIError: apiErr}
+	case apiErr.Code == "insufficient_quota":
+		// Out of credits: retrying will not help, so this is not a rate limit
+		return &apiErr
+	case apiErr.StatusCode == http.StatusTooManyRequests || apiErr.Type == "rate_limit_error":
+		return &RateLimitError{APIError: apiErr, RetryAfter: retryAfter}
+	case apiErr.StatusCode >= http.StatusInternalServerError ||
+		apiErr.Type == "overloaded_error" || apiErr.Type == "api_error" ||
+		strings.Contains(message, "model is loading") ||
+		strings.Contains(message, "loading model") ||
+		strings.Contains(message, "server busy"):
+		return &ServerUnavailableError{APIError: apiErr, RetryAfter: retryAfter}
+	default:
+		return &apiErr
+	}
+}
+
+// retryAfter returns the delay requested by the Retry-After header, which holds
+// either a number of seconds or an HTTP date. OpenAI's retry-after-ms header is
+// preferred when present as it is more precise.
+func retryAfter(header http.Header) time.Duration {
+	if ms := header.Get("Retry-After-Ms"); ms != "" {
+		if n, err := strconv.ParseFloat(ms, 64); err == nil && n > 0 {
+			return time.Duration(n * float64(time.Millisecond))
+		}
+	}
+
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := time.Until(date); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
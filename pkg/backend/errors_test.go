@@ -0,0 +1,187 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOpenAIErrors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		status int
+		header map[string]string
+		body   string
+		check  func(t *testing.T, err error)
+	}{
+		{
+			name:   "rate limited",
+			status: http.StatusTooManyRequests,
+			header: map[string]string{"Retry-After": "2"},
+			body:   `{"error":{"message":"Rate limit reached","type":"requests","code":"rate_limit_exceeded"}}`,
+			check: func(t *testing.T, err error) {
+				t.Helper()
+				var rateErr *RateLimitError
+				if !errors.As(err, &rateErr) {
+					t.Fatalf("Expected RateLimitError, got %T: %v", err, err)
+				}
+				if rateErr.RetryAfter != 2*time.Second {
+					t.Errorf("Expected RetryAfter 2s, got %v", rateErr.RetryAfter)
+				}
+			},
+		},
+		{
+			name:   "invalid api key",
+			status: http.StatusUnauthorized,
+			body:   `{"error":{"message":"Incorrect API key provided","type":"invalid_request_error","code":"invalid_api_key"}}`,
+			check: func(t *testing.T, err error) {
+				t.Helper()
+				var authErr *AuthenticationError
+				if !errors.As(err, &authErr) {
+					t.Fatalf("Expected AuthenticationError, got %T: %v", err, err)
+				}
+			},
+		},
+		{
+			name:   "model not found",
+			status: http.StatusNotFound,
+			body:   `{"error":{"message":"The model 'gpt-5' does not exist","type":"invalid_request_error","code":"model_not_found"}}`,
+			check: func(t *testing.T, err error) {
+				t.Helper()
+				var modelErr *ModelNotFoundError
+				if !errors.As(err, &modelErr) {
+					t.Fatalf("Expected ModelNotFoundError, got %T: %v", err, err)
+				}
+			},
+		},
+		{
+			name:   "context length exceeded",
+			status: http.StatusBadRequest,
+			body: `{"error":{"message":"This model's maximum context length is 8192 tokens",` +
+				`"type":"invalid_request_error","code":"context_length_exceeded"}}`,
+			check: func(t *testing.T, err error) {
+				t.Helper()
+				var lengthErr *ContextLengthExceededError
+				if !errors.As(err, &lengthErr) {
+					t.Fatalf("Expected ContextLengthExceededError, got %T: %v", err, err)
+				}
+			},
+		},
+		{
+			name:   "content filtered",
+			status: http.StatusBadRequest,
+			body:   `{"error":{"message":"The response was filtered","type":"invalid_request_error","code":"content_filter"}}`,
+			check: func(t *testing.T, err error) {
+				t.Helper()
+				var filterErr *ContentFilterError
+				if !errors.As(err, &filterErr) {
+					t.Fatalf("Expected ContentFilterError, got %T: %v", err, err)
+				}
+			},
+		},
+		{
+			name:   "server unavailable",
+			status: http.StatusServiceUnavailable,
+			body:   `upstream connect error`,
+			check: func(t *testing.T, err error) {
+				t.Helper()
+				var serverErr *ServerUnavailableError
+				if !errors.As(err, &serverErr) {
+					t.Fatalf("Expected ServerUnavailableError, got %T: %v", err, err)
+				}
+				if serverErr.Message != "upstream connect error" {
+					t.Errorf("Expected the raw body as message, got %q", serverErr.Message)
+				}
+			},
+		},
+		{
+			name:   "insufficient quota",
+			status: http.StatusTooManyRequests,
+			body:   `{"error":{"message":"You exceeded your current quota","type":"insufficient_quota","code":"insufficient_quota"}}`,
+			check: func(t *testing.T, err error) {
+				t.Helper()
+				var rateErr *RateLimitError
+				if errors.As(err, &rateErr) {
+					t.Errorf("Expected insufficient quota not to be a RateLimitError")
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				for key, value := range tt.header {
+					w.Header().Set(key, value)
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer mockServer.Close()
+
+			backend := &OpenAIBackend{
+				APIKey:     "test-api-key",
+				Model:      "gpt-4o",
+				HTTPClient: mockServer.Client(),
+				BaseURL:    mockServer.URL,
+			}
+
+			_, err := backend.Generate(context.Background(), NewPrompt().AddMessage("user", "Hello"))
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("Expected an APIError, got %T: %v", err, err)
+			}
+			if apiErr.Provider != "openai" || apiErr.StatusCode != tt.status {
+				t.Errorf("Unexpected APIError: %+v", apiErr)
+			}
+			tt.check(t, err)
+		})
+	}
+}
+
+func TestOllamaErrors(t *testing.T) {
+	t.Parallel()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error":"model \"llama9\" not found, try pulling it first"}`))
+	}))
+	defer mockServer.Close()
+
+	backend := &OllamaBackend{
+		Model:   "llama9",
+		Client:  mockServer.Client(),
+		BaseURL: mockServer.URL,
+	}
+
+	_, err := backend.Embed(context.Background(), testEmbeddingText)
+
+	var modelErr *ModelNotFoundError
+	if !errors.As(err, &modelErr) {
+		t.Fatalf("Expected ModelNotFoundError, got %T: %v", err, err)
+	}
+	if modelErr.Provider != "ollama" || modelErr.Message != `model "llama9" not found, try pulling it first` {
+		t.Errorf("Unexpected error details: %+v", modelErr.APIError)
+	}
+}
@@ -0,0 +1,354 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultHedgePercentile is the latency percentile after which a call is hedged.
+	defaultHedgePercentile = 0.95
+	// defaultHedgeMinDelay is the shortest delay before a call is hedged.
+	defaultHedgeMinDelay = 10 * time.Millisecond
+	// defaultHedgeBudget is the fraction of calls that may be hedged.
+	defaultHedgeBudget = 0.1
+	// hedgeBurst is how many hedges the budget can save up while calls are fast.
+	hedgeBurst = 10
+	// latencyWindowSize is the number of recent latencies the hedging delay is computed from.
+	latencyWindowSize = 128
+	// minLatencySamples is the number of latencies needed before calls are hedged.
+	minLatencySamples = 20
+)
+
+// Ensure HedgedBackend implements the Backend interface.
+var _ Backend = (*HedgedBackend)(nil)
+
+// HedgeOption represents an option for NewHedgedBackend.
+type HedgeOption func(*HedgedBackend)
+
+// WithHedgePercentile sets the percentile of recent latencies after which a call
+// is hedged, between 0 and 1. It defaults to 0.95, hedging the slowest 5% of calls.
+func WithHedgePercentile(percentile float64) HedgeOption {
+	return func(h *HedgedBackend) {
+		h.percentile = percentile
+	}
+}
+
+// WithHedgeMinDelay sets the shortest delay before a call is hedged, so that
+// very fast calls are not duplicated over noise. It defaults to 10ms.
+func WithHedgeMinDelay(delay time.Duration) HedgeOption {
+	return func(h *HedgedBackend) {
+		h.minDelay = delay
+	}
+}
+
+// WithHedgeBudget caps the extra load of hedging to the given fraction of calls.
+// It defaults to 0.1: at most one call in ten is duplicated, with up to ten
+// hedges saved up for bursts of slow calls.
+func WithHedgeBudget(fraction float64) HedgeOption {
+	return func(h *HedgedBackend) {
+		h.budgetRate = fraction
+	}
+}
+
+// WithMaxConcurrentHedges caps the number of hedged requests in flight at once.
+// Zero, the default, means no limit beyond the budget.
+func WithMaxConcurrentHedges(n int) HedgeOption {
+	return func(h *HedgedBackend) {
+		h.maxInFlight = n
+	}
+}
+
+// HedgedBackend cuts tail latency by hedging slow calls: when a call to the
+// primary backend has not returned after a delay, the same call is sent to the
+// secondary backend and whichever answers first is used. The other call is
+// cancelled through its context.
+//
+// The delay is a percentile of the latencies of recent calls, tracked separately
+// for generations, single embeddings and batches of embeddings, so that slow
+// batches do not delay the hedging of single queries. Calls are not hedged until
+// enough latencies have been seen, and the hedging budget limits the extra load.
+// Streams are not supported. Backends created with NewHedgedGenerator or
+// NewHedgedEmbedder fail the calls their backends do not support.
+type HedgedBackend struct {
+	generators  [2]Generator
+	embedders   [2]Embedder
+	percentile  float64
+	minDelay    time.Duration
+	budgetRate  float64
+	maxInFlight int
+
+	mu         sync.Mutex
+	budget     float64
+	inFlight   int
+	generate   latencyWindow
+	embed      latencyWindow
+	embedBatch latencyWindow
+}
+
+// NewHedgedBackend creates a backend that hedges slow calls to primary with
+// calls to secondary. The secondary can be primary itself, another host serving
+// the same model, or a Router spreading hedges over several hosts.
+//
+// Parameters:
+//   - primary: The backend every call is sent to first.
+//   - secondary: The backend slow calls are duplicated to.
+//   - opts: Options setting the delay and the caps on extra load.
+//
+// Returns:
+//   - A pointer to a new HedgedBackend instance.
+//   - An error if primary or secondary is nil.
+func NewHedgedBackend(primary, secondary Backend, opts ...HedgeOption) (*HedgedBackend, error) {
+	if primary == nil || secondary == nil {
+		return nil, errHedgeBackendMissing
+	}
+	h := newHedgedBackend(opts)
+	h.generators = [2]Generator{primary, secondary}
+	h.embedders = [2]Embedder{primary, secondary}
+	return h, nil
+}
+
+// NewHedgedGenerator creates a backend that hedges slow generations of primary,
+// a backend that only generates such as AnthropicBackend, with generations of
+// secondary. Its embedding calls fail.
+//
+// Parameters:
+//   - primary: The generator every call is sent to first.
+//   - secondary: The generator slow calls are duplicated to.
+//   - opts: Options setting the delay and the caps on extra load.
+//
+// Returns:
+//   - A pointer to a new HedgedBackend instance.
+//   - An error if primary or secondary is nil.
+func NewHedgedGenerator(primary, secondary Generator, opts ...HedgeOption) (*HedgedBackend, error) {
+	if primary == nil || secondary == nil {
+		return nil, errHedgeBackendMissing
+	}
+	h := newHedgedBackend(opts)
+	h.generators = [2]Generator{primary, secondary}
+	return h, nil
+}
+
+// NewHedgedEmbedder creates a backend that hedges slow embeddings of primary, a
+// backend that only embeds such as TEIBackend, with embeddings of secondary.
+// Its generation calls fail.
+//
+// Parameters:
+//   - primary: The embedder every call is sent to first.
+//   - secondary: The embedder slow calls are duplicated to.
+//   - opts: Options setting the delay and the caps on extra load.
+//
+// Returns:
+//   - A pointer to a new HedgedBackend instance.
+//   - An error if primary or secondary is nil.
+func NewHedgedEmbedder(primary, secondary Embedder, opts ...HedgeOption) (*HedgedBackend, error) {
+	if primary == nil || secondary == nil {
+		return nil, errHedgeBackendMissing
+	}
+	h := newHedgedBackend(opts)
+	h.embedders = [2]Embedder{primary, secondary}
+	return h, nil
+}
+
+// errHedgeBackendMissing is returned when a hedged backend is created without
+// one of its backends, which would otherwise only fail once a call is hedged.
+var errHedgeBackendMissing = errors.New("hedged backend needs a primary and a secondary backend")
+
+func newHedgedBackend(opts []HedgeOption) *HedgedBackend {
+	h := &HedgedBackend{
+		percentile: defaultHedgePercentile,
+		minDelay:   defaultHedgeMinDelay,
+		budgetRate: defaultHedgeBudget,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	h.budget = hedgeBurst
+	return h
+}
+
+// Generate generates a response to the prompt, hedging the call if it is slow.
+func (h *HedgedBackend) Generate(ctx context.Context, prompt *Prompt) (string, error) {
+	result, err := h.GenerateWithResult(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	return result.Content(), nil
+}
+
+// GenerateWithResult generates a response to the prompt, hedging the call if it is slow.
+func (h *HedgedBackend) GenerateWithResult(ctx context.Context, prompt *Prompt) (*GenerateResult, error) {
+	if h.generators[0] == nil {
+		return nil, errNoGeneration
+	}
+	return hedge(ctx, h, &h.generate, h.generators, func(ctx context.Context, g Generator) (*GenerateResult, error) {
+		return g.GenerateWithResult(ctx, prompt)
+	})
+}
+
+// Embed embeds the input, hedging the call if it is slow.
+func (h *HedgedBackend) Embed(ctx context.Context, input string) ([]float32, error) {
+	if h.embedders[0] == nil {
+		return nil, errNoEmbedding
+	}
+	return hedge(ctx, h, &h.embed, h.embedders, func(ctx context.Context, e Embedder) ([]float32, error) {
+		return e.Embed(ctx, input)
+	})
+}
+
+// EmbedBatch embeds the inputs, hedging the call if it is slow.
+func (h *HedgedBackend) EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	if h.embedders[0] == nil {
+		return nil, errNoEmbedding
+	}
+	return hedge(ctx, h, &h.embedBatch, h.embedders, func(ctx context.Context, e Embedder) ([][]float32, error) {
+		return e.EmbedBatch(ctx, inputs)
+	})
+}
+
+// hedgeResult is the outcome of one of the calls of a hedged call.
+type hedgeResult[T any] struct {
+	value  T
+	err    error
+	hedged bool
+}
+
+// hedge sends call to the primary of backends and, if it has not returned after
+// the hedging delay of window, to the secondary. It returns the first success,
+// or the primary's error if both fail.
+func hedge[B, T any](
+	ctx context.Context, h *HedgedBackend, window *latencyWindow, backends [2]B, call func(ctx context.Context, b B) (T, error),
+) (T, error) {
+	// Returning cancels the call that lost, or both if the caller gave up.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgeResult[T], 2)
+	start := time.Now()
+	go func() {
+		value, err := call(ctx, backends[0])
+		results <- hedgeResult[T]{value: value, err: err}
+	}()
+
+	var timeout <-chan time.Time
+	if delay, ok := h.delay(window); ok {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	pending := 1
+	var primaryErr error
+	for {
+		select {
+		case <-timeout:
+			timeout = nil
+			if !h.acquireHedge() {
+				continue
+			}
+			pending++
+			go func() {
+				defer h.releaseHedge()
+				value, err := call(ctx, backends[1])
+				results <- hedgeResult[T]{value: value, err: err, hedged: true}
+			}()
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// When the hedge wins, this is when the primary was overtaken, a
+				// lower bound of its latency.
+				h.record(window, time.Since(start))
+				return result.value, nil
+			}
+			if !result.hedged {
+				timeout = nil
+				primaryErr = result.err
+			}
+			if pending == 0 {
+				if primaryErr == nil {
+					primaryErr = result.err
+				}
+				var zero T
+				return zero, primaryErr
+			}
+		}
+	}
+}
+
+// delay returns how long to wait before hedging a call, and whether enough
+// latencies are known to hedge at all.
+func (h *HedgedBackend) delay(window *latencyWindow) (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.budget = min(hedgeBurst, h.budget+h.budgetRate)
+	latency, ok := window.percentile(h.percentile)
+	return max(latency, h.minDelay), ok
+}
+
+// acquireHedge reports whether a hedge is within the budget and concurrency cap,
+// and takes it if so.
+func (h *HedgedBackend) acquireHedge() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.budget < 1 || (h.maxInFlight > 0 && h.inFlight >= h.maxInFlight) {
+		return false
+	}
+	h.budget--
+	h.inFlight++
+	return true
+}
+
+func (h *HedgedBackend) releaseHedge() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.inFlight--
+}
+
+func (h *HedgedBackend) record(window *latencyWindow, latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	window.add(latency)
+}
+
+// latencyWindow holds the most recent latencies of calls.
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+}
+
+func (w *latencyWindow) add(latency time.Duration) {
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, latency)
+		return
+	}
+	w.samples[w.next] = latency
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+// percentile returns the latency below which the fraction p of the samples
+// fall, and whether there are enough samples.
+func (w *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	if len(w.samples) < minLatencySamples {
+		return 0, false
+	}
+	sorted := append([]time.Duration(nil), w.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(p * float64(len(sorted)))
+	return sorted[min(max(i, 0), len(sorted)-1)], true
+}
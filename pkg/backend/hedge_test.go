@@ -0,0 +1,243 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sleepyBackend embeds after delay unless its context is cancelled first,
+// counting its calls and cancellations.
+type sleepyBackend struct {
+	stubGenerator
+	delay     time.Duration
+	value     float32
+	err       error
+	calls     atomic.Int32
+	cancelled atomic.Int32
+}
+
+func (b *sleepyBackend) Embed(ctx context.Context, _ string) ([]float32, error) {
+	b.calls.Add(1)
+	select {
+	case <-ctx.Done():
+		b.cancelled.Add(1)
+		return nil, ctx.Err()
+	case <-time.After(b.delay):
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	return []float32{b.value}, nil
+}
+
+func (b *sleepyBackend) EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(inputs))
+	for i, input := range inputs {
+		embedding, err := b.Embed(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		embeddings[i] = embedding
+	}
+	return embeddings, nil
+}
+
+func newTestHedge(t *testing.T, primary, secondary Backend, opts ...HedgeOption) *HedgedBackend {
+	t.Helper()
+	hedged, err := NewHedgedBackend(primary, secondary, opts...)
+	if err != nil {
+		t.Fatalf("NewHedgedBackend returned error: %v", err)
+	}
+	return hedged
+}
+
+// warmUp fills a latency window of h with samples of latency.
+func warmUp(h *HedgedBackend, window *latencyWindow, latency time.Duration) {
+	for i := 0; i < minLatencySamples; i++ {
+		h.record(window, latency)
+	}
+}
+
+func TestHedgedBackendHedgesSlowCalls(t *testing.T) {
+	t.Parallel()
+	primary := &sleepyBackend{delay: 5 * time.Second, value: 1}
+	secondary := &sleepyBackend{delay: time.Millisecond, value: 2}
+	hedged := newTestHedge(t, primary, secondary, WithHedgeMinDelay(time.Millisecond))
+	warmUp(hedged, &hedged.embed, 20*time.Millisecond)
+
+	start := time.Now()
+	embedding, err := hedged.Embed(context.Background(), "chunk")
+	if err != nil {
+		t.Fatalf("Embed returned error: %v", err)
+	}
+	if embedding[0] != 2 {
+		t.Errorf("Expected the hedge to answer, got %v", embedding)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the hedge to cut the latency, took %s", elapsed)
+	}
+	deadline := time.Now().Add(time.Second)
+	for primary.cancelled.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if primary.cancelled.Load() != 1 {
+		t.Errorf("Expected the slow primary call to be cancelled")
+	}
+}
+
+func TestHedgedBackendSkipsFastCalls(t *testing.T) {
+	t.Parallel()
+	primary := &sleepyBackend{value: 1}
+	secondary := &sleepyBackend{value: 2}
+	hedged := newTestHedge(t, primary, secondary, WithHedgeMinDelay(time.Second))
+	warmUp(hedged, &hedged.embedBatch, time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		if _, err := hedged.EmbedBatch(context.Background(), []string{"a", "b"}); err != nil {
+			t.Fatalf("EmbedBatch returned error: %v", err)
+		}
+	}
+	if secondary.calls.Load() != 0 {
+		t.Errorf("Expected no hedges for fast calls, got %d", secondary.calls.Load())
+	}
+}
+
+func TestHedgedBackendSeparatesBatchLatencies(t *testing.T) {
+	t.Parallel()
+	primary := &sleepyBackend{delay: 5 * time.Second, value: 1}
+	secondary := &sleepyBackend{delay: time.Millisecond, value: 2}
+	hedged := newTestHedge(t, primary, secondary, WithHedgeMinDelay(time.Millisecond))
+	warmUp(hedged, &hedged.embed, 20*time.Millisecond)
+	warmUp(hedged, &hedged.embedBatch, time.Minute)
+
+	start := time.Now()
+	if _, err := hedged.Embed(context.Background(), "query"); err != nil {
+		t.Fatalf("Embed returned error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected slow batches not to delay the hedging of single embeddings, took %s", elapsed)
+	}
+	if len(hedged.embedBatch.samples) != minLatencySamples {
+		t.Errorf("Expected single embeddings not to be recorded as batches")
+	}
+}
+
+func TestHedgedBackendNeedsLatencies(t *testing.T) {
+	t.Parallel()
+	primary := &sleepyBackend{delay: 50 * time.Millisecond}
+	secondary := &sleepyBackend{}
+	hedged := newTestHedge(t, primary, secondary, WithHedgeMinDelay(time.Millisecond))
+
+	if _, err := hedged.Embed(context.Background(), "chunk"); err != nil {
+		t.Fatalf("Embed returned error: %v", err)
+	}
+	if secondary.calls.Load() != 0 {
+		t.Errorf("Expected no hedge before latencies are known")
+	}
+	if len(hedged.embed.samples) != 1 {
+		t.Errorf("Expected the latency to be recorded, got %d samples", len(hedged.embed.samples))
+	}
+}
+
+func TestHedgedBackendBudget(t *testing.T) {
+	t.Parallel()
+	primary := &sleepyBackend{delay: 100 * time.Millisecond}
+	secondary := &sleepyBackend{delay: time.Millisecond}
+	hedged := newTestHedge(t, primary, secondary, WithHedgeMinDelay(time.Millisecond), WithHedgeBudget(0))
+	warmUp(hedged, &hedged.embed, time.Millisecond)
+
+	for i := 0; i < hedgeBurst+5; i++ {
+		if _, err := hedged.Embed(context.Background(), "chunk"); err != nil {
+			t.Fatalf("Embed returned error: %v", err)
+		}
+	}
+	if got := secondary.calls.Load(); got != hedgeBurst {
+		t.Errorf("Expected the budget to allow %d hedges, got %d", hedgeBurst, got)
+	}
+}
+
+func TestHedgedBackendErrors(t *testing.T) {
+	t.Parallel()
+	failure := errors.New("primary failed")
+	primary := &sleepyBackend{delay: 30 * time.Millisecond, err: failure}
+	secondary := &sleepyBackend{delay: 5 * time.Second, value: 2}
+	hedged := newTestHedge(t, primary, secondary, WithHedgeMinDelay(time.Millisecond))
+	warmUp(hedged, &hedged.embed, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := hedged.Embed(ctx, "chunk"); !errors.Is(err, failure) {
+		t.Errorf("Expected the primary's error when both calls fail, got %v", err)
+	}
+
+	fast := newTestHedge(t, &sleepyBackend{err: failure}, secondary)
+	warmUp(fast, &fast.embed, time.Second)
+	if _, err := fast.Embed(context.Background(), "chunk"); !errors.Is(err, failure) {
+		t.Errorf("Expected a primary failure before the delay to be returned, got %v", err)
+	}
+}
+
+func TestHedgedGeneratorAndEmbedder(t *testing.T) {
+	t.Parallel()
+	primary := &sleepyBackend{delay: 5 * time.Second, value: 1}
+	secondary := &sleepyBackend{delay: time.Millisecond, value: 2}
+	embedder, err := NewHedgedEmbedder(
+		struct{ Embedder }{primary}, struct{ Embedder }{secondary}, WithHedgeMinDelay(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("NewHedgedEmbedder returned error: %v", err)
+	}
+	warmUp(embedder, &embedder.embed, 20*time.Millisecond)
+
+	embedding, err := embedder.Embed(context.Background(), "chunk")
+	if err != nil {
+		t.Fatalf("Embed returned error: %v", err)
+	}
+	if embedding[0] != 2 {
+		t.Errorf("Expected the hedge to answer, got %v", embedding)
+	}
+	if _, err := embedder.Generate(context.Background(), NewPrompt()); !errors.Is(err, errNoGeneration) {
+		t.Errorf("Expected %v, got %v", errNoGeneration, err)
+	}
+
+	generator, err := NewHedgedGenerator(&stubGenerator{response: "Hi"}, &AnthropicBackend{})
+	if err != nil {
+		t.Fatalf("NewHedgedGenerator returned error: %v", err)
+	}
+	response, err := generator.Generate(context.Background(), NewPrompt().AddMessage("user", "Hi"))
+	if err != nil || response != "Hi" {
+		t.Errorf("Expected the primary to answer, got %q, %v", response, err)
+	}
+	if _, err := generator.EmbedBatch(context.Background(), []string{"chunk"}); !errors.Is(err, errNoEmbedding) {
+		t.Errorf("Expected %v, got %v", errNoEmbedding, err)
+	}
+}
+
+func TestHedgedBackendNeedsBothBackends(t *testing.T) {
+	t.Parallel()
+	if _, err := NewHedgedBackend(&sleepyBackend{}, nil); !errors.Is(err, errHedgeBackendMissing) {
+		t.Errorf("Expected %v for a missing secondary, got %v", errHedgeBackendMissing, err)
+	}
+	if _, err := NewHedgedGenerator(nil, &stubGenerator{}); !errors.Is(err, errHedgeBackendMissing) {
+		t.Errorf("Expected %v for a missing primary, got %v", errHedgeBackendMissing, err)
+	}
+	if _, err := NewHedgedEmbedder(&sleepyBackend{}, nil); !errors.Is(err, errHedgeBackendMissing) {
+		t.Errorf("Expected %v for a missing secondary, got %v", errHedgeBackendMissing, err)
+	}
+}
@@ -0,0 +1,429 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	llamaCppCompletionEndpoint = "/completion"
+	llamaCppEmbeddingEndpoint  = "/embedding"
+	llamaCppTokenizeEndpoint   = "/tokenize"
+)
+
+// Ensure LlamaCppBackend implements the backend interfaces.
+var (
+	_ Backend  = (*LlamaCppBackend)(nil)
+	_ Streamer = (*LlamaCppBackend)(nil)
+)
+
+// LlamaCppBackend represents a backend for interacting with the native API of the
+// llama.cpp server. The server loads a single model, so requests do not name one.
+//
+// The /completion endpoint takes a raw prompt string, which is rendered from the
+// prompt messages with Template. Tools are not supported.
+type LlamaCppBackend struct {
+	BaseURL string
+	Client  *http.Client
+	// Template renders the prompt messages for the loaded model. It must match
+	// the model's training format; if nil, Llama3Template is used.
+	Template ChatTemplate
+	// Grammar is a GBNF grammar that constrains every generation. It is ignored
+	// for prompts with a ResponseFormat, whose schema is sent instead.
+	Grammar string
+	// Retry configures retries of transient failures, including models that are
+	// still loading. If nil, requests are not retried.
+	Retry *RetryPolicy
+}
+
+// LlamaCppCompletionResponse represents the response of the llama.cpp /completion
+// endpoint. When streaming, each chunk has the same shape and carries the next
+// piece of the completion; the last one has Stop set.
+type LlamaCppCompletionResponse struct {
+	Content         string `json:"content"`
+	Model           string `json:"model"`
+	Stop            bool   `json:"stop"`
+	StoppedEOS      bool   `json:"stopped_eos"`
+	StoppedLimit    bool   `json:"stopped_limit"`
+	StoppedWord     bool   `json:"stopped_word"`
+	StoppingWord    string `json:"stopping_word"`
+	TokensPredicted int    `json:"tokens_predicted"`
+	TokensEvaluated int    `json:"tokens_evaluated"`
+}
+
+// NewLlamaCppBackend creates a new LlamaCppBackend instance.
+//
+// Parameters:
+//   - baseURL: The URL of the llama.cpp server, such as http://localhost:8080.
+//   - template: The chat template of the loaded model. If nil, Llama3Template is used.
+//   - timeout: The duration for the HTTP client timeout.
+//
+// Returns:
+//   - A pointer to a new LlamaCppBackend instance.
+func NewLlamaCppBackend(baseURL string, template ChatTemplate, timeout time.Duration) *LlamaCppBackend {
+	return &LlamaCppBackend{
+		BaseURL:  baseURL,
+		Template: template,
+		Client: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+// Generate renders the prompt with the backend's chat template and returns the
+// completion generated by the llama.cpp server.
+//
+// Parameters:
+//   - ctx: The context for the API request, which can be used for cancellation.
+//   - prompt: A structured prompt containing messages and parameters.
+//
+// Returns:
+//   - A string containing the generated response.
+//   - An error if the API request fails or if there's an issue processing the response.
+func (l *LlamaCppBackend) Generate(ctx context.Context, prompt *Prompt) (string, error) {
+	result, err := l.GenerateWithResult(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	return result.Content(), nil
+}
+
+// GenerateWithResult renders the prompt with the backend's chat template and
+// returns the completion together with the finish reason, token counts and latency.
+//
+// Parameters:
+//   - ctx: The context for the API request, which can be used for cancellation.
+//   - prompt: A structured prompt containing messages and parameters.
+//
+// Returns:
+//   - The generation result, including the assistant message.
+//   - An error if the API request fails or if there's an issue processing the response.
+func (l *LlamaCppBackend) GenerateWithResult(ctx context.Context, prompt *Prompt) (*GenerateResult, error) {
+	reqBody, err := l.completionRequestBody(prompt, false)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := l.send(ctx, l.Client, llamaCppCompletionEndpoint, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate response from llama.cpp: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result LlamaCppCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &GenerateResult{
+		Message:      Message{Role: "assistant", Content: result.Content},
+		FinishReason: llamaCppFinishReason(result),
+		Usage: Usage{
+			PromptTokens:     result.TokensEvaluated,
+			CompletionTokens: result.TokensPredicted,
+			TotalTokens:      result.TokensEvaluated + result.TokensPredicted,
+		},
+		Model:   result.Model,
+		Latency: time.Since(start),
+	}, nil
+}
+
+// llamaCppFinishReason maps the stop flags of a completion onto a FinishReason.
+func llamaCppFinishReason(result LlamaCppCompletionResponse) FinishReason {
+	switch {
+	case result.StoppedLimit:
+		return FinishReasonLength
+	case result.StoppedEOS || result.StoppedWord:
+		return FinishReasonStop
+	default:
+		return ""
+	}
+}
+
+// GenerateStream renders the prompt with the backend's chat template and delivers
+// the completion in chunks as it is generated. llama.cpp streams server-sent
+// events, each carrying the next piece of the completion.
+//
+// The request is bounded by ctx only; the client timeout is not applied so that
+// long generations are not cut off mid-stream.
+//
+// Parameters:
+//   - ctx: The context for the API request, which can be used for cancellation.
+//   - prompt: A structured prompt containing messages and parameters.
+//
+// Returns:
+//   - A channel receiving the response chunks, closed when the stream ends.
+//   - An error if the request could not be started.
+func (l *LlamaCppBackend) GenerateStream(ctx context.Context, prompt *Prompt) (<-chan StreamChunk, error) {
+	reqBody, err := l.completionRequestBody(prompt, true)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := l.send(ctx, streamingClient(l.Client), llamaCppCompletionEndpoint, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate response from llama.cpp: %w", err)
+	}
+
+	chunks := make(chan StreamChunk)
+	go func() {
+		defer close(chunks)
+		defer resp.Body.Close()
+
+		done := false
+		err := scanSSE(resp.Body, func(data []byte) bool {
+			var result struct {
+				LlamaCppCompletionResponse
+				Error json.RawMessage `json:"error"`
+			}
+			if err := json.Unmarshal(data, &result); err != nil {
+				sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("failed to decode stream chunk: %w", err)})
+				return false
+			}
+			if len(result.Error) > 0 {
+				apiErr := llamaCppErrorBody(data)
+				sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("llama.cpp stream error: %w", classifyError(apiErr, 0))})
+				return false
+			}
+			done = result.Stop
+			return sendChunk(ctx, chunks, StreamChunk{Content: result.Content, Done: result.Stop}) && !done
+		})
+		if err != nil {
+			sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("failed to read stream: %w", err)})
+			return
+		}
+		if !done && ctx.Err() == nil {
+			sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("stream ended before completion: %w", io.ErrUnexpectedEOF)})
+		}
+	}()
+
+	return chunks, nil
+}
+
+// completionRequestBody builds the JSON body of a /completion request for the given prompt.
+func (l *LlamaCppBackend) completionRequestBody(prompt *Prompt, stream bool) ([]byte, error) {
+	if len(prompt.Tools) > 0 {
+		return nil, fmt.Errorf("tools are not supported by the llama.cpp completion endpoint")
+	}
+	if err := checkTextOnly(prompt.Messages, "llama.cpp"); err != nil {
+		return nil, err
+	}
+
+	template := l.Template
+	if template == nil {
+		template = Llama3Template
+	}
+	text, err := template.Render(prompt.Messages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render prompt: %w", err)
+	}
+
+	reqBody := map[string]interface{}{
+		"prompt": text,
+		"stop":   template.StopSequences(),
+		"stream": stream,
+	}
+	params := prompt.Parameters
+	if params.MaxTokens != 0 {
+		reqBody["n_predict"] = params.MaxTokens
+	}
+	if params.Temperature != 0 {
+		reqBody["temperature"] = params.Temperature
+	}
+	if params.TopP != 0 {
+		reqBody["top_p"] = params.TopP
+	}
+	if params.FrequencyPenalty != 0 {
+		reqBody["frequency_penalty"] = params.FrequencyPenalty
+	}
+	if params.PresencePenalty != 0 {
+		reqBody["presence_penalty"] = params.PresencePenalty
+	}
+	if params.RepeatPenalty != 0 {
+		reqBody["repeat_penalty"] = params.RepeatPenalty
+	}
+	if params.Seed != 0 {
+		reqBody["seed"] = params.Seed
+	}
+	if prompt.ResponseFormat != nil {
+		reqBody["json_schema"] = prompt.ResponseFormat.Schema
+	} else if l.Grammar != "" {
+		reqBody["grammar"] = l.Grammar
+	}
+
+	reqBodyBytes, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	return reqBodyBytes, nil
+}
+
+// Embed generates embeddings for the given input text using the llama.cpp
+// /embedding endpoint. The server must have been started with embeddings enabled.
+//
+// Parameters:
+//   - ctx: The context for the API request, which can be used for cancellation.
+//   - input: The input text to be embedded.
+//
+// Returns:
+//   - A slice of float32 values representing the embedding vector.
+//   - An error if the API request fails or if there's an issue processing the response.
+func (l *LlamaCppBackend) Embed(ctx context.Context, input string) ([]float32, error) {
+	embeddings, err := l.requestEmbeddings(ctx, input, 1)
+	if err != nil {
+		return nil, err
+	}
+	return embeddings[0], nil
+}
+
+// EmbedBatch generates embeddings for several input texts with a single request
+// to the llama.cpp /embedding endpoint.
+//
+// Parameters:
+//   - ctx: The context for the API request, which can be used for cancellation.
+//   - inputs: The input texts to be embedded.
+//
+// Returns:
+//   - The embedding vectors, in the same order as the input texts.
+//   - An error if the API request fails or if there's an issue processing the response.
+func (l *LlamaCppBackend) EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	if len(inputs) == 0 {
+		return [][]float32{}, nil
+	}
+	return l.requestEmbeddings(ctx, inputs, len(inputs))
+}
+
+// requestEmbeddings sends a single /embedding request for content, which is either
+// a string or a slice of strings, and returns the embeddings ordered by input index.
+func (l *LlamaCppBackend) requestEmbeddings(ctx context.Context, content interface{}, count int) ([][]float32, error) {
+	reqBodyBytes, err := json.Marshal(map[string]interface{}{"content": content})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	resp, err := l.send(ctx, l.Client, llamaCppEmbeddingEndpoint, reqBodyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate embeddings from llama.cpp: %w", err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	embeddings, err := decodeLlamaCppEmbeddings(bodyBytes, count)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return embeddings, nil
+}
+
+// decodeLlamaCppEmbeddings decodes an /embedding response. Older servers return a
+// single {"embedding": [...]} object, newer ones an array of {"index", "embedding"}
+// objects whose embedding is nested in another array when pooling is enabled.
+func decodeLlamaCppEmbeddings(body []byte, count int) ([][]float32, error) {
+	var single struct {
+		Embedding []float32 `json:"embedding"`
+	}
+	if err := json.Unmarshal(body, &single); err == nil {
+		if count != 1 {
+			return nil, fmt.Errorf("expected %d embeddings, got 1", count)
+		}
+		return [][]float32{single.Embedding}, nil
+	}
+
+	var results []struct {
+		Index     int             `json:"index"`
+		Embedding json.RawMessage `json:"embedding"`
+	}
+	if err := json.Unmarshal(body, &results); err != nil {
+		return nil, err
+	}
+	if len(results) != count {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", count, len(results))
+	}
+
+	embeddings := make([][]float32, count)
+	for _, result := range results {
+		if result.Index < 0 || result.Index >= count || embeddings[result.Index] != nil {
+			return nil, fmt.Errorf("unexpected embedding index %d", result.Index)
+		}
+		var vector []float32
+		if err := json.Unmarshal(result.Embedding, &vector); err != nil {
+			var nested [][]float32
+			if err := json.Unmarshal(result.Embedding, &nested); err != nil || len(nested) != 1 {
+				return nil, fmt.Errorf("unexpected embedding shape for index %d", result.Index)
+			}
+			vector = nested[0]
+		}
+		embeddings[result.Index] = vector
+	}
+	return embeddings, nil
+}
+
+// Tokenize converts text into the token IDs of the loaded model using the
+// llama.cpp /tokenize endpoint.
+//
+// Parameters:
+//   - ctx: The context for the API request, which can be used for cancellation.
+//   - text: The text to tokenize.
+//
+// Returns:
+//   - The token IDs of the text.
+//   - An error if the API request fails or if there's an issue processing the response.
+func (l *LlamaCppBackend) Tokenize(ctx context.Context, text string) ([]int, error) {
+	reqBodyBytes, err := json.Marshal(map[string]interface{}{"content": text})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	resp, err := l.send(ctx, l.Client, llamaCppTokenizeEndpoint, reqBodyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to tokenize with llama.cpp: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Tokens []int `json:"tokens"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return result.Tokens, nil
+}
+
+// send posts body to the given API endpoint and returns the successful response,
+// retrying transient failures according to the backend's retry policy.
+func (l *LlamaCppBackend) send(ctx context.Context, client *http.Client, endpoint string, body []byte) (*http.Response, error) {
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.BaseURL+endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	}
+	return sendWithRetry(ctx, l.Retry, client, 0, newRequest, newLlamaCppError)
+}
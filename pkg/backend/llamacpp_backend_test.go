@@ -0,0 +1,187 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLlamaCppGenerate(t *testing.T) {
+	t.Parallel()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != llamaCppCompletionEndpoint {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+
+		var reqBody map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		expectedPrompt := "<|im_start|>system\nYou are terse.<|im_end|>\n<|im_start|>user\nHi<|im_end|>\n<|im_start|>assistant\n"
+		if reqBody["prompt"] != expectedPrompt {
+			t.Errorf("Expected prompt %q, got %q", expectedPrompt, reqBody["prompt"])
+		}
+		if reqBody["n_predict"] != float64(64) {
+			t.Errorf("Expected n_predict 64, got %v", reqBody["n_predict"])
+		}
+		if reqBody["grammar"] != `root ::= "yes" | "no"` {
+			t.Errorf("Expected the grammar to be sent, got %v", reqBody["grammar"])
+		}
+		if _, ok := reqBody["frequency_penalty"]; ok {
+			t.Error("Expected unset parameters to be omitted")
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		fmt.Fprint(w, `{"content":"yes","model":"qwen2.5-7b.gguf","stop":true,"stopped_eos":true,`+
+			`"tokens_predicted":2,"tokens_evaluated":20}`)
+	}))
+	defer mockServer.Close()
+
+	backend := NewLlamaCppBackend(mockServer.URL, ChatMLTemplate, 10*time.Second)
+	backend.Grammar = `root ::= "yes" | "no"`
+
+	prompt := NewPrompt().
+		AddMessage("system", "You are terse.").
+		AddMessage("user", "Hi").
+		SetParameters(Parameters{MaxTokens: 64})
+
+	result, err := backend.GenerateWithResult(context.Background(), prompt)
+	if err != nil {
+		t.Fatalf("GenerateWithResult returned error: %v", err)
+	}
+	if result.Content() != "yes" {
+		t.Errorf("Expected response 'yes', got '%s'", result.Content())
+	}
+	if result.FinishReason != FinishReasonStop {
+		t.Errorf("Expected finish reason stop, got %s", result.FinishReason)
+	}
+	if result.Usage.TotalTokens != 22 {
+		t.Errorf("Expected 22 total tokens, got %d", result.Usage.TotalTokens)
+	}
+}
+
+func TestLlamaCppGenerateStream(t *testing.T) {
+	t.Parallel()
+	events := []string{
+		`{"content":"This is ","stop":false}`,
+		`{"content":"a test response.","stop":false}`,
+		`{"content":"","stop":true,"stopped_eos":true}`,
+	}
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			fmt.Fprintf(w, "data: %s\n\n", event)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer mockServer.Close()
+
+	backend := NewLlamaCppBackend(mockServer.URL, nil, 10*time.Second)
+
+	stream, err := backend.GenerateStream(context.Background(), NewPrompt().AddMessage("user", "Hi"))
+	if err != nil {
+		t.Fatalf("GenerateStream returned error: %v", err)
+	}
+
+	var response string
+	var done bool
+	for chunk := range stream {
+		if chunk.Err != nil {
+			t.Fatalf("Stream returned error: %v", chunk.Err)
+		}
+		response += chunk.Content
+		done = chunk.Done
+	}
+
+	if !done {
+		t.Error("Expected the last chunk to be marked as done")
+	}
+	if expected := "This is a test response."; response != expected {
+		t.Errorf("Expected response '%s', got '%s'", expected, response)
+	}
+}
+
+func TestLlamaCppEmbedBatch(t *testing.T) {
+	t.Parallel()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != llamaCppEmbeddingEndpoint {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		// Pooled embeddings are nested in an extra array, and the order is not guaranteed
+		fmt.Fprint(w, `[{"index":1,"embedding":[[0.3,0.4]]},{"index":0,"embedding":[[0.1,0.2]]}]`)
+	}))
+	defer mockServer.Close()
+
+	backend := NewLlamaCppBackend(mockServer.URL, nil, 10*time.Second)
+
+	embeddings, err := backend.EmbedBatch(context.Background(), []string{"first", "second"})
+	if err != nil {
+		t.Fatalf("EmbedBatch returned error: %v", err)
+	}
+	if len(embeddings) != 2 || embeddings[0][0] != 0.1 || embeddings[1][0] != 0.3 {
+		t.Errorf("Unexpected embeddings: %v", embeddings)
+	}
+}
+
+func TestLlamaCppTokenize(t *testing.T) {
+	t.Parallel()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != llamaCppTokenizeEndpoint {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		fmt.Fprint(w, `{"tokens":[9906,1917]}`)
+	}))
+	defer mockServer.Close()
+
+	backend := NewLlamaCppBackend(mockServer.URL, nil, 10*time.Second)
+
+	tokens, err := backend.Tokenize(context.Background(), "Hello world")
+	if err != nil {
+		t.Fatalf("Tokenize returned error: %v", err)
+	}
+	if len(tokens) != 2 || tokens[0] != 9906 {
+		t.Errorf("Unexpected tokens: %v", tokens)
+	}
+}
+
+func TestLlamaCppErrors(t *testing.T) {
+	t.Parallel()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"error":{"code":503,"message":"Loading model","type":"unavailable_error"}}`)
+	}))
+	defer mockServer.Close()
+
+	backend := NewLlamaCppBackend(mockServer.URL, nil, 10*time.Second)
+
+	_, err := backend.Generate(context.Background(), NewPrompt().AddMessage("user", "Hi"))
+
+	var serverErr *ServerUnavailableError
+	if !errors.As(err, &serverErr) {
+		t.Fatalf("Expected ServerUnavailableError, got %T: %v", err, err)
+	}
+	if serverErr.Provider != "llamacpp" || serverErr.Message != "Loading model" {
+		t.Errorf("Unexpected error details: %+v", serverErr.APIError)
+	}
+}
@@ -0,0 +1,371 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+const (
+	// OperationGenerate identifies generation calls in CallInfo.
+	OperationGenerate = "generate"
+	// OperationEmbed identifies embedding calls in CallInfo.
+	OperationEmbed = "embed"
+
+	// redactedText replaces the text matched by redaction patterns.
+	redactedText = "[REDACTED]"
+)
+
+// errNilResult is returned when middleware returns neither a result nor an error.
+var errNilResult = errors.New("middleware returned no result")
+
+// Ensure the wrapped backends implement the backend interfaces.
+var (
+	_ Backend   = (*WrappedBackend)(nil)
+	_ Streamer  = (*WrappedBackend)(nil)
+	_ Generator = (*WrappedGenerator)(nil)
+	_ Streamer  = (*WrappedGenerator)(nil)
+	_ Embedder  = (*WrappedEmbedder)(nil)
+)
+
+// GenerateFunc generates the result of a prompt. It is the signature of the
+// generation calls that middleware intercepts.
+type GenerateFunc func(ctx context.Context, prompt *Prompt) (*GenerateResult, error)
+
+// EmbedFunc embeds a batch of inputs. It is the signature of the embedding calls
+// that middleware intercepts; Embed is passed a single input, which reaches the
+// Embed method of the wrapped embedder rather than EmbedBatch.
+type EmbedFunc func(ctx context.Context, inputs []string) ([][]float32, error)
+
+// StreamFunc starts a streamed generation. It is the signature of the streaming
+// calls that middleware intercepts.
+type StreamFunc func(ctx context.Context, prompt *Prompt) (<-chan StreamChunk, error)
+
+// Middleware intercepts the calls made to a backend wrapped with Wrap,
+// WrapGenerator or WrapEmbedder. Each field wraps the next function of its kind
+// in the chain, and can inspect or change the prompt or inputs, the result and
+// the error. A nil field passes calls of that kind through unchanged.
+type Middleware struct {
+	Generate func(next GenerateFunc) GenerateFunc
+	Embed    func(next EmbedFunc) EmbedFunc
+	Stream   func(next StreamFunc) StreamFunc
+}
+
+// WrappedGenerator is a generator whose calls go through a chain of middleware.
+// It is created with WrapGenerator.
+type WrappedGenerator struct {
+	generator Generator
+	generate  GenerateFunc
+	stream    StreamFunc
+}
+
+// WrappedEmbedder is an embedder whose calls go through a chain of middleware.
+// It is created with WrapEmbedder.
+type WrappedEmbedder struct {
+	embedder   Embedder
+	embed      EmbedFunc
+	embedBatch EmbedFunc
+}
+
+// WrappedBackend is a backend whose calls go through a chain of middleware. It
+// is created with Wrap.
+type WrappedBackend struct {
+	*WrappedGenerator
+	*WrappedEmbedder
+	backend Backend
+}
+
+// Wrap returns a backend that sends every call to b through the given middleware.
+// The first middleware is the outermost: it sees calls first and results last.
+// Streaming is supported if b implements Streamer. Use WrapGenerator and
+// WrapEmbedder for backends that only generate or only embed.
+//
+// Parameters:
+//   - b: The backend that finally handles the calls.
+//   - middleware: The middleware to apply, outermost first.
+//
+// Returns:
+//   - The wrapped backend.
+func Wrap(b Backend, middleware ...Middleware) *WrappedBackend {
+	return &WrappedBackend{
+		WrappedGenerator: WrapGenerator(b, middleware...),
+		WrappedEmbedder:  WrapEmbedder(b, middleware...),
+		backend:          b,
+	}
+}
+
+// WrapGenerator returns a generator that sends every generation and stream call
+// to g through the given middleware, outermost first. Streaming is supported if g
+// implements Streamer.
+//
+// Parameters:
+//   - g: The generator that finally handles the calls.
+//   - middleware: The middleware to apply, outermost first.
+//
+// Returns:
+//   - The wrapped generator.
+func WrapGenerator(g Generator, middleware ...Middleware) *WrappedGenerator {
+	w := &WrappedGenerator{
+		generator: g,
+		generate:  g.GenerateWithResult,
+		stream: func(ctx context.Context, prompt *Prompt) (<-chan StreamChunk, error) {
+			streamer, ok := g.(Streamer)
+			if !ok {
+				return nil, fmt.Errorf("backend %T does not support streaming", g)
+			}
+			return streamer.GenerateStream(ctx, prompt)
+		},
+	}
+	for i := len(middleware) - 1; i >= 0; i-- {
+		if middleware[i].Generate != nil {
+			w.generate = middleware[i].Generate(w.generate)
+		}
+		if middleware[i].Stream != nil {
+			w.stream = middleware[i].Stream(w.stream)
+		}
+	}
+	return w
+}
+
+// WrapEmbedder returns an embedder that sends every embedding call to e through
+// the given middleware, outermost first.
+//
+// Parameters:
+//   - e: The embedder that finally handles the calls.
+//   - middleware: The middleware to apply, outermost first.
+//
+// Returns:
+//   - The wrapped embedder.
+func WrapEmbedder(e Embedder, middleware ...Middleware) *WrappedEmbedder {
+	w := &WrappedEmbedder{
+		embedder:   e,
+		embed:      embedOne(e),
+		embedBatch: e.EmbedBatch,
+	}
+	for i := len(middleware) - 1; i >= 0; i-- {
+		if middleware[i].Embed != nil {
+			w.embed = middleware[i].Embed(w.embed)
+			w.embedBatch = middleware[i].Embed(w.embedBatch)
+		}
+	}
+	return w
+}
+
+// embedOne returns the end of the chain of single embeddings, which sends them
+// to the Embed method of e. Some backends embed single inputs on another
+// endpoint than batches, and the vectors may differ, for example in their
+// normalization. If middleware changed the number of inputs, they go to
+// EmbedBatch.
+func embedOne(e Embedder) EmbedFunc {
+	return func(ctx context.Context, inputs []string) ([][]float32, error) {
+		if len(inputs) != 1 {
+			return e.EmbedBatch(ctx, inputs)
+		}
+		embedding, err := e.Embed(ctx, inputs[0])
+		if err != nil {
+			return nil, err
+		}
+		return [][]float32{embedding}, nil
+	}
+}
+
+// Unwrap returns the wrapped backend.
+func (w *WrappedBackend) Unwrap() Backend {
+	return w.backend
+}
+
+// Unwrap returns the wrapped generator.
+func (w *WrappedGenerator) Unwrap() Generator {
+	return w.generator
+}
+
+// Generate generates a response to the prompt through the middleware chain.
+func (w *WrappedGenerator) Generate(ctx context.Context, prompt *Prompt) (string, error) {
+	result, err := w.generate(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	if result == nil {
+		return "", errNilResult
+	}
+	return result.Content(), nil
+}
+
+// GenerateWithResult generates a response to the prompt through the middleware chain.
+func (w *WrappedGenerator) GenerateWithResult(ctx context.Context, prompt *Prompt) (*GenerateResult, error) {
+	return w.generate(ctx, prompt)
+}
+
+// GenerateStream streams a response to the prompt through the middleware chain.
+func (w *WrappedGenerator) GenerateStream(ctx context.Context, prompt *Prompt) (<-chan StreamChunk, error) {
+	return w.stream(ctx, prompt)
+}
+
+// Unwrap returns the wrapped embedder.
+func (w *WrappedEmbedder) Unwrap() Embedder {
+	return w.embedder
+}
+
+// Embed embeds the input through the middleware chain.
+func (w *WrappedEmbedder) Embed(ctx context.Context, input string) ([]float32, error) {
+	embeddings, err := w.embed(ctx, []string{input})
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddings) != 1 {
+		return nil, fmt.Errorf("expected 1 embedding, got %d", len(embeddings))
+	}
+	return embeddings[0], nil
+}
+
+// EmbedBatch embeds the inputs through the middleware chain.
+func (w *WrappedEmbedder) EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	return w.embedBatch(ctx, inputs)
+}
+
+// CallInfo describes a completed backend call to ObserveMiddleware.
+type CallInfo struct {
+	// Operation is OperationGenerate or OperationEmbed.
+	Operation string
+	// Prompt is the prompt of a generation.
+	Prompt *Prompt
+	// Result is the result of a successful generation.
+	Result *GenerateResult
+	// Inputs is the number of inputs of an embedding call.
+	Inputs int
+	// Duration is how long the call took.
+	Duration time.Duration
+	// Err is the error the call failed with, if any.
+	Err error
+}
+
+// ObserveMiddleware calls observe after every generation and embedding call, for
+// example to record metrics. Streams are not observed.
+func ObserveMiddleware(observe func(ctx context.Context, info CallInfo)) Middleware {
+	return Middleware{
+		Generate: func(next GenerateFunc) GenerateFunc {
+			return func(ctx context.Context, prompt *Prompt) (*GenerateResult, error) {
+				start := time.Now()
+				result, err := next(ctx, prompt)
+				observe(ctx, CallInfo{
+					Operation: OperationGenerate,
+					Prompt:    prompt,
+					Result:    result,
+					Duration:  time.Since(start),
+					Err:       err,
+				})
+				return result, err
+			}
+		},
+		Embed: func(next EmbedFunc) EmbedFunc {
+			return func(ctx context.Context, inputs []string) ([][]float32, error) {
+				start := time.Now()
+				embeddings, err := next(ctx, inputs)
+				observe(ctx, CallInfo{
+					Operation: OperationEmbed,
+					Inputs:    len(inputs),
+					Duration:  time.Since(start),
+					Err:       err,
+				})
+				return embeddings, err
+			}
+		},
+	}
+}
+
+// LoggingMiddleware logs every generation and embedding call with logf, which
+// can be the Printf method of most loggers. Only sizes, token usage and errors
+// are logged, never the content of prompts or responses.
+func LoggingMiddleware(logf func(format string, args ...interface{})) Middleware {
+	return ObserveMiddleware(func(_ context.Context, info CallInfo) {
+		switch {
+		case info.Err != nil && info.Operation == OperationGenerate:
+			logf("generate failed: messages=%d duration=%s error=%v", len(info.Prompt.Messages), info.Duration, info.Err)
+		case info.Err != nil:
+			logf("embed failed: inputs=%d duration=%s error=%v", info.Inputs, info.Duration, info.Err)
+		case info.Operation == OperationGenerate && info.Result == nil:
+			logf("generate: messages=%d duration=%s no result", len(info.Prompt.Messages), info.Duration)
+		case info.Operation == OperationGenerate:
+			logf("generate: model=%s messages=%d finish_reason=%s prompt_tokens=%d completion_tokens=%d duration=%s",
+				info.Result.Model, len(info.Prompt.Messages), info.Result.FinishReason,
+				info.Result.Usage.PromptTokens, info.Result.Usage.CompletionTokens, info.Duration)
+		default:
+			logf("embed: inputs=%d duration=%s", info.Inputs, info.Duration)
+		}
+	})
+}
+
+// DefaultRedactionPatterns match common secrets and personal data: email
+// addresses, API keys in the formats of OpenAI, Anthropic and AWS, and payment
+// card numbers.
+var DefaultRedactionPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{16,}`),
+	regexp.MustCompile(`\bAKIA[0-9A-Z]{16}\b`),
+	regexp.MustCompile(`\b(?:\d[ -]?){12,15}\d\b`),
+}
+
+// RedactionMiddleware replaces the text matching any of patterns with
+// "[REDACTED]" in the messages of prompts and in embedding inputs before they
+// reach the backend. Without patterns, DefaultRedactionPatterns are used. The
+// caller's prompt is not modified.
+func RedactionMiddleware(patterns ...*regexp.Regexp) Middleware {
+	if len(patterns) == 0 {
+		patterns = DefaultRedactionPatterns
+	}
+	redact := func(text string) string {
+		for _, pattern := range patterns {
+			text = pattern.ReplaceAllString(text, redactedText)
+		}
+		return text
+	}
+	redactPrompt := func(prompt *Prompt) *Prompt {
+		redacted := prompt.Clone()
+		for i, message := range redacted.Messages {
+			message.Content = redact(message.Content)
+			message.Parts = append([]ContentPart(nil), message.Parts...)
+			for j := range message.Parts {
+				message.Parts[j].Text = redact(message.Parts[j].Text)
+			}
+			redacted.Messages[i] = message
+		}
+		return redacted
+	}
+
+	return Middleware{
+		Generate: func(next GenerateFunc) GenerateFunc {
+			return func(ctx context.Context, prompt *Prompt) (*GenerateResult, error) {
+				return next(ctx, redactPrompt(prompt))
+			}
+		},
+		Stream: func(next StreamFunc) StreamFunc {
+			return func(ctx context.Context, prompt *Prompt) (<-chan StreamChunk, error) {
+				return next(ctx, redactPrompt(prompt))
+			}
+		},
+		Embed: func(next EmbedFunc) EmbedFunc {
+			return func(ctx context.Context, inputs []string) ([][]float32, error) {
+				redacted := make([]string, len(inputs))
+				for i, input := range inputs {
+					redacted[i] = redact(input)
+				}
+				return next(ctx, redacted)
+			}
+		},
+	}
+}
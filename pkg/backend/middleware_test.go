@@ -0,0 +1,252 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Generator-only and embedder-only backends can be wrapped with middleware.
+var (
+	_ Streamer = WrapGenerator(&AnthropicBackend{}, LoggingMiddleware(func(string, ...interface{}) {}))
+	_ Streamer = WrapGenerator(&TGIBackend{}, RedactionMiddleware())
+	_ Embedder = WrapEmbedder(&TEIBackend{}, RedactionMiddleware())
+)
+
+// stubBackend is a stubGenerator that also embeds, recording the inputs.
+type stubBackend struct {
+	stubGenerator
+	inputs []string
+}
+
+func (b *stubBackend) Embed(ctx context.Context, input string) ([]float32, error) {
+	embeddings, err := b.EmbedBatch(ctx, []string{input})
+	if err != nil {
+		return nil, err
+	}
+	return embeddings[0], nil
+}
+
+func (b *stubBackend) EmbedBatch(_ context.Context, inputs []string) ([][]float32, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	b.inputs = append(b.inputs, inputs...)
+	embeddings := make([][]float32, len(inputs))
+	for i, input := range inputs {
+		embeddings[i] = []float32{float32(len(input))}
+	}
+	return embeddings, nil
+}
+
+// tracing returns middleware that appends its name to calls before and after
+// each generation.
+func tracing(name string, calls *[]string) Middleware {
+	return Middleware{
+		Generate: func(next GenerateFunc) GenerateFunc {
+			return func(ctx context.Context, prompt *Prompt) (*GenerateResult, error) {
+				*calls = append(*calls, name+" before")
+				result, err := next(ctx, prompt)
+				*calls = append(*calls, name+" after")
+				return result, err
+			}
+		},
+	}
+}
+
+func TestWrapOrder(t *testing.T) {
+	t.Parallel()
+	var calls []string
+	inner := &stubBackend{stubGenerator: stubGenerator{response: "Hi there"}}
+	wrapped := Wrap(inner, tracing("outer", &calls), tracing("inner", &calls))
+
+	response, err := wrapped.Generate(context.Background(), NewPrompt().AddMessage("user", "Hello"))
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if response != "Hi there" {
+		t.Errorf("Expected response 'Hi there', got %q", response)
+	}
+	expected := "outer before,inner before,inner after,outer after"
+	if got := strings.Join(calls, ","); got != expected {
+		t.Errorf("Expected calls %s, got %s", expected, got)
+	}
+
+	embedding, err := wrapped.Embed(context.Background(), "abc")
+	if err != nil || len(embedding) != 1 || embedding[0] != 3 {
+		t.Errorf("Expected Embed to pass through, got %v, %v", embedding, err)
+	}
+	if _, err := wrapped.GenerateStream(context.Background(), NewPrompt()); err == nil {
+		t.Errorf("Expected an error when streaming from a backend without streaming support")
+	}
+	if wrapped.Unwrap() != Backend(inner) {
+		t.Errorf("Expected Unwrap to return the inner backend")
+	}
+}
+
+func TestWrapGeneratorAndEmbedder(t *testing.T) {
+	t.Parallel()
+	generator := &stubGenerator{response: "Done"}
+	wrappedGenerator := WrapGenerator(generator, RedactionMiddleware())
+	prompt := NewPrompt().AddMessage("user", "Mail ada@example.com")
+	if _, err := wrappedGenerator.Generate(context.Background(), prompt); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if sent := generator.prompts[0].Messages[0].Content; sent != "Mail [REDACTED]" {
+		t.Errorf("Expected the generator's prompt to be redacted, got %q", sent)
+	}
+	if wrappedGenerator.Unwrap() != Generator(generator) {
+		t.Errorf("Expected Unwrap to return the inner generator")
+	}
+
+	inner := &stubBackend{}
+	embedder := struct{ Embedder }{inner}
+	wrappedEmbedder := WrapEmbedder(embedder, RedactionMiddleware())
+	if _, err := wrappedEmbedder.Embed(context.Background(), "Mail ada@example.com"); err != nil {
+		t.Fatalf("Embed returned error: %v", err)
+	}
+	if inner.inputs[0] != "Mail [REDACTED]" {
+		t.Errorf("Expected the embedder's input to be redacted, got %q", inner.inputs[0])
+	}
+}
+
+func TestWrappedEmbedKeepsEndpoint(t *testing.T) {
+	t.Parallel()
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", contentTypeJSON)
+		body := `{"embedding": [3, 4]}`
+		if r.URL.Path == embedBatchEndpoint {
+			body = `{"embeddings": [[0.6, 0.8], [0.6, 0.8]]}`
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Errorf("Failed to write response: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	ollama := &OllamaBackend{Model: "nomic-embed-text", Client: server.Client(), BaseURL: server.URL}
+	wrapped := Wrap(ollama, RedactionMiddleware())
+	embedding, err := wrapped.Embed(context.Background(), "chunk")
+	if err != nil {
+		t.Fatalf("Embed returned error: %v", err)
+	}
+	if len(embedding) != 2 || embedding[0] != 3 {
+		t.Errorf("Expected the embedding of %s, got %v", embedEndpoint, embedding)
+	}
+	if _, err := wrapped.EmbedBatch(context.Background(), []string{"a", "b"}); err != nil {
+		t.Fatalf("EmbedBatch returned error: %v", err)
+	}
+	if len(paths) != 2 || paths[0] != embedEndpoint || paths[1] != embedBatchEndpoint {
+		t.Errorf("Expected %s then %s, got %v", embedEndpoint, embedBatchEndpoint, paths)
+	}
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	t.Parallel()
+	var lines []string
+	logf := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	inner := &stubBackend{stubGenerator: stubGenerator{response: "secret answer"}}
+	wrapped := Wrap(inner, LoggingMiddleware(logf))
+
+	if _, err := wrapped.Generate(context.Background(), NewPrompt().AddMessage("user", "secret question")); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if _, err := wrapped.EmbedBatch(context.Background(), []string{"a", "b"}); err != nil {
+		t.Fatalf("EmbedBatch returned error: %v", err)
+	}
+	failure := errors.New("boom")
+	inner.err = failure
+	if _, err := wrapped.Generate(context.Background(), NewPrompt().AddMessage("user", "Hi")); !errors.Is(err, failure) {
+		t.Fatalf("Expected %v, got %v", failure, err)
+	}
+
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 log lines, got %q", lines)
+	}
+	if !strings.HasPrefix(lines[0], "generate: ") || !strings.Contains(lines[0], "messages=1") {
+		t.Errorf("Unexpected generate log line: %s", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "embed: inputs=2") {
+		t.Errorf("Unexpected embed log line: %s", lines[1])
+	}
+	if !strings.HasPrefix(lines[2], "generate failed: ") || !strings.Contains(lines[2], "error=boom") {
+		t.Errorf("Unexpected error log line: %s", lines[2])
+	}
+	for _, line := range lines {
+		if strings.Contains(line, "secret") {
+			t.Errorf("Expected content not to be logged, got %s", line)
+		}
+	}
+}
+
+func TestLoggingMiddlewareWithoutResult(t *testing.T) {
+	t.Parallel()
+	var lines []string
+	logf := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	noResult := Middleware{
+		Generate: func(GenerateFunc) GenerateFunc {
+			return func(context.Context, *Prompt) (*GenerateResult, error) {
+				return nil, nil
+			}
+		},
+	}
+	wrapped := Wrap(&stubBackend{}, LoggingMiddleware(logf), noResult)
+
+	if _, err := wrapped.Generate(context.Background(), NewPrompt().AddMessage("user", "Hi")); !errors.Is(err, errNilResult) {
+		t.Errorf("Expected %v, got %v", errNilResult, err)
+	}
+	if len(lines) != 1 || !strings.Contains(lines[0], "no result") {
+		t.Errorf("Expected the missing result to be logged, got %q", lines)
+	}
+}
+
+func TestRedactionMiddleware(t *testing.T) {
+	t.Parallel()
+	inner := &stubBackend{stubGenerator: stubGenerator{response: "Done"}}
+	wrapped := Wrap(inner, RedactionMiddleware())
+
+	prompt := NewPrompt().
+		AddMessage("system", "Be brief.").
+		AddMessageWithParts("user", TextPart("Email jane.doe@example.com with key sk-abcdefghijklmnopqrstuvwx"))
+	if _, err := wrapped.Generate(context.Background(), prompt); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+
+	sent := inner.prompts[0].Messages[1].Parts[0].Text
+	if sent != "Email [REDACTED] with key [REDACTED]" {
+		t.Errorf("Expected secrets to be redacted, got %q", sent)
+	}
+	if !strings.Contains(prompt.Messages[1].Parts[0].Text, "jane.doe@example.com") {
+		t.Errorf("Expected the caller's prompt to be left unchanged")
+	}
+
+	if _, err := wrapped.Embed(context.Background(), "Card 4111 1111 1111 1111 on file"); err != nil {
+		t.Fatalf("Embed returned error: %v", err)
+	}
+	if inner.inputs[0] != "Card [REDACTED] on file" {
+		t.Errorf("Expected the card number to be redacted, got %q", inner.inputs[0])
+	}
+}
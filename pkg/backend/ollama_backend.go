@@ -16,6 +16,7 @@ package backend
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -24,9 +25,20 @@ import (
 )
 
 const (
-	generateEndpoint = "/api/generate"
-	embedEndpoint    = "/api/embeddings"
-	defaultTimeout   = 30 * time.Second
+	chatEndpoint       = "/api/chat"
+	embedEndpoint      = "/api/embeddings"
+	embedBatchEndpoint = "/api/embed"
+	defaultTimeout     = 30 * time.Second
+
+	// ollamaDefaultEmbedBatchSize is the number of inputs sent per /api/embed request
+	// when OllamaBackend.EmbedBatchSize is not set.
+	ollamaDefaultEmbedBatchSize = 512
+)
+
+// Ensure OllamaBackend implements the backend interfaces.
+var (
+	_ Backend  = (*OllamaBackend)(nil)
+	_ Streamer = (*OllamaBackend)(nil)
 )
 
 // OllamaBackend represents a backend for interacting with the Ollama API.
@@ -34,22 +46,38 @@ type OllamaBackend struct {
 	Model   string
 	Client  *http.Client
 	BaseURL string
+	// EmbedBatchSize is the maximum number of inputs sent in a single request by
+	// EmbedBatch. If zero, a default of 512 is used.
+	EmbedBatchSize int
+	// Retry configures retries of transient failures, including models that are
+	// still loading. If nil, requests are not retried.
+	Retry *RetryPolicy
 }
 
-// Response represents the structure of the response received from the Ollama API.
+// Response represents the structure of the response received from the Ollama chat API.
+// When streaming, each chunk has the same shape and carries the next piece of the
+// assistant message.
 type Response struct {
-	Model              string `json:"model"`
-	CreatedAt          string `json:"created_at"`
-	Response           string `json:"response"`
-	Done               bool   `json:"done"`
-	DoneReason         string `json:"done_reason"`
-	Context            []int  `json:"context"`
+	Model     string `json:"model"`
+	CreatedAt string `json:"created_at"`
+	// Response is the generated text returned by /api/generate.
+	//
+	// Deprecated: the backend uses /api/chat, which returns the text in Message.
+	Response   string  `json:"response,omitempty"`
+	Message    Message `json:"message"`
+	Done       bool    `json:"done"`
+	DoneReason string  `json:"done_reason"`
+	// Context encodes the conversation for a follow-up /api/generate request.
+	//
+	// Deprecated: /api/chat does not return it; send the messages of a Session instead.
+	Context            []int  `json:"context,omitempty"`
 	TotalDuration      int64  `json:"total_duration"`
 	LoadDuration       int64  `json:"load_duration"`
 	PromptEvalCount    int    `json:"prompt_eval_count"`
 	PromptEvalDuration int64  `json:"prompt_eval_duration"`
 	EvalCount          int    `json:"eval_count"`
 	EvalDuration       int64  `json:"eval_duration"`
+	Error              string `json:"error,omitempty"`
 }
 
 // OllamaEmbeddingResponse represents the response from the Ollama API for embeddings.
@@ -57,6 +85,71 @@ type OllamaEmbeddingResponse struct {
 	Embedding []float32 `json:"embedding"`
 }
 
+// OllamaBatchEmbeddingResponse represents the response from the Ollama /api/embed
+// endpoint, which embeds several inputs at once.
+type OllamaBatchEmbeddingResponse struct {
+	Model      string      `json:"model"`
+	Embeddings [][]float32 `json:"embeddings"`
+}
+
+// ollamaMessage is the Ollama wire representation of a Message, in which images
+// are a list of base64-encoded files and tool results name the tool they answer.
+type ollamaMessage struct {
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	Images    []string   `json:"images,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	ToolName  string     `json:"tool_name,omitempty"`
+}
+
+// ollamaMessages converts prompt messages into the Ollama wire format. Ollama
+// cannot fetch images, so image URLs are rejected.
+func ollamaMessages(messages []Message) ([]ollamaMessage, error) {
+	result := make([]ollamaMessage, 0, len(messages))
+	var calls []ToolCall
+	answered := 0
+	for _, message := range messages {
+		m := ollamaMessage{
+			Role:      message.Role,
+			Content:   message.Text(),
+			ToolCalls: message.ToolCalls,
+		}
+		switch {
+		case message.Role == "tool":
+			m.ToolName = toolNameOf(calls, answered, message.ToolCallID)
+			answered++
+		case len(message.ToolCalls) > 0:
+			calls, answered = message.ToolCalls, 0
+		}
+		for _, part := range message.Parts {
+			if part.Type != ContentPartImage {
+				continue
+			}
+			if part.URL != "" {
+				return nil, fmt.Errorf("image URLs are not supported by Ollama, pass the image bytes instead: %s", part.URL)
+			}
+			m.Images = append(m.Images, base64.StdEncoding.EncodeToString(part.Data))
+		}
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+// toolNameOf returns the name of the tool that a tool result answers, which is
+// what Ollama matches results by. The call is found by its ID or, as Ollama does
+// not always assign IDs, by the position of the result after the calls.
+func toolNameOf(calls []ToolCall, position int, toolCallID string) string {
+	for _, call := range calls {
+		if toolCallID != "" && call.ID == toolCallID {
+			return call.Function.Name
+		}
+	}
+	if position < len(calls) {
+		return calls[position].Function.Name
+	}
+	return ""
+}
+
 // NewOllamaBackend creates a new OllamaBackend instance.
 func NewOllamaBackend(baseURL, model string, timeout time.Duration) *OllamaBackend {
 	return &OllamaBackend{
@@ -68,7 +161,9 @@ func NewOllamaBackend(baseURL, model string, timeout time.Duration) *OllamaBacke
 	}
 }
 
-// Generate produces a response from the Ollama API based on the given structured prompt.
+// Generate produces a response from the Ollama chat API based on the given structured prompt.
+// The prompt messages are sent as role-based chat messages, so the model's own chat
+// template is applied, and the parameters are mapped onto Ollama's model options.
 //
 // Parameters:
 //   - ctx: The context for the API request, which can be used for cancellation.
@@ -78,68 +173,210 @@ func NewOllamaBackend(baseURL, model string, timeout time.Duration) *OllamaBacke
 //   - A string containing the generated response from the Ollama model.
 //   - An error if the API request fails or if there's an issue processing the response.
 func (o *OllamaBackend) Generate(ctx context.Context, prompt *Prompt) (string, error) {
-	url := o.BaseURL + generateEndpoint
-
-	// Concatenate the messages into a single prompt string
-	var promptText string
-	for _, message := range prompt.Messages {
-		// Append role and content into one string (adjust formatting as needed)
-		promptText += message.Role + ": " + message.Content + "\n"
+	result, err := o.GenerateWithResult(ctx, prompt)
+	if err != nil {
+		return "", err
 	}
+	return result.Content(), nil
+}
 
-	// Construct the request body with concatenated prompt
-	reqBody := map[string]interface{}{
-		"model":             o.Model,
-		"prompt":            promptText, // Use concatenated string
-		"max_tokens":        prompt.Parameters.MaxTokens,
-		"temperature":       prompt.Parameters.Temperature,
-		"top_p":             prompt.Parameters.TopP,
-		"frequency_penalty": prompt.Parameters.FrequencyPenalty,
-		"presence_penalty":  prompt.Parameters.PresencePenalty,
-		"stream":            false, // Explicitly set stream to false
+// GenerateWithResult produces a response from the Ollama chat API and returns it
+// together with the finish reason, token counts and latency of the generation.
+// Ollama does not assign request IDs, so RequestID is left empty.
+//
+// Parameters:
+//   - ctx: The context for the API request, which can be used for cancellation.
+//   - prompt: A structured prompt containing messages, parameters and tools.
+//
+// Returns:
+//   - The generation result, including the assistant message and any tool calls the model requested.
+//   - An error if the API request fails or if there's an issue processing the response.
+func (o *OllamaBackend) GenerateWithResult(ctx context.Context, prompt *Prompt) (*GenerateResult, error) {
+	reqBody, err := o.chatRequestBody(prompt, false)
+	if err != nil {
+		return nil, err
 	}
 
-	reqBodyBytes, err := json.Marshal(reqBody)
+	start := time.Now()
+	resp, err := o.send(ctx, o.Client, chatEndpoint, reqBody)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal request body: %w", err)
+		return nil, fmt.Errorf("failed to generate response from Ollama: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result Response
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &GenerateResult{
+		Message:      result.Message,
+		FinishReason: ollamaFinishReason(result),
+		Usage: Usage{
+			PromptTokens:     result.PromptEvalCount,
+			CompletionTokens: result.EvalCount,
+			TotalTokens:      result.PromptEvalCount + result.EvalCount,
+		},
+		Model:   result.Model,
+		Latency: time.Since(start),
+	}, nil
+}
+
+// ollamaFinishReason maps Ollama's done reason onto a FinishReason.
+func ollamaFinishReason(result Response) FinishReason {
+	if len(result.Message.ToolCalls) > 0 {
+		return FinishReasonToolCalls
+	}
+	switch result.DoneReason {
+	case "":
+		return ""
+	case "length":
+		return FinishReasonLength
+	default:
+		return FinishReasonStop
 	}
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(reqBodyBytes))
+// GenerateStream produces a response from the Ollama chat API and delivers it in chunks
+// as the model generates it. Ollama streams newline-delimited JSON objects, each
+// carrying the next piece of the response.
+//
+// The request is bounded by ctx only; the client timeout is not applied so that
+// long generations are not cut off mid-stream.
+//
+// Parameters:
+//   - ctx: The context for the API request, which can be used for cancellation.
+//   - prompt: A structured prompt containing messages and parameters.
+//
+// Returns:
+//   - A channel receiving the response chunks, closed when the stream ends.
+//   - An error if the request could not be started.
+func (o *OllamaBackend) GenerateStream(ctx context.Context, prompt *Prompt) (<-chan StreamChunk, error) {
+	reqBody, err := o.chatRequestBody(prompt, true)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := o.Client.Do(req)
+	resp, err := o.send(ctx, streamingClient(o.Client), chatEndpoint, reqBody)
 	if err != nil {
-		return "", fmt.Errorf("HTTP request failed: %w", err)
+		return nil, fmt.Errorf("failed to generate response from Ollama: %w", err)
 	}
-	defer resp.Body.Close()
 
-	bodyBytes, err := io.ReadAll(resp.Body)
+	chunks := make(chan StreamChunk)
+	go func() {
+		defer close(chunks)
+		defer resp.Body.Close()
+
+		done := false
+		err := scanLines(resp.Body, func(line []byte) bool {
+			var result Response
+			if err := json.Unmarshal(line, &result); err != nil {
+				sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("failed to decode stream chunk: %w", err)})
+				return false
+			}
+			if result.Error != "" {
+				apiErr := ollamaErrorBody(line)
+				sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("ollama stream error: %w", classifyError(apiErr, 0))})
+				return false
+			}
+			done = result.Done
+			return sendChunk(ctx, chunks, StreamChunk{Content: result.Message.Content, Done: result.Done}) && !done
+		})
+		if err != nil {
+			sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("failed to read stream: %w", err)})
+			return
+		}
+		if !done && ctx.Err() == nil {
+			sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("stream ended before completion: %w", io.ErrUnexpectedEOF)})
+		}
+	}()
+
+	return chunks, nil
+}
+
+// chatRequestBody builds the JSON body of a chat request for the given prompt.
+func (o *OllamaBackend) chatRequestBody(prompt *Prompt, stream bool) ([]byte, error) {
+	messages, err := ollamaMessages(prompt.Messages)
 	if err != nil {
-		return "", fmt.Errorf("failed to read response body: %w", err)
+		return nil, err
+	}
+	reqBody := map[string]interface{}{
+		"model":    o.Model,
+		"messages": messages,
+		"stream":   stream,
+		"options":  ollamaOptions(prompt.Parameters),
+	}
+	if len(prompt.Tools) > 0 {
+		reqBody["tools"] = toolsPayload(prompt.Tools)
+	}
+	if prompt.ResponseFormat != nil {
+		reqBody["format"] = prompt.ResponseFormat.Schema
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf(
-			"failed to generate response from Ollama: "+
-				"status code %d, response: %s",
-			resp.StatusCode, string(bodyBytes),
-		)
+	reqBodyBytes, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
 	}
 
-	var result Response
-	if err := json.NewDecoder(bytes.NewBuffer(bodyBytes)).Decode(&result); err != nil {
-		return "", fmt.Errorf("failed to decode response: %w", err)
+	return reqBodyBytes, nil
+}
+
+// send posts body to the given API endpoint and returns the successful response,
+// retrying transient failures according to the backend's retry policy.
+func (o *OllamaBackend) send(ctx context.Context, client *http.Client, endpoint string, body []byte) (*http.Response, error) {
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.BaseURL+endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
 	}
+	return sendWithRetry(ctx, o.Retry, client, 0, newRequest, newOllamaError)
+}
 
-	return result.Response, nil
+// ollamaOptions maps the generation parameters onto Ollama's model options.
+// Zero values are left out so that the defaults from the model's Modelfile apply,
+// except for the temperature: it is always sent, as a temperature of zero asks
+// for greedy decoding, like it does with OpenAI.
+func ollamaOptions(params Parameters) map[string]interface{} {
+	options := map[string]interface{}{
+		"temperature": params.Temperature,
+	}
+	if params.MaxTokens != 0 {
+		options["num_predict"] = params.MaxTokens
+	}
+	if params.TopP != 0 {
+		options["top_p"] = params.TopP
+	}
+	if params.FrequencyPenalty != 0 {
+		options["frequency_penalty"] = params.FrequencyPenalty
+	}
+	if params.PresencePenalty != 0 {
+		options["presence_penalty"] = params.PresencePenalty
+	}
+	if params.RepeatPenalty != 0 {
+		options["repeat_penalty"] = params.RepeatPenalty
+	}
+	if params.Seed != 0 {
+		options["seed"] = params.Seed
+	}
+	if params.NumCtx != 0 {
+		options["num_ctx"] = params.NumCtx
+	}
+	return options
 }
 
 // Embed generates embeddings for the given input text using the Ollama API.
-func (o *OllamaBackend) Embed(ctx context.Context, input string, headers map[string]string) ([]float32, error) {
-	url := o.BaseURL + embedEndpoint
+//
+// Parameters:
+//   - ctx: The context for the API request, which can be used for cancellation.
+//   - input: The input text to be embedded.
+//
+// Returns:
+//   - A slice of float32 values representing the embedding vector.
+//   - An error if the API request fails or if there's an issue processing the response.
+func (o *OllamaBackend) Embed(ctx context.Context, input string) ([]float32, error) {
 	reqBody := map[string]interface{}{
 		"model":  o.Model,
 		"prompt": input,
@@ -150,38 +387,61 @@ func (o *OllamaBackend) Embed(ctx context.Context, input string, headers map[str
 		return nil, fmt.Errorf("failed to marshal request body: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(reqBodyBytes))
+	resp, err := o.send(ctx, o.Client, embedEndpoint, reqBodyBytes)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to generate embeddings from Ollama: %w", err)
 	}
+	defer resp.Body.Close()
 
-	// Add headers to the request
-	for key, value := range headers {
-		req.Header.Set(key, value)
+	var result OllamaEmbeddingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
-	resp, err := o.Client.Do(req)
+	return result.Embedding, nil
+}
+
+// EmbedBatch generates embeddings for several input texts using the Ollama /api/embed
+// endpoint, which accepts an array of inputs. Large inputs are split into batches of
+// EmbedBatchSize inputs.
+//
+// Parameters:
+//   - ctx: The context for the API requests, which can be used for cancellation.
+//   - inputs: The input texts to be embedded.
+//
+// Returns:
+//   - The embedding vectors, in the same order as the input texts.
+//   - An error if any of the API requests fail or if there's an issue processing the responses.
+func (o *OllamaBackend) EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	batchSize := o.EmbedBatchSize
+	if batchSize <= 0 {
+		batchSize = ollamaDefaultEmbedBatchSize
+	}
+	return embedInBatches(ctx, inputs, batchSize, o.embedBatch)
+}
+
+// embedBatch sends a single /api/embed request for the given inputs.
+func (o *OllamaBackend) embedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	reqBody := map[string]interface{}{
+		"model": o.Model,
+		"input": inputs,
+	}
+
+	reqBodyBytes, err := json.Marshal(reqBody)
 	if err != nil {
-		return nil, fmt.Errorf("HTTP request failed: %w", err)
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read response body: %w", err)
-		}
-		return nil, fmt.Errorf(
-			"failed to generate embeddings from Ollama: "+
-				"status code %d, response: %s",
-			resp.StatusCode, string(bodyBytes),
-		)
+	resp, err := o.send(ctx, o.Client, embedBatchEndpoint, reqBodyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate embeddings from Ollama: %w", err)
 	}
+	defer resp.Body.Close()
 
-	var result OllamaEmbeddingResponse
+	var result OllamaBatchEmbeddingResponse
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
-	return result.Embedding, nil
+	return result.Embeddings, nil
 }
@@ -15,6 +15,7 @@ package backend
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -31,14 +32,17 @@ func TestOllamaGenerate(t *testing.T) {
 	mockResponse := Response{
 		Model:     "test-model",
 		CreatedAt: time.Now().Format(time.RFC3339),
-		Response:  "This is a test response from Ollama.",
-		Done:      true,
+		Message: Message{
+			Role:    "assistant",
+			Content: "This is a test response from Ollama.",
+		},
+		Done: true,
 	}
 
 	// Create a mock server to simulate the Ollama API
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Validate the request
-		if r.Method != http.MethodPost || r.URL.Path != generateEndpoint {
+		if r.Method != http.MethodPost || r.URL.Path != chatEndpoint {
 			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
 		}
 
@@ -48,15 +52,40 @@ func TestOllamaGenerate(t *testing.T) {
 		}
 
 		// Decode the request body
-		var reqBody map[string]interface{}
+		var reqBody struct {
+			Model    string                 `json:"model"`
+			Messages []Message              `json:"messages"`
+			Stream   bool                   `json:"stream"`
+			Options  map[string]interface{} `json:"options"`
+		}
 		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
 			t.Errorf("Failed to decode request body: %v", err)
 		}
 
-		// Check that the "prompt" field is correctly passed
-		promptText, ok := reqBody["prompt"].(string)
-		if !ok || promptText == "" {
-			t.Errorf("Expected a valid prompt, got: %v", reqBody["prompt"])
+		// Check that the messages are passed with their roles
+		if len(reqBody.Messages) != 2 ||
+			reqBody.Messages[0].Role != "system" || reqBody.Messages[1].Role != "user" {
+			t.Errorf("Expected system and user messages, got: %v", reqBody.Messages)
+		}
+		if reqBody.Stream {
+			t.Error("Expected stream to be false")
+		}
+
+		// Check that the parameters are mapped onto Ollama's options
+		expectedOptions := map[string]interface{}{
+			"num_predict":       float64(150),
+			"temperature":       0.7,
+			"top_p":             0.9,
+			"frequency_penalty": 0.5,
+			"presence_penalty":  0.6,
+			"repeat_penalty":    1.1,
+			"seed":              float64(42),
+			"num_ctx":           float64(4096),
+		}
+		for key, expected := range expectedOptions {
+			if reqBody.Options[key] != expected {
+				t.Errorf("Expected option %s = %v, got %v", key, expected, reqBody.Options[key])
+			}
 		}
 
 		// Write the mock response
@@ -87,6 +116,9 @@ func TestOllamaGenerate(t *testing.T) {
 			TopP:             0.9,
 			FrequencyPenalty: 0.5,
 			PresencePenalty:  0.6,
+			RepeatPenalty:    1.1,
+			Seed:             42,
+			NumCtx:           4096,
 		})
 
 	// Call the Generate method
@@ -96,8 +128,163 @@ func TestOllamaGenerate(t *testing.T) {
 	}
 
 	// Validate the response
-	if response != mockResponse.Response {
-		t.Errorf("Expected response '%s', got '%s'", mockResponse.Response, response)
+	if response != mockResponse.Message.Content {
+		t.Errorf("Expected response '%s', got '%s'", mockResponse.Message.Content, response)
+	}
+}
+
+func TestOllamaGenerateWithResult(t *testing.T) {
+	t.Parallel()
+	mockResponse := Response{
+		Model:           "llama3:latest",
+		Message:         Message{Role: "assistant", Content: "Once upon a"},
+		Done:            true,
+		DoneReason:      "length",
+		TotalDuration:   int64(2 * time.Second),
+		PromptEvalCount: 26,
+		EvalCount:       3,
+	}
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(mockResponse); err != nil {
+			t.Errorf("Failed to encode mock response: %v", err)
+		}
+	}))
+	defer mockServer.Close()
+
+	backend := &OllamaBackend{
+		Model:   "llama3",
+		Client:  mockServer.Client(),
+		BaseURL: mockServer.URL,
+	}
+
+	prompt := NewPrompt().
+		AddMessage("user", "Tell me a story").
+		SetParameters(Parameters{MaxTokens: 3})
+
+	result, err := backend.GenerateWithResult(context.Background(), prompt)
+	if err != nil {
+		t.Fatalf("GenerateWithResult returned error: %v", err)
+	}
+
+	if result.Content() != mockResponse.Message.Content {
+		t.Errorf("Expected content '%s', got '%s'", mockResponse.Message.Content, result.Content())
+	}
+	if result.FinishReason != FinishReasonLength {
+		t.Errorf("Expected finish reason %q, got %q", FinishReasonLength, result.FinishReason)
+	}
+	if result.Usage != (Usage{PromptTokens: 26, CompletionTokens: 3, TotalTokens: 29}) {
+		t.Errorf("Unexpected usage: %+v", result.Usage)
+	}
+	if result.Model != "llama3:latest" {
+		t.Errorf("Expected model 'llama3:latest', got '%s'", result.Model)
+	}
+}
+
+func TestOllamaGenerateWithResultToolCalls(t *testing.T) {
+	t.Parallel()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody struct {
+			Messages []Message `json:"messages"`
+			Tools    []struct {
+				Type     string `json:"type"`
+				Function struct {
+					Name string `json:"name"`
+				} `json:"function"`
+			} `json:"tools"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		if len(reqBody.Tools) != 1 || reqBody.Tools[0].Type != "function" ||
+			reqBody.Tools[0].Function.Name != "get_weather" {
+			t.Errorf("Unexpected tools: %+v", reqBody.Tools)
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		_, _ = w.Write([]byte(`{"model":"test-model","message":{"role":"assistant","content":"",` +
+			`"tool_calls":[{"function":{"name":"get_weather","arguments":{"city":"Paris"}}}]},"done":true}`))
+	}))
+	defer mockServer.Close()
+
+	backend := &OllamaBackend{
+		Model:   "test-model",
+		Client:  mockServer.Client(),
+		BaseURL: mockServer.URL,
+	}
+
+	prompt := NewPrompt().
+		AddMessage("user", "What is the weather in Paris?").
+		AddTool(Tool{
+			Name:        "get_weather",
+			Description: "Get the current weather for a city",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"city": map[string]interface{}{"type": "string"},
+				},
+			},
+		})
+
+	result, err := backend.GenerateWithResult(context.Background(), prompt)
+	if err != nil {
+		t.Fatalf("GenerateWithResult returned error: %v", err)
+	}
+	message := result.Message
+
+	if len(message.ToolCalls) != 1 || message.ToolCalls[0].Function.Name != "get_weather" {
+		t.Fatalf("Unexpected tool calls: %+v", message.ToolCalls)
+	}
+	if args := string(message.ToolCalls[0].Function.Arguments); args != `{"city":"Paris"}` {
+		t.Errorf("Expected arguments '{\"city\":\"Paris\"}', got '%s'", args)
+	}
+}
+
+func TestOllamaToolResultsNameTheirTool(t *testing.T) {
+	t.Parallel()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody struct {
+			Messages []map[string]interface{} `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		if len(reqBody.Messages) != 4 {
+			t.Fatalf("Expected 4 messages, got %+v", reqBody.Messages)
+		}
+		for i, name := range map[int]string{2: "get_weather", 3: "get_time"} {
+			message := reqBody.Messages[i]
+			if message["role"] != "tool" || message["tool_name"] != name {
+				t.Errorf("Expected tool result %d to name %s, got %+v", i, name, message)
+			}
+			if _, ok := message["tool_call_id"]; ok {
+				t.Errorf("Expected no tool_call_id in Ollama tool results, got %+v", message)
+			}
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		_, _ = w.Write([]byte(`{"model":"test-model","message":{"role":"assistant","content":"Sunny at noon"},"done":true}`))
+	}))
+	defer mockServer.Close()
+
+	backend := &OllamaBackend{
+		Model:   "test-model",
+		Client:  mockServer.Client(),
+		BaseURL: mockServer.URL,
+	}
+
+	prompt := NewPrompt().
+		AddMessage("user", "What is the weather and time in Paris?").
+		AppendMessage(Message{Role: "assistant", ToolCalls: []ToolCall{
+			{Function: FunctionCall{Name: "get_weather", Arguments: json.RawMessage(`{"city":"Paris"}`)}},
+			{Function: FunctionCall{Name: "get_time", Arguments: json.RawMessage(`{"city":"Paris"}`)}},
+		}}).
+		AddToolResult("", `{"weather":"sunny"}`).
+		AddToolResult("", `{"time":"12:00"}`)
+
+	if _, err := backend.Generate(context.Background(), prompt); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
 	}
 }
 
@@ -152,11 +339,7 @@ func TestOllamaEmbed(t *testing.T) {
 	ctx := context.Background()
 	input := testEmbeddingText
 
-	headers := map[string]string{
-		"Content-Type": contentTypeJSON,
-	}
-
-	embedding, err := backend.Embed(ctx, input, headers)
+	embedding, err := backend.Embed(ctx, input)
 	if err != nil {
 		t.Fatalf("Embed returned error: %v", err)
 	}
@@ -171,3 +354,175 @@ func TestOllamaEmbed(t *testing.T) {
 		}
 	}
 }
+
+func TestOllamaGenerateStream(t *testing.T) {
+	t.Parallel()
+	chunks := []Response{
+		{Model: "test-model", Message: Message{Role: "assistant", Content: "This is "}},
+		{Model: "test-model", Message: Message{Role: "assistant", Content: "a streamed "}},
+		{Model: "test-model", Message: Message{Role: "assistant", Content: "response."}, Done: true, DoneReason: "stop"},
+	}
+
+	// Create a mock server that streams newline-delimited JSON chunks
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		if reqBody["stream"] != true {
+			t.Errorf("Expected stream to be true, got %v", reqBody["stream"])
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for _, chunk := range chunks {
+			if err := json.NewEncoder(w).Encode(chunk); err != nil {
+				t.Errorf("Failed to encode mock chunk: %v", err)
+			}
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer mockServer.Close()
+
+	backend := &OllamaBackend{
+		Model:   "test-model",
+		Client:  mockServer.Client(),
+		BaseURL: mockServer.URL,
+	}
+
+	prompt := NewPrompt().AddMessage("user", "Hello, Ollama!")
+
+	stream, err := backend.GenerateStream(context.Background(), prompt)
+	if err != nil {
+		t.Fatalf("GenerateStream returned error: %v", err)
+	}
+
+	var response string
+	var done bool
+	for chunk := range stream {
+		if chunk.Err != nil {
+			t.Fatalf("Stream returned error: %v", chunk.Err)
+		}
+		response += chunk.Content
+		done = chunk.Done
+	}
+
+	if !done {
+		t.Error("Expected the last chunk to be marked as done")
+	}
+	if expected := "This is a streamed response."; response != expected {
+		t.Errorf("Expected response '%s', got '%s'", expected, response)
+	}
+}
+
+func TestOllamaEmbedBatch(t *testing.T) {
+	t.Parallel()
+	requests := 0
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != embedBatchEndpoint {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+
+		var reqBody struct {
+			Model string   `json:"model"`
+			Input []string `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		requests++
+
+		resp := OllamaBatchEmbeddingResponse{Model: reqBody.Model}
+		for _, input := range reqBody.Input {
+			resp.Embeddings = append(resp.Embeddings, []float32{float32(len(input))})
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			t.Errorf("Failed to encode mock response: %v", err)
+		}
+	}))
+	defer mockServer.Close()
+
+	backend := &OllamaBackend{
+		Model:          "test-model",
+		Client:         mockServer.Client(),
+		BaseURL:        mockServer.URL,
+		EmbedBatchSize: 2,
+	}
+
+	inputs := []string{"a", "bb", "ccc"}
+	embeddings, err := backend.EmbedBatch(context.Background(), inputs)
+	if err != nil {
+		t.Fatalf("EmbedBatch returned error: %v", err)
+	}
+
+	if requests != 2 {
+		t.Errorf("Expected 2 requests, got %d", requests)
+	}
+	if len(embeddings) != len(inputs) {
+		t.Fatalf("Expected %d embeddings, got %d", len(inputs), len(embeddings))
+	}
+	for i, input := range inputs {
+		if embeddings[i][0] != float32(len(input)) {
+			t.Errorf("Expected embedding %d to belong to %q, got %v", i, input, embeddings[i])
+		}
+	}
+}
+
+func TestOllamaGenerateWithImages(t *testing.T) {
+	t.Parallel()
+	image := []byte("\x89PNG\r\n\x1a\nfake image")
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody struct {
+			Messages []struct {
+				Role    string   `json:"role"`
+				Content string   `json:"content"`
+				Images  []string `json:"images"`
+			} `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		expectedImage := base64.StdEncoding.EncodeToString(image)
+		if len(reqBody.Messages) != 1 || reqBody.Messages[0].Content != "What does this diagram show?" ||
+			len(reqBody.Messages[0].Images) != 1 || reqBody.Messages[0].Images[0] != expectedImage {
+			t.Errorf("Unexpected messages: %+v", reqBody.Messages)
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		_, _ = w.Write([]byte(`{"model":"llava","message":{"role":"assistant","content":"A pipeline."},"done":true}`))
+	}))
+	defer mockServer.Close()
+
+	backend := &OllamaBackend{
+		Model:   "llava",
+		Client:  mockServer.Client(),
+		BaseURL: mockServer.URL,
+	}
+
+	prompt := NewPrompt().AddMessageWithParts("user", TextPart("What does this diagram show?"), ImagePart(image, ""))
+	response, err := backend.Generate(context.Background(), prompt)
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if response != "A pipeline." {
+		t.Errorf("Expected response 'A pipeline.', got '%s'", response)
+	}
+
+	prompt = NewPrompt().AddMessageWithParts("user", ImageURLPart("https://example.com/diagram.png"))
+	if _, err := backend.Generate(context.Background(), prompt); err == nil {
+		t.Errorf("Expected an error for an image URL")
+	}
+}
+
+func TestOllamaOptionsSendZeroTemperature(t *testing.T) {
+	t.Parallel()
+	options := ollamaOptions(Parameters{})
+	if temperature, ok := options["temperature"]; !ok || temperature != 0.0 {
+		t.Errorf("Expected a temperature of 0 to be sent for greedy decoding, got %v", options)
+	}
+	if len(options) != 1 {
+		t.Errorf("Expected other unset parameters to be left out, got %v", options)
+	}
+}
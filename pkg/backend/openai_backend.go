@@ -20,18 +20,54 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 )
 
+// Ensure OpenAIBackend implements the backend interfaces.
+var (
+	_ Backend  = (*OpenAIBackend)(nil)
+	_ Streamer = (*OpenAIBackend)(nil)
+)
+
 // OpenAIBackend represents a backend for interacting with the OpenAI API.
 // It contains configuration details and methods for making API requests.
+//
+// Besides the OpenAI API itself, it can talk to any server implementing the same
+// protocol, such as vLLM, LM Studio, llama.cpp or LiteLLM. See
+// NewOpenAICompatibleBackend.
 type OpenAIBackend struct {
+	// APIKey is sent as a bearer token. If empty, no Authorization header is sent.
 	APIKey     string
 	Model      string
 	HTTPClient *http.Client
 	BaseURL    string
+	// PathPrefix is prepended to the API paths, such as /chat/completions. If
+	// empty, /v1 is used; set it to "/" for servers that serve the API at BaseURL.
+	PathPrefix string
+	// Headers are added to every request, for example to authenticate with a proxy.
+	Headers map[string]string
+	// Organization and Project, when set, are sent as the OpenAI-Organization and
+	// OpenAI-Project headers.
+	Organization string
+	Project      string
+	// DisabledParameters lists request body fields, such as "frequency_penalty",
+	// that are never sent. Use it for servers that reject parameters they do not
+	// support.
+	DisabledParameters []string
+	// EmbedBatchSize is the maximum number of inputs sent in a single embeddings
+	// request by EmbedBatch. If zero, the OpenAI limit of 2048 inputs is used.
+	EmbedBatchSize int
+	// Retry configures retries of transient failures. If nil, requests are not retried.
+	Retry *RetryPolicy
+	// Azure, when set, sends requests to an Azure OpenAI deployment instead of the
+	// OpenAI API. See NewAzureOpenAIBackend.
+	Azure *AzureConfig
 }
 
+// openAIMaxEmbedBatchSize is the maximum number of inputs OpenAI accepts in one embeddings request.
+const openAIMaxEmbedBatchSize = 2048
+
 // OpenAIEmbeddingResponse represents the structure of the response received from the OpenAI API
 // for an embedding request. It contains the generated embeddings, usage statistics, and other
 // metadata related to the API call.
@@ -74,6 +110,23 @@ func NewOpenAIBackend(apiKey, model string, timeout time.Duration) *OpenAIBacken
 	}
 }
 
+// NewOpenAICompatibleBackend creates and returns a new OpenAIBackend for a server
+// that implements the OpenAI API, such as vLLM, LM Studio, llama.cpp or LiteLLM.
+//
+// Parameters:
+//   - baseURL: The URL of the server, without the /v1 path prefix.
+//   - apiKey: The API key to send as a bearer token, or empty if the server needs none.
+//   - model: The name of the model to use for generating responses or embeddings.
+//   - timeout: The duration for the HTTP client timeout. If zero, the default timeout is used.
+//
+// Returns:
+//   - A pointer to a new OpenAIBackend instance configured for the server.
+func NewOpenAICompatibleBackend(baseURL, apiKey, model string, timeout time.Duration) *OpenAIBackend {
+	backend := NewOpenAIBackend(apiKey, model, timeout)
+	backend.BaseURL = strings.TrimSuffix(baseURL, "/")
+	return backend
+}
+
 // OpenAIResponse represents the structure of the response received from the OpenAI API
 // for a chat completion request. It contains information about the generated text,
 // usage statistics, and other metadata related to the API call.
@@ -85,86 +138,395 @@ type OpenAIResponse struct {
 	Choices []struct {
 		Index   int `json:"index"`
 		Message struct {
-			Role    string `json:"role"`
-			Content string `json:"content"`
+			Role      string           `json:"role"`
+			Content   string           `json:"content"`
+			ToolCalls []OpenAIToolCall `json:"tool_calls,omitempty"`
 		} `json:"message"`
 		FinishReason string `json:"finish_reason"`
+		// ContentFilterResults is only returned by Azure OpenAI.
+		ContentFilterResults ContentFilterResults `json:"content_filter_results,omitempty"`
 	} `json:"choices"`
 	Usage struct {
 		PromptTokens     int `json:"prompt_tokens"`
 		CompletionTokens int `json:"completion_tokens"`
 		TotalTokens      int `json:"total_tokens"`
 	} `json:"usage"`
+	// PromptFilterResults is only returned by Azure OpenAI.
+	PromptFilterResults []struct {
+		PromptIndex          int                  `json:"prompt_index"`
+		ContentFilterResults ContentFilterResults `json:"content_filter_results"`
+	} `json:"prompt_filter_results,omitempty"`
 }
 
-// Generate sends a prompt to the OpenAI API and returns the generated response.
+// OpenAIToolCall represents a tool call in the OpenAI wire format, where the
+// function arguments are encoded as a JSON string.
+type OpenAIToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// openAIMessage is the OpenAI wire representation of a Message.
+type openAIMessage struct {
+	Role string `json:"role"`
+	// Content is a string, or a list of content parts for multimodal messages.
+	Content    interface{}      `json:"content"`
+	ToolCalls  []OpenAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+// openAIMessages converts prompt messages into the OpenAI wire format.
+func openAIMessages(messages []Message) []openAIMessage {
+	result := make([]openAIMessage, 0, len(messages))
+	for _, message := range messages {
+		m := openAIMessage{
+			Role:       message.Role,
+			Content:    openAIContent(message),
+			ToolCallID: message.ToolCallID,
+		}
+		for _, call := range message.ToolCalls {
+			var tc OpenAIToolCall
+			tc.ID = call.ID
+			tc.Type = "function"
+			tc.Function.Name = call.Function.Name
+			tc.Function.Arguments = string(call.Function.Arguments)
+			m.ToolCalls = append(m.ToolCalls, tc)
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
+// openAIContent returns the content of a message in the OpenAI wire format: a
+// string for text messages, and a list of text and image_url parts otherwise.
+// Image bytes are sent as data URLs.
+func openAIContent(message Message) interface{} {
+	if len(message.Parts) == 0 {
+		return message.Content
+	}
+
+	parts := make([]map[string]interface{}, 0, len(message.Parts)+1)
+	if message.Content != "" {
+		parts = append(parts, map[string]interface{}{"type": "text", "text": message.Content})
+	}
+	for _, part := range message.Parts {
+		switch part.Type {
+		case ContentPartText:
+			parts = append(parts, map[string]interface{}{"type": "text", "text": part.Text})
+		case ContentPartImage:
+			url := part.URL
+			if url == "" {
+				url = part.dataURL()
+			}
+			parts = append(parts, map[string]interface{}{
+				"type":      "image_url",
+				"image_url": map[string]interface{}{"url": url},
+			})
+		}
+	}
+	return parts
+}
+
+// toolCallsFromOpenAI converts tool calls from the OpenAI wire format, in which
+// arguments are a string the model wrote. Arguments that are not valid JSON are
+// reported as an InvalidToolArgumentsError.
+func toolCallsFromOpenAI(calls []OpenAIToolCall) ([]ToolCall, error) {
+	var result []ToolCall
+	for _, call := range calls {
+		arguments := json.RawMessage(call.Function.Arguments)
+		if len(arguments) == 0 {
+			arguments = json.RawMessage("{}")
+		}
+		if !json.Valid(arguments) {
+			return nil, &InvalidToolArgumentsError{
+				ToolCallID: call.ID,
+				Name:       call.Function.Name,
+				Arguments:  call.Function.Arguments,
+			}
+		}
+		result = append(result, ToolCall{
+			ID:   call.ID,
+			Type: call.Type,
+			Function: FunctionCall{
+				Name:      call.Function.Name,
+				Arguments: arguments,
+			},
+		})
+	}
+	return result, nil
+}
+
+// Generate sends a structured prompt to the OpenAI API and returns the generated response.
 //
 // Parameters:
 //   - ctx: The context for the API request, which can be used for cancellation.
-//   - prompt: The input text prompt for which to generate a response.
+//   - prompt: A structured prompt containing messages and parameters.
 //
 // Returns:
 //   - A string containing the generated response from the OpenAI model.
 //   - An error if the API request fails or if there's an issue processing the response.
+func (o *OpenAIBackend) Generate(ctx context.Context, prompt *Prompt) (string, error) {
+	result, err := o.GenerateWithResult(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	return result.Content(), nil
+}
 
-// Generate sends a structured prompt to the OpenAI API and returns the generated response.
+// GenerateWithResult sends a structured prompt to the OpenAI API and returns the
+// response together with the finish reason, token usage, latency and the request
+// ID from the x-request-id response header. Azure OpenAI deployments additionally
+// report their content filter results.
 //
 // Parameters:
 //   - ctx: The context for the API request, which can be used for cancellation.
-//   - prompt: A structured prompt containing messages and parameters.
+//   - prompt: A structured prompt containing messages, parameters and tools.
 //
 // Returns:
-//   - A string containing the generated response from the OpenAI model.
+//   - The generation result, including the assistant message and any tool calls the model requested.
 //   - An error if the API request fails or if there's an issue processing the response.
-func (o *OpenAIBackend) Generate(ctx context.Context, prompt *Prompt) (string, error) {
-	timeoutCtx, cancel := context.WithTimeout(ctx, defaultTimeout)
-	defer cancel()
+func (o *OpenAIBackend) GenerateWithResult(ctx context.Context, prompt *Prompt) (*GenerateResult, error) {
+	reqBody, err := o.chatRequestBody(prompt, false)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := o.send(ctx, o.HTTPClient, defaultTimeout, "/chat/completions", reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate response from OpenAI: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result OpenAIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if len(result.Choices) == 0 {
+		return nil, fmt.Errorf("no choices in response from OpenAI")
+	}
 
-	url := o.BaseURL + "/v1/chat/completions"
+	choice := result.Choices[0]
+	toolCalls, err := toolCallsFromOpenAI(choice.Message.ToolCalls)
+	if err != nil {
+		return nil, err
+	}
+	var promptFilterResults ContentFilterResults
+	if len(result.PromptFilterResults) > 0 {
+		promptFilterResults = result.PromptFilterResults[0].ContentFilterResults
+	}
+	return &GenerateResult{
+		Message: Message{
+			Role:      choice.Message.Role,
+			Content:   choice.Message.Content,
+			ToolCalls: toolCalls,
+		},
+		FinishReason: openAIFinishReason(choice.FinishReason),
+		Usage: Usage{
+			PromptTokens:     result.Usage.PromptTokens,
+			CompletionTokens: result.Usage.CompletionTokens,
+			TotalTokens:      result.Usage.TotalTokens,
+		},
+		Model:                   result.Model,
+		Latency:                 time.Since(start),
+		RequestID:               openAIRequestID(resp.Header),
+		PromptFilterResults:     promptFilterResults,
+		CompletionFilterResults: choice.ContentFilterResults,
+	}, nil
+}
+
+// openAIRequestID returns the request ID from the response headers. Azure OpenAI
+// identifies requests with apim-request-id when x-request-id is absent.
+func openAIRequestID(header http.Header) string {
+	if id := header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	return header.Get("Apim-Request-Id")
+}
+
+// openAIFinishReason maps OpenAI's finish reason onto a FinishReason.
+func openAIFinishReason(reason string) FinishReason {
+	if reason == "function_call" {
+		return FinishReasonToolCalls
+	}
+	return FinishReason(reason)
+}
+
+// openAIStreamChunk represents a single server-sent event of a streamed chat completion.
+type openAIStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Error *struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+	} `json:"error,omitempty"`
+}
+
+// GenerateStream sends a structured prompt to the OpenAI API and delivers the
+// response in chunks as it is generated. OpenAI streams server-sent events whose
+// "data:" payloads carry content deltas, terminated by "data: [DONE]".
+//
+// Unlike Generate, the request is bounded by ctx only, so long generations are
+// not cut off by the default timeout.
+//
+// Parameters:
+//   - ctx: The context for the API request, which can be used for cancellation.
+//   - prompt: A structured prompt containing messages and parameters.
+//
+// Returns:
+//   - A channel receiving the response chunks, closed when the stream ends.
+//   - An error if the request could not be started.
+func (o *OpenAIBackend) GenerateStream(ctx context.Context, prompt *Prompt) (<-chan StreamChunk, error) {
+	reqBody, err := o.chatRequestBody(prompt, true)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := o.send(ctx, streamingClient(o.HTTPClient), 0, "/chat/completions", reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate response from OpenAI: %w", err)
+	}
+
+	chunks := make(chan StreamChunk)
+	go func() {
+		defer close(chunks)
+		defer resp.Body.Close()
+
+		done := false
+		err := scanSSE(resp.Body, func(data []byte) bool {
+			if string(data) == "[DONE]" {
+				done = true
+				sendChunk(ctx, chunks, StreamChunk{Done: true})
+				return false
+			}
+
+			var chunk openAIStreamChunk
+			if err := json.Unmarshal(data, &chunk); err != nil {
+				sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("failed to decode stream chunk: %w", err)})
+				return false
+			}
+			if chunk.Error != nil {
+				apiErr := openAIErrorBody(data)
+				sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("openai stream error: %w", classifyError(apiErr, 0))})
+				return false
+			}
+			if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+				return true
+			}
+			return sendChunk(ctx, chunks, StreamChunk{Content: chunk.Choices[0].Delta.Content})
+		})
+		if err != nil {
+			sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("failed to read stream: %w", err)})
+			return
+		}
+		if !done && ctx.Err() == nil {
+			sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("stream ended before completion: %w", io.ErrUnexpectedEOF)})
+		}
+	}()
+
+	return chunks, nil
+}
+
+// chatRequestBody builds the JSON body of a chat completion request for the given prompt.
+func (o *OpenAIBackend) chatRequestBody(prompt *Prompt, stream bool) ([]byte, error) {
 	reqBody := map[string]interface{}{
 		"model":             o.Model,
-		"messages":          prompt.Messages,
+		"messages":          openAIMessages(prompt.Messages),
 		"max_tokens":        prompt.Parameters.MaxTokens,
 		"temperature":       prompt.Parameters.Temperature,
 		"top_p":             prompt.Parameters.TopP,
 		"frequency_penalty": prompt.Parameters.FrequencyPenalty,
 		"presence_penalty":  prompt.Parameters.PresencePenalty,
 	}
+	if len(prompt.Tools) > 0 {
+		reqBody["tools"] = toolsPayload(prompt.Tools)
+	}
+	if format := prompt.ResponseFormat; format != nil {
+		reqBody["response_format"] = map[string]interface{}{
+			"type": "json_schema",
+			"json_schema": map[string]interface{}{
+				"name":   format.Name,
+				"schema": format.Schema,
+				"strict": format.Strict,
+			},
+		}
+	}
+	if stream {
+		reqBody["stream"] = true
+	}
+	for _, name := range o.DisabledParameters {
+		delete(reqBody, name)
+	}
 
 	reqBodyBytes, err := json.Marshal(reqBody)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal request body: %w", err)
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(timeoutCtx, "POST", url, bytes.NewBuffer(reqBodyBytes))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+	return reqBodyBytes, nil
+}
+
+// endpointURL returns the URL of the given API operation, such as "/chat/completions".
+func (o *OpenAIBackend) endpointURL(operation string) string {
+	if o.Azure != nil {
+		return o.Azure.endpointURL(o.BaseURL, operation)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+o.APIKey)
+	prefix := o.PathPrefix
+	if prefix == "" {
+		prefix = "/v1"
+	}
+	return o.BaseURL + strings.TrimSuffix(prefix, "/") + operation
+}
 
-	resp, err := o.HTTPClient.Do(req)
+// newRequest builds an authenticated JSON POST request for the given API operation.
+func (o *OpenAIBackend) newRequest(ctx context.Context, operation string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", o.endpointURL(operation), bytes.NewReader(body))
 	if err != nil {
-		return "", fmt.Errorf("HTTP request failed: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return "", fmt.Errorf("failed to read response body: %w", err)
-		}
-		return "", fmt.Errorf("failed to generate response from OpenAI: "+
-			"status code %d, response: %s", resp.StatusCode, string(bodyBytes))
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range o.Headers {
+		req.Header.Set(name, value)
+	}
+	if o.Organization != "" {
+		req.Header.Set("OpenAI-Organization", o.Organization)
+	}
+	if o.Project != "" {
+		req.Header.Set("OpenAI-Project", o.Project)
 	}
 
-	var result OpenAIResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("failed to decode response: %w", err)
+	switch {
+	case o.Azure != nil:
+		if err := o.Azure.authorize(ctx, req, o.APIKey); err != nil {
+			return nil, err
+		}
+	case o.APIKey != "":
+		req.Header.Set("Authorization", "Bearer "+o.APIKey)
 	}
 
-	return result.Choices[0].Message.Content, nil
+	return req, nil
+}
+
+// send posts body to the given API operation and returns the successful response,
+// retrying transient failures according to the backend's retry policy. If
+// attemptTimeout is non-zero it bounds each attempt.
+func (o *OpenAIBackend) send(
+	ctx context.Context, client *http.Client, attemptTimeout time.Duration, operation string, body []byte,
+) (*http.Response, error) {
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		return o.newRequest(ctx, operation, body)
+	}
+	return sendWithRetry(ctx, o.Retry, client, attemptTimeout, newRequest, newOpenAIError)
 }
 
 // Embed generates an embedding vector for the given text using the OpenAI API.
@@ -177,12 +539,40 @@ func (o *OpenAIBackend) Generate(ctx context.Context, prompt *Prompt) (string, e
 //   - A slice of float32 values representing the embedding vector.
 //   - An error if the API request fails or if there's an issue processing the response.
 func (o *OpenAIBackend) Embed(ctx context.Context, text string) ([]float32, error) {
-	timeoutCtx, cancel := context.WithTimeout(ctx, defaultTimeout)
-	defer cancel()
-	url := o.BaseURL + "/v1/embeddings"
+	embeddings, err := o.requestEmbeddings(ctx, text, 1)
+	if err != nil {
+		return nil, err
+	}
+	return embeddings[0], nil
+}
+
+// EmbedBatch generates embedding vectors for several texts using the OpenAI API.
+// The inputs are sent in as few requests as the batch size allows, using the array
+// form of the embeddings input.
+//
+// Parameters:
+//   - ctx: The context for the API requests, which can be used for cancellation.
+//   - texts: The input texts to be embedded.
+//
+// Returns:
+//   - The embedding vectors, in the same order as the input texts.
+//   - An error if any of the API requests fail or if there's an issue processing the responses.
+func (o *OpenAIBackend) EmbedBatch(ctx context.Context, texts []string) ([][]float32, error) {
+	batchSize := o.EmbedBatchSize
+	if batchSize <= 0 || batchSize > openAIMaxEmbedBatchSize {
+		batchSize = openAIMaxEmbedBatchSize
+	}
+	return embedInBatches(ctx, texts, batchSize, func(ctx context.Context, batch []string) ([][]float32, error) {
+		return o.requestEmbeddings(ctx, batch, len(batch))
+	})
+}
+
+// requestEmbeddings sends a single embeddings request for input, which is either a
+// string or a slice of strings, and returns the embeddings ordered by input index.
+func (o *OpenAIBackend) requestEmbeddings(ctx context.Context, input interface{}, count int) ([][]float32, error) {
 	reqBody := map[string]interface{}{
 		"model": o.Model,
-		"input": text,
+		"input": input,
 	}
 
 	reqBodyBytes, err := json.Marshal(reqBody)
@@ -190,33 +580,29 @@ func (o *OpenAIBackend) Embed(ctx context.Context, text string) ([]float32, erro
 		return nil, fmt.Errorf("failed to marshal request body: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(timeoutCtx, "POST", url, bytes.NewBuffer(reqBodyBytes))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+o.APIKey)
-
-	resp, err := o.HTTPClient.Do(req)
+	resp, err := o.send(ctx, o.HTTPClient, defaultTimeout, "/embeddings", reqBodyBytes)
 	if err != nil {
-		return nil, fmt.Errorf("HTTP request failed: %w", err)
+		return nil, fmt.Errorf("failed to generate embedding from OpenAI: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read response body: %w", err)
-		}
-		return nil, fmt.Errorf("failed to generate embedding from OpenAI: "+
-			"status code %d, response: %s", resp.StatusCode, string(bodyBytes))
-	}
-
 	var result OpenAIEmbeddingResponse
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
-	return result.Data[0].Embedding, nil
+	if len(result.Data) != count {
+		return nil, fmt.Errorf("expected %d embeddings from OpenAI, got %d", count, len(result.Data))
+	}
+
+	// The embeddings are not guaranteed to be returned in input order
+	embeddings := make([][]float32, count)
+	for _, data := range result.Data {
+		if data.Index < 0 || data.Index >= count || embeddings[data.Index] != nil {
+			return nil, fmt.Errorf("unexpected embedding index %d in response from OpenAI", data.Index)
+		}
+		embeddings[data.Index] = data.Embedding
+	}
+
+	return embeddings, nil
 }
@@ -15,9 +15,13 @@ package backend
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 )
@@ -33,16 +37,19 @@ func TestGenerate(t *testing.T) {
 		Choices: []struct {
 			Index   int `json:"index"`
 			Message struct {
-				Role    string `json:"role"`
-				Content string `json:"content"`
+				Role      string           `json:"role"`
+				Content   string           `json:"content"`
+				ToolCalls []OpenAIToolCall `json:"tool_calls,omitempty"`
 			} `json:"message"`
-			FinishReason string `json:"finish_reason"`
+			FinishReason         string               `json:"finish_reason"`
+			ContentFilterResults ContentFilterResults `json:"content_filter_results,omitempty"`
 		}{
 			{
 				Index: 0,
 				Message: struct {
-					Role    string `json:"role"`
-					Content string `json:"content"`
+					Role      string           `json:"role"`
+					Content   string           `json:"content"`
+					ToolCalls []OpenAIToolCall `json:"tool_calls,omitempty"`
 				}{
 					Role:    "assistant",
 					Content: "This is a test response.",
@@ -120,6 +127,181 @@ func TestGenerate(t *testing.T) {
 	}
 }
 
+func TestGenerateWithResult(t *testing.T) {
+	t.Parallel()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Request-Id", "req_123")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","model":"gpt-4o-2024-08-06",` +
+			`"choices":[{"index":0,"message":{"role":"assistant","content":"The answer is"},` +
+			`"finish_reason":"length"}],` +
+			`"usage":{"prompt_tokens":12,"completion_tokens":3,"total_tokens":15}}`))
+	}))
+	defer mockServer.Close()
+
+	backend := &OpenAIBackend{
+		APIKey:     "test-api-key",
+		Model:      "gpt-4o",
+		HTTPClient: mockServer.Client(),
+		BaseURL:    mockServer.URL,
+	}
+
+	prompt := NewPrompt().
+		AddMessage("user", "What is the answer?").
+		SetParameters(Parameters{MaxTokens: 3})
+
+	result, err := backend.GenerateWithResult(context.Background(), prompt)
+	if err != nil {
+		t.Fatalf("GenerateWithResult returned error: %v", err)
+	}
+
+	if result.Content() != "The answer is" {
+		t.Errorf("Expected content 'The answer is', got '%s'", result.Content())
+	}
+	if result.FinishReason != FinishReasonLength {
+		t.Errorf("Expected finish reason %q, got %q", FinishReasonLength, result.FinishReason)
+	}
+	if result.Usage != (Usage{PromptTokens: 12, CompletionTokens: 3, TotalTokens: 15}) {
+		t.Errorf("Unexpected usage: %+v", result.Usage)
+	}
+	if result.Model != "gpt-4o-2024-08-06" {
+		t.Errorf("Expected model 'gpt-4o-2024-08-06', got '%s'", result.Model)
+	}
+	if result.RequestID != "req_123" {
+		t.Errorf("Expected request ID 'req_123', got '%s'", result.RequestID)
+	}
+	if result.Latency <= 0 {
+		t.Errorf("Expected a positive latency, got %v", result.Latency)
+	}
+}
+
+func TestGenerateWithResultToolCalls(t *testing.T) {
+	t.Parallel()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody struct {
+			Messages []map[string]interface{} `json:"messages"`
+			Tools    []struct {
+				Type     string `json:"type"`
+				Function struct {
+					Name       string                 `json:"name"`
+					Parameters map[string]interface{} `json:"parameters"`
+				} `json:"function"`
+			} `json:"tools"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+
+		// Check the tool declaration
+		if len(reqBody.Tools) != 1 || reqBody.Tools[0].Type != "function" ||
+			reqBody.Tools[0].Function.Name != "get_weather" || reqBody.Tools[0].Function.Parameters == nil {
+			t.Errorf("Unexpected tools: %+v", reqBody.Tools)
+		}
+
+		// Check that the earlier tool call and its result are sent in the OpenAI format
+		if len(reqBody.Messages) != 3 {
+			t.Fatalf("Expected 3 messages, got %d", len(reqBody.Messages))
+		}
+		calls := reqBody.Messages[1]["tool_calls"].([]interface{})
+		function := calls[0].(map[string]interface{})["function"].(map[string]interface{})
+		if function["arguments"] != `{"city":"Paris"}` {
+			t.Errorf("Expected arguments to be sent as a JSON string, got %v", function["arguments"])
+		}
+		if reqBody.Messages[2]["role"] != "tool" || reqBody.Messages[2]["tool_call_id"] != "call_1" {
+			t.Errorf("Unexpected tool result message: %v", reqBody.Messages[2])
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"",`+
+			`"tool_calls":[{"id":"call_2","type":"function",`+
+			`"function":{"name":"get_weather","arguments":"{\"city\":\"London\"}"}}]},`+
+			`"finish_reason":"tool_calls"}]}`)
+	}))
+	defer mockServer.Close()
+
+	backend := &OpenAIBackend{
+		APIKey:     "test-api-key",
+		Model:      "gpt-4o",
+		HTTPClient: mockServer.Client(),
+		BaseURL:    mockServer.URL,
+	}
+
+	prompt := NewPrompt().
+		AddMessage("user", "What is the weather in Paris and London?").
+		AppendMessage(Message{
+			Role: "assistant",
+			ToolCalls: []ToolCall{{
+				ID:       "call_1",
+				Type:     "function",
+				Function: FunctionCall{Name: "get_weather", Arguments: json.RawMessage(`{"city":"Paris"}`)},
+			}},
+		}).
+		AddToolResult("call_1", "Sunny, 22C").
+		AddTool(Tool{
+			Name:        "get_weather",
+			Description: "Get the current weather for a city",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"city": map[string]interface{}{"type": "string"},
+				},
+				"required": []string{"city"},
+			},
+		})
+
+	result, err := backend.GenerateWithResult(context.Background(), prompt)
+	if err != nil {
+		t.Fatalf("GenerateWithResult returned error: %v", err)
+	}
+	message := result.Message
+
+	if len(message.ToolCalls) != 1 {
+		t.Fatalf("Expected 1 tool call, got %d", len(message.ToolCalls))
+	}
+	call := message.ToolCalls[0]
+	if call.ID != "call_2" || call.Function.Name != "get_weather" {
+		t.Errorf("Unexpected tool call: %+v", call)
+	}
+
+	var args struct {
+		City string `json:"city"`
+	}
+	if err := json.Unmarshal(call.Function.Arguments, &args); err != nil {
+		t.Fatalf("Failed to decode tool call arguments: %v", err)
+	}
+	if args.City != "London" {
+		t.Errorf("Expected city 'London', got '%s'", args.City)
+	}
+}
+
+func TestGenerateRejectsInvalidToolArguments(t *testing.T) {
+	t.Parallel()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"",`+
+			`"tool_calls":[{"id":"call_1","type":"function",`+
+			`"function":{"name":"get_weather","arguments":"{\"city\": \"Par"}}]},`+
+			`"finish_reason":"tool_calls"}]}`)
+	}))
+	defer mockServer.Close()
+
+	backend := &OpenAIBackend{
+		APIKey:     "test-api-key",
+		Model:      "gpt-4o",
+		HTTPClient: mockServer.Client(),
+		BaseURL:    mockServer.URL,
+	}
+
+	_, err := backend.GenerateWithResult(context.Background(), NewPrompt().AddMessage("user", "Weather in Paris?"))
+	var invalid *InvalidToolArgumentsError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("Expected an InvalidToolArgumentsError, got %v", err)
+	}
+	if invalid.ToolCallID != "call_1" || invalid.Name != "get_weather" || invalid.Arguments != `{"city": "Par` {
+		t.Errorf("Unexpected error details: %+v", invalid)
+	}
+}
+
 func TestGenerateEmbedding(t *testing.T) {
 	t.Parallel()
 	// Mock response from OpenAI API
@@ -194,3 +376,294 @@ func TestGenerateEmbedding(t *testing.T) {
 		}
 	}
 }
+
+func TestGenerateStream(t *testing.T) {
+	t.Parallel()
+	events := []string{
+		`{"choices":[{"index":0,"delta":{"role":"assistant","content":""}}]}`,
+		`{"choices":[{"index":0,"delta":{"content":"This is "}}]}`,
+		`{"choices":[{"index":0,"delta":{"content":"a test response."}}]}`,
+		`{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+		`[DONE]`,
+	}
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+
+		var reqBody map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		if reqBody["stream"] != true {
+			t.Errorf("Expected stream to be true, got %v", reqBody["stream"])
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			fmt.Fprintf(w, "data: %s\n\n", event)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer mockServer.Close()
+
+	backend := &OpenAIBackend{
+		APIKey:     "test-api-key",
+		Model:      "gpt-3.5-turbo",
+		HTTPClient: mockServer.Client(),
+		BaseURL:    mockServer.URL,
+	}
+
+	prompt := NewPrompt().AddMessage("user", "Hello, openAI!")
+
+	stream, err := backend.GenerateStream(context.Background(), prompt)
+	if err != nil {
+		t.Fatalf("GenerateStream returned error: %v", err)
+	}
+
+	var response string
+	var done bool
+	for chunk := range stream {
+		if chunk.Err != nil {
+			t.Fatalf("Stream returned error: %v", chunk.Err)
+		}
+		response += chunk.Content
+		done = chunk.Done
+	}
+
+	if !done {
+		t.Error("Expected the last chunk to be marked as done")
+	}
+	if expected := "This is a test response."; response != expected {
+		t.Errorf("Expected response '%s', got '%s'", expected, response)
+	}
+}
+
+func TestGenerateStreamCancel(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"partial\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		// Hold the stream open until the test is done
+		<-release
+	}))
+	defer mockServer.Close()
+	defer close(release)
+
+	backend := &OpenAIBackend{
+		APIKey:     "test-api-key",
+		Model:      "gpt-3.5-turbo",
+		HTTPClient: mockServer.Client(),
+		BaseURL:    mockServer.URL,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := backend.GenerateStream(ctx, NewPrompt().AddMessage("user", "Hello"))
+	if err != nil {
+		t.Fatalf("GenerateStream returned error: %v", err)
+	}
+
+	chunk := <-stream
+	if chunk.Content != "partial" {
+		t.Errorf("Expected first chunk 'partial', got '%s'", chunk.Content)
+	}
+
+	cancel()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-stream:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Stream was not closed after context cancellation")
+		}
+	}
+}
+
+func TestGenerateEmbeddingBatch(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var batches [][]string
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody struct {
+			Input []string `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		mu.Lock()
+		batches = append(batches, reqBody.Input)
+		mu.Unlock()
+
+		// Return the embeddings in reverse order, identified by their index
+		var resp OpenAIEmbeddingResponse
+		for i := len(reqBody.Input) - 1; i >= 0; i-- {
+			resp.Data = append(resp.Data, struct {
+				Object    string    `json:"object"`
+				Embedding []float32 `json:"embedding"`
+				Index     int       `json:"index"`
+			}{
+				Object:    "embedding",
+				Embedding: []float32{float32(len(reqBody.Input[i]))},
+				Index:     i,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			t.Errorf("Failed to encode mock response: %v", err)
+		}
+	}))
+	defer mockServer.Close()
+
+	backend := &OpenAIBackend{
+		APIKey:         "test-api-key",
+		HTTPClient:     mockServer.Client(),
+		BaseURL:        mockServer.URL,
+		EmbedBatchSize: 2,
+	}
+
+	texts := []string{"a", "bb", "ccc", "dddd", "eeeee"}
+	embeddings, err := backend.EmbedBatch(context.Background(), texts)
+	if err != nil {
+		t.Fatalf("EmbedBatch returned error: %v", err)
+	}
+
+	if len(batches) != 3 {
+		t.Errorf("Expected 3 requests, got %d", len(batches))
+	}
+	if len(embeddings) != len(texts) {
+		t.Fatalf("Expected %d embeddings, got %d", len(texts), len(embeddings))
+	}
+	for i, text := range texts {
+		if embeddings[i][0] != float32(len(text)) {
+			t.Errorf("Expected embedding %d to belong to %q, got %v", i, text, embeddings[i])
+		}
+	}
+}
+
+func TestOpenAICompatibleBackend(t *testing.T) {
+	t.Parallel()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/chat/completions" {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+		if _, ok := r.Header["Authorization"]; ok {
+			t.Errorf("Expected no Authorization header, got %s", r.Header.Get("Authorization"))
+		}
+		if r.Header.Get("X-Tenant") != "edge" {
+			t.Errorf("Expected X-Tenant edge, got %s", r.Header.Get("X-Tenant"))
+		}
+		if r.Header.Get("OpenAI-Organization") != "org-1" || r.Header.Get("OpenAI-Project") != "proj-1" {
+			t.Errorf("Unexpected organization headers: %v", r.Header)
+		}
+
+		var reqBody map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		for _, name := range []string{"frequency_penalty", "presence_penalty"} {
+			if _, ok := reqBody[name]; ok {
+				t.Errorf("Expected %s not to be sent", name)
+			}
+		}
+		if reqBody["temperature"] != 0.2 {
+			t.Errorf("Expected temperature 0.2, got %v", reqBody["temperature"])
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}]}`)
+	}))
+	defer mockServer.Close()
+
+	backend := NewOpenAICompatibleBackend(mockServer.URL+"/", "", "Qwen/Qwen2.5-7B-Instruct", 10*time.Second)
+	backend.PathPrefix = "/api/"
+	backend.Headers = map[string]string{"X-Tenant": "edge"}
+	backend.Organization = "org-1"
+	backend.Project = "proj-1"
+	backend.DisabledParameters = []string{"frequency_penalty", "presence_penalty"}
+
+	prompt := NewPrompt().AddMessage("user", "Hi").SetParameters(Parameters{Temperature: 0.2})
+
+	response, err := backend.Generate(context.Background(), prompt)
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if response != "Hello" {
+		t.Errorf("Expected response 'Hello', got '%s'", response)
+	}
+}
+
+func TestGenerateWithImages(t *testing.T) {
+	t.Parallel()
+	image := []byte("\x89PNG\r\n\x1a\nfake image")
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody struct {
+			Messages []struct {
+				Role    string          `json:"role"`
+				Content json.RawMessage `json:"content"`
+			} `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		if len(reqBody.Messages) != 2 {
+			t.Fatalf("Expected 2 messages, got %d", len(reqBody.Messages))
+		}
+		if string(reqBody.Messages[0].Content) != `"You describe screenshots."` {
+			t.Errorf("Expected text content to be a string, got %s", reqBody.Messages[0].Content)
+		}
+
+		var parts []struct {
+			Type     string `json:"type"`
+			Text     string `json:"text"`
+			ImageURL struct {
+				URL string `json:"url"`
+			} `json:"image_url"`
+		}
+		if err := json.Unmarshal(reqBody.Messages[1].Content, &parts); err != nil {
+			t.Fatalf("Expected multimodal content to be a list of parts: %v", err)
+		}
+		dataURL := "data:image/png;base64," + base64.StdEncoding.EncodeToString(image)
+		if len(parts) != 3 ||
+			parts[0].Type != "text" || parts[0].Text != "Compare these screenshots." ||
+			parts[1].Type != "image_url" || parts[1].ImageURL.URL != dataURL ||
+			parts[2].Type != "image_url" || parts[2].ImageURL.URL != "https://example.com/after.png" {
+			t.Errorf("Unexpected content parts: %+v", parts)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"The button moved."}}]}`))
+	}))
+	defer mockServer.Close()
+
+	backend := &OpenAIBackend{
+		APIKey:     "test-api-key",
+		Model:      "gpt-4o",
+		HTTPClient: mockServer.Client(),
+		BaseURL:    mockServer.URL,
+	}
+
+	prompt := NewPrompt().
+		AddMessage("system", "You describe screenshots.").
+		AddMessageWithParts("user",
+			TextPart("Compare these screenshots."),
+			ImagePart(image, ""),
+			ImageURLPart("https://example.com/after.png"),
+		)
+	response, err := backend.Generate(context.Background(), prompt)
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if response != "The button moved." {
+		t.Errorf("Expected response 'The button moved.', got '%s'", response)
+	}
+}
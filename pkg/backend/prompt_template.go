@@ -0,0 +1,437 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The names of the templates that render the messages of a prompt.
+const (
+	systemTemplateName    = "system"
+	userTemplateName      = "user"
+	assistantTemplateName = "assistant"
+)
+
+// rootTemplateName is the name of the template holding the text outside of define blocks.
+const rootTemplateName = "prompt"
+
+// errTemplateNotParsed is returned by templates that were not created with
+// NewPromptTemplate, ParsePromptTemplate or LoadPromptTemplate, such as zero
+// values or ones decoded from JSON, which have no template text.
+var errTemplateNotParsed = errors.New("prompt template is not parsed")
+
+// frontMatterDelimiter opens and closes the YAML front-matter of a template file.
+const frontMatterDelimiter = "---"
+
+// VariableType is the type of a template variable.
+type VariableType string
+
+const (
+	// VariableString accepts strings.
+	VariableString VariableType = "string"
+	// VariableInt accepts integers, including floats without a fractional part.
+	VariableInt VariableType = "int"
+	// VariableFloat accepts any number.
+	VariableFloat VariableType = "float"
+	// VariableBool accepts booleans.
+	VariableBool VariableType = "bool"
+	// VariableList accepts slices, for example of retrieved documents.
+	VariableList VariableType = "list"
+	// VariableAny accepts any value. It is the type of variables without one.
+	VariableAny VariableType = "any"
+)
+
+// TemplateVariable declares a variable of a PromptTemplate.
+type TemplateVariable struct {
+	// Type is the type values must have. If empty, any value is accepted.
+	Type VariableType `json:"type,omitempty"`
+	// Description documents the variable for the people editing the template.
+	Description string `json:"description,omitempty"`
+	// Required variables must be supplied to Render unless they have a Default.
+	Required bool `json:"required,omitempty"`
+	// Default is used when the variable is not supplied.
+	Default interface{} `json:"default,omitempty"`
+}
+
+// TemplateExample is a few-shot example, rendered as a user message followed by
+// the assistant's answer between the system message and the user message. Both
+// are templates that can use the variables.
+type TemplateExample struct {
+	User      string `json:"user"`
+	Assistant string `json:"assistant"`
+}
+
+// PromptTemplate renders a Prompt from text/template templates and variables.
+//
+// The messages of the prompt come from the templates named "system", "user" and
+// "assistant", defined with {{define "system"}}...{{end}} blocks; text outside of
+// define blocks is the user message. Any other defined template is a partial that
+// can be included with {{template "name" .}}. A rendered message that is empty
+// is left out, and an "assistant" template prefills the start of the reply.
+//
+// Variables are referenced as {{.name}}. Referencing a variable that is neither
+// supplied nor has a default is an error.
+type PromptTemplate struct {
+	// Name identifies the template in errors.
+	Name string `json:"name,omitempty"`
+	// Description documents the purpose of the template.
+	Description string `json:"description,omitempty"`
+	// Parameters are the default generation parameters of rendered prompts.
+	Parameters Parameters `json:"parameters"`
+	// Variables declares the variables of the template by name.
+	Variables map[string]TemplateVariable `json:"variables,omitempty"`
+	// Examples are few-shot examples added before the user message.
+	Examples []TemplateExample `json:"examples,omitempty"`
+
+	tmpl *template.Template
+}
+
+// templateFuncs are the functions available to prompt templates in addition to
+// the text/template builtins.
+var templateFuncs = template.FuncMap{
+	"join":  templateJoin,
+	"trim":  strings.TrimSpace,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// NewPromptTemplate parses a prompt template from its text.
+//
+// Parameters:
+//   - name: The name of the template, used in errors.
+//   - text: The template text, which defines the messages and partials.
+//
+// Returns:
+//   - The parsed template, without variable declarations or default parameters.
+//   - An error if the text is not a valid template.
+func NewPromptTemplate(name, text string) (*PromptTemplate, error) {
+	t := &PromptTemplate{Name: name}
+	if err := t.parse(text); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ParsePromptTemplate parses a prompt template document. The document may start
+// with YAML front-matter between "---" lines that holds the name, description,
+// default parameters, variable declarations and few-shot examples of the
+// template; the rest of the document is the template text:
+//
+//	---
+//	name: rag-answer
+//	parameters:
+//	  temperature: 0.2
+//	variables:
+//	  question: {type: string, required: true}
+//	---
+//	{{define "system"}}Use the provided context to answer.{{end}}
+//	{{.question}}
+func ParsePromptTemplate(data []byte) (*PromptTemplate, error) {
+	// Files saved with Windows line endings would otherwise not be recognised as
+	// having front-matter.
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	t := &PromptTemplate{}
+
+	if rest, ok := strings.CutPrefix(text, frontMatterDelimiter+"\n"); ok {
+		frontMatter, body, found := strings.Cut(rest, "\n"+frontMatterDelimiter+"\n")
+		if !found {
+			frontMatter, found = strings.CutSuffix(rest, "\n"+frontMatterDelimiter)
+		}
+		if !found {
+			return nil, errors.New("failed to parse prompt template: front-matter is not closed")
+		}
+		if err := decodeFrontMatter(frontMatter, t); err != nil {
+			return nil, err
+		}
+		text = body
+	}
+
+	if err := t.validateDeclarations(); err != nil {
+		return nil, err
+	}
+	if err := t.parse(text); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// LoadPromptTemplate reads and parses a prompt template file, see
+// ParsePromptTemplate. The file name without extension is the default name of
+// the template.
+func LoadPromptTemplate(path string) (*PromptTemplate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prompt template: %w", err)
+	}
+	t, err := ParsePromptTemplate(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if t.Name == "" {
+		t.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	return t, nil
+}
+
+// decodeFrontMatter decodes YAML front-matter into t. The YAML is converted to
+// JSON first, so that the field names match the JSON tags used throughout.
+func decodeFrontMatter(frontMatter string, t *PromptTemplate) error {
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal([]byte(frontMatter), &raw); err != nil {
+		return fmt.Errorf("failed to parse front-matter: %w", err)
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return fmt.Errorf("failed to convert front-matter: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(t); err != nil {
+		return fmt.Errorf("failed to decode front-matter: %w", err)
+	}
+	return nil
+}
+
+// AddPartials parses text for {{define}} blocks that the templates of t can
+// include, such as partials shared by several templates. Text outside of define
+// blocks is ignored.
+func (t *PromptTemplate) AddPartials(text string) error {
+	if t.tmpl == nil {
+		return errTemplateNotParsed
+	}
+	partials, err := template.New("partials").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return fmt.Errorf("failed to parse partials: %w", err)
+	}
+	for _, partial := range partials.Templates() {
+		if partial.Name() == "partials" {
+			continue
+		}
+		if _, err := t.tmpl.AddParseTree(partial.Name(), partial.Tree); err != nil {
+			return fmt.Errorf("failed to add partial %q: %w", partial.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Validate checks that vars supplies every required variable and that the values
+// of declared variables have the declared types.
+func (t *PromptTemplate) Validate(vars map[string]interface{}) error {
+	var problems []string
+	for _, name := range t.variableNames() {
+		variable := t.Variables[name]
+		value, ok := vars[name]
+		if !ok {
+			if variable.Required && variable.Default == nil {
+				problems = append(problems, fmt.Sprintf("missing required variable %q", name))
+			}
+			continue
+		}
+		if !variable.accepts(value) {
+			problems = append(problems, fmt.Sprintf("variable %q must be of type %s, got %T", name, variable.Type, value))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid variables for prompt template %s: %s", t.Name, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Render validates vars and renders the template into a new prompt that carries
+// the template's default parameters.
+//
+// Parameters:
+//   - vars: The values of the template variables by name.
+//
+// Returns:
+//   - The rendered prompt with the system message, few-shot examples, user message
+//     and assistant prefill, in that order.
+//   - An error if the template was not parsed, a variable is missing or has the
+//     wrong type, or rendering fails.
+func (t *PromptTemplate) Render(vars map[string]interface{}) (*Prompt, error) {
+	if t.tmpl == nil {
+		return nil, errTemplateNotParsed
+	}
+	if err := t.Validate(vars); err != nil {
+		return nil, err
+	}
+	// Every declared variable is present, so that optional ones can be tested with
+	// {{if}}; only undeclared names are missing keys.
+	data := make(map[string]interface{}, len(vars)+len(t.Variables))
+	for name, variable := range t.Variables {
+		data[name] = variable.Default
+	}
+	for name, value := range vars {
+		data[name] = value
+	}
+
+	prompt := NewPrompt().SetParameters(t.Parameters)
+	if err := t.addMessage(prompt, "system", systemTemplateName, data); err != nil {
+		return nil, err
+	}
+	for i, example := range t.Examples {
+		user, err := t.execute(fmt.Sprintf("example %d", i+1), example.User, data)
+		if err != nil {
+			return nil, err
+		}
+		assistant, err := t.execute(fmt.Sprintf("example %d", i+1), example.Assistant, data)
+		if err != nil {
+			return nil, err
+		}
+		prompt.AddMessage("user", user).AddMessage("assistant", assistant)
+	}
+	if err := t.addMessage(prompt, "user", userTemplateName, data); err != nil {
+		return nil, err
+	}
+	if err := t.addMessage(prompt, "assistant", assistantTemplateName, data); err != nil {
+		return nil, err
+	}
+	return prompt, nil
+}
+
+// parse parses the template text. Text outside of define blocks becomes the
+// user template unless one is defined explicitly.
+func (t *PromptTemplate) parse(text string) error {
+	tmpl, err := template.New(rootTemplateName).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return fmt.Errorf("failed to parse prompt template %s: %w", t.Name, err)
+	}
+	if tmpl.Lookup(userTemplateName) == nil && strings.TrimSpace(tmplText(tmpl)) != "" {
+		if _, err := tmpl.AddParseTree(userTemplateName, tmpl.Tree); err != nil {
+			return fmt.Errorf("failed to parse prompt template %s: %w", t.Name, err)
+		}
+	}
+	t.tmpl = tmpl
+	return nil
+}
+
+// tmplText returns the text of the top-level template outside of define blocks.
+func tmplText(tmpl *template.Template) string {
+	if tmpl.Tree == nil || tmpl.Tree.Root == nil {
+		return ""
+	}
+	return tmpl.Tree.Root.String()
+}
+
+// addMessage renders the named template, if defined, and adds it to the prompt
+// unless it is empty.
+func (t *PromptTemplate) addMessage(prompt *Prompt, role, name string, data map[string]interface{}) error {
+	tmpl := t.tmpl.Lookup(name)
+	if tmpl == nil {
+		return nil
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return fmt.Errorf("failed to render prompt template %s: %w", t.Name, err)
+	}
+	if content := strings.TrimSpace(b.String()); content != "" {
+		prompt.AddMessage(role, content)
+	}
+	return nil
+}
+
+// execute renders text as a template that can use the partials of t.
+func (t *PromptTemplate) execute(name, text string, data map[string]interface{}) (string, error) {
+	clone, err := t.tmpl.Clone()
+	if err != nil {
+		return "", fmt.Errorf("failed to render prompt template %s: %w", t.Name, err)
+	}
+	tmpl, err := clone.New(name).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %s of prompt template %s: %w", name, t.Name, err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to render %s of prompt template %s: %w", name, t.Name, err)
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// validateDeclarations checks the variable declarations of the front-matter.
+func (t *PromptTemplate) validateDeclarations() error {
+	for _, name := range t.variableNames() {
+		variable := t.Variables[name]
+		switch variable.Type {
+		case "", VariableString, VariableInt, VariableFloat, VariableBool, VariableList, VariableAny:
+		default:
+			return fmt.Errorf("variable %q has unknown type %q", name, variable.Type)
+		}
+		if variable.Default != nil && !variable.accepts(variable.Default) {
+			return fmt.Errorf("default of variable %q must be of type %s", name, variable.Type)
+		}
+	}
+	return nil
+}
+
+func (t *PromptTemplate) variableNames() []string {
+	names := make([]string, 0, len(t.Variables))
+	for name := range t.Variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// accepts reports whether value has the type of the variable.
+func (v TemplateVariable) accepts(value interface{}) bool {
+	rv := reflect.ValueOf(value)
+	switch v.Type {
+	case VariableString:
+		return rv.Kind() == reflect.String
+	case VariableInt:
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return true
+		case reflect.Float32, reflect.Float64:
+			return rv.Float() == math.Trunc(rv.Float())
+		default:
+			return false
+		}
+	case VariableFloat:
+		return rv.CanInt() || rv.CanUint() || rv.CanFloat()
+	case VariableBool:
+		return rv.Kind() == reflect.Bool
+	case VariableList:
+		return rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array
+	default:
+		return true
+	}
+}
+
+// templateJoin joins the elements of a slice with sep, formatting each with %v.
+func templateJoin(sep string, list interface{}) (string, error) {
+	rv := reflect.ValueOf(list)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return "", fmt.Errorf("join expects a list, got %T", list)
+	}
+	items := make([]string, rv.Len())
+	for i := range items {
+		items[i] = fmt.Sprint(rv.Index(i).Interface())
+	}
+	return strings.Join(items, sep), nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const ragTemplate = `---
+description: Answers questions from retrieved documents
+parameters:
+  max_tokens: 256
+  temperature: 0.2
+variables:
+  question:
+    type: string
+    required: true
+  documents:
+    type: list
+    required: true
+  tone:
+    type: string
+    default: friendly
+examples:
+  - user: "Context: Paris is the capital of France.\n\nQuestion: What is the capital of France?"
+    assistant: "Paris."
+---
+{{define "system"}}Use the provided context to answer in a {{.tone}} tone. {{template "refusal" .}}{{end}}
+Context: {{join "\n" .documents}}
+
+Question: {{.question}}
+`
+
+func TestLoadPromptTemplate(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "rag-answer.tmpl")
+	if err := os.WriteFile(path, []byte(ragTemplate), 0o600); err != nil {
+		t.Fatalf("Failed to write template: %v", err)
+	}
+
+	tmpl, err := LoadPromptTemplate(path)
+	if err != nil {
+		t.Fatalf("LoadPromptTemplate returned error: %v", err)
+	}
+	if tmpl.Name != "rag-answer" {
+		t.Errorf("Expected the name to default to the file name, got %q", tmpl.Name)
+	}
+	partials := `{{define "refusal"}}If the context does not contain the answer, say you don't know.{{end}}`
+	if err := tmpl.AddPartials(partials); err != nil {
+		t.Fatalf("AddPartials returned error: %v", err)
+	}
+
+	prompt, err := tmpl.Render(map[string]interface{}{
+		"question":  "Who created Mickey Mouse?",
+		"documents": []string{"Mickey Mouse is a cartoon character.", "Walt Disney created Mickey Mouse."},
+	})
+	if err != nil {
+		t.Fatalf("Render returned error: %v", err)
+	}
+
+	if prompt.Parameters.MaxTokens != 256 || prompt.Parameters.Temperature != 0.2 {
+		t.Errorf("Expected the default parameters from the front-matter, got %+v", prompt.Parameters)
+	}
+	expected := []Message{
+		{Role: "system", Content: "Use the provided context to answer in a friendly tone. " +
+			"If the context does not contain the answer, say you don't know."},
+		{Role: "user", Content: "Context: Paris is the capital of France.\n\nQuestion: What is the capital of France?"},
+		{Role: "assistant", Content: "Paris."},
+		{Role: "user", Content: "Context: Mickey Mouse is a cartoon character.\nWalt Disney created Mickey Mouse.\n\n" +
+			"Question: Who created Mickey Mouse?"},
+	}
+	if len(prompt.Messages) != len(expected) {
+		t.Fatalf("Expected %d messages, got %+v", len(expected), prompt.Messages)
+	}
+	for i, message := range prompt.Messages {
+		if message.Role != expected[i].Role || message.Content != expected[i].Content {
+			t.Errorf("Expected message %d to be %+v, got %+v", i, expected[i], message)
+		}
+	}
+}
+
+func TestPromptTemplateValidation(t *testing.T) {
+	t.Parallel()
+	tmpl, err := ParsePromptTemplate([]byte(ragTemplate))
+	if err != nil {
+		t.Fatalf("ParsePromptTemplate returned error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		vars map[string]interface{}
+		want string
+	}{
+		{
+			name: "missing required variable",
+			vars: map[string]interface{}{"documents": []string{}},
+			want: `missing required variable "question"`,
+		},
+		{
+			name: "wrong type",
+			vars: map[string]interface{}{"question": 42, "documents": []string{}},
+			want: `variable "question" must be of type string`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if _, err := tmpl.Render(tt.vars); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+
+	undeclared, err := NewPromptTemplate("greeting", "Hello {{.name}}!")
+	if err != nil {
+		t.Fatalf("NewPromptTemplate returned error: %v", err)
+	}
+	if _, err := undeclared.Render(nil); err == nil {
+		t.Errorf("Expected an error for a variable that was not supplied")
+	}
+	prompt, err := undeclared.Render(map[string]interface{}{"name": "Ada"})
+	if err != nil || len(prompt.Messages) != 1 || prompt.Messages[0].Content != "Hello Ada!" {
+		t.Errorf("Unexpected prompt %+v, error %v", prompt, err)
+	}
+}
+
+func TestParsePromptTemplateErrors(t *testing.T) {
+	t.Parallel()
+	tests := map[string]string{
+		"unclosed front-matter": "---\nname: broken\n{{.x}}",
+		"unknown field":         "---\nnmae: typo\n---\n{{.x}}",
+		"unknown type":          "---\nvariables:\n  x: {type: date}\n---\n{{.x}}",
+		"bad default":           "---\nvariables:\n  x: {type: int, default: many}\n---\n{{.x}}",
+		"invalid template":      "{{.x",
+	}
+	for name, text := range tests {
+		if _, err := ParsePromptTemplate([]byte(text)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestPromptTemplateOptionalVariables(t *testing.T) {
+	t.Parallel()
+	text := "---\nvariables:\n  name: {type: string}\n---\nHello{{if .name}} {{.name}}{{end}}!"
+	tmpl, err := ParsePromptTemplate([]byte(text))
+	if err != nil {
+		t.Fatalf("ParsePromptTemplate returned error: %v", err)
+	}
+
+	for vars, want := range map[string]string{"": "Hello!", "Ada": "Hello Ada!"} {
+		values := map[string]interface{}{}
+		if vars != "" {
+			values["name"] = vars
+		}
+		prompt, err := tmpl.Render(values)
+		if err != nil {
+			t.Fatalf("Render returned error: %v", err)
+		}
+		if got := prompt.Messages[0].Content; got != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	}
+
+	undeclared, err := NewPromptTemplate("greeting", "Hello {{.name}}{{.title}}!")
+	if err != nil {
+		t.Fatalf("NewPromptTemplate returned error: %v", err)
+	}
+	if _, err := undeclared.Render(map[string]interface{}{"name": "Ada"}); err == nil {
+		t.Errorf("Expected an error for an undeclared variable that was not supplied")
+	}
+}
+
+func TestParsePromptTemplateCRLF(t *testing.T) {
+	t.Parallel()
+	text := strings.ReplaceAll(ragTemplate, "\n", "\r\n")
+	tmpl, err := ParsePromptTemplate([]byte(text))
+	if err != nil {
+		t.Fatalf("ParsePromptTemplate returned error: %v", err)
+	}
+	if tmpl.Description != "Answers questions from retrieved documents" || len(tmpl.Variables) != 3 {
+		t.Errorf("Expected the front-matter to be parsed, got %+v", tmpl)
+	}
+	if err := tmpl.AddPartials(`{{define "refusal"}}Say you don't know otherwise.{{end}}`); err != nil {
+		t.Fatalf("AddPartials returned error: %v", err)
+	}
+
+	prompt, err := tmpl.Render(map[string]interface{}{"question": "Why?", "documents": []string{"Because."}})
+	if err != nil {
+		t.Fatalf("Render returned error: %v", err)
+	}
+	last := prompt.Messages[len(prompt.Messages)-1]
+	if strings.Contains(last.Content, "---") || strings.Contains(last.Content, "\r") {
+		t.Errorf("Expected the front-matter not to be sent to the model, got %q", last.Content)
+	}
+}
+
+func TestPromptTemplateNotParsed(t *testing.T) {
+	t.Parallel()
+	var decoded PromptTemplate
+	if err := json.Unmarshal([]byte(`{"name": "qa"}`), &decoded); err != nil {
+		t.Fatalf("Unmarshal returned error: %v", err)
+	}
+	for _, tmpl := range []*PromptTemplate{{}, &decoded} {
+		if _, err := tmpl.Render(nil); !errors.Is(err, errTemplateNotParsed) {
+			t.Errorf("Expected %v from Render, got %v", errTemplateNotParsed, err)
+		}
+		if err := tmpl.AddPartials(`{{define "refusal"}}No.{{end}}`); !errors.Is(err, errTemplateNotParsed) {
+			t.Errorf("Expected %v from AddPartials, got %v", errTemplateNotParsed, err)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultCompletionReserve is the number of completion tokens reserved for a
+// generation that does not set MaxTokens.
+const defaultCompletionReserve = 256
+
+// RateLimitOption represents an option for NewRateLimiter.
+type RateLimitOption func(*RateLimiter)
+
+// WithTokenCounter sets the function used to estimate the tokens of prompts and
+// embedding inputs before they are sent. It defaults to EstimateTokens; the
+// Count method of a tokenizer gives exact figures.
+func WithTokenCounter(counter TokenCounter) RateLimitOption {
+	return func(l *RateLimiter) {
+		l.counter = counter
+	}
+}
+
+// WithCompletionReserve sets the number of completion tokens reserved for a
+// generation that does not set MaxTokens. It defaults to 256.
+func WithCompletionReserve(tokens int) RateLimitOption {
+	return func(l *RateLimiter) {
+		l.completionReserve = tokens
+	}
+}
+
+// RateLimiter keeps calls within a requests-per-minute and a tokens-per-minute
+// budget, so that concurrent callers sharing a provider quota queue up instead
+// of failing with rate limit errors. It is safe for concurrent use; share one
+// limiter between all backends drawing from the same quota.
+//
+// Both budgets are token buckets that hold a minute's worth of capacity and
+// refill continuously. Before a call is sent, its tokens are estimated from the
+// prompt or inputs plus the completion tokens it may use, and the call waits
+// until both buckets can cover it. Once a generation returns, the estimate is
+// replaced by the usage the provider reported.
+//
+// The limiter sees each call once. Retries made by the RetryPolicy of a wrapped
+// backend happen inside the call, so they go around the limiter: they are not
+// delayed by it and do not count against its budgets. Leave headroom in the
+// limits when backends retry.
+type RateLimiter struct {
+	mu                sync.Mutex
+	requests          *tokenBucket
+	tokens            *tokenBucket
+	counter           TokenCounter
+	completionReserve int
+	now               func() time.Time
+}
+
+// NewRateLimiter creates a rate limiter. A limit of zero or less disables that budget.
+//
+// Parameters:
+//   - requestsPerMinute: The number of calls allowed per minute.
+//   - tokensPerMinute: The number of prompt and completion tokens allowed per minute.
+//   - opts: Options setting how tokens are estimated.
+//
+// Returns:
+//   - A pointer to a new RateLimiter instance.
+func NewRateLimiter(requestsPerMinute, tokensPerMinute int, opts ...RateLimitOption) *RateLimiter {
+	l := &RateLimiter{
+		counter:           EstimateTokens,
+		completionReserve: defaultCompletionReserve,
+		now:               time.Now,
+	}
+	start := l.now()
+	if requestsPerMinute > 0 {
+		l.requests = newTokenBucket(requestsPerMinute, start)
+	}
+	if tokensPerMinute > 0 {
+		l.tokens = newTokenBucket(tokensPerMinute, start)
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Wait blocks until a call using the given number of tokens fits in the budgets,
+// and takes it from them. Calls are admitted in the order they called Wait. A
+// call estimated above the tokens-per-minute budget waits for the full budget.
+//
+// Parameters:
+//   - ctx: The context for the wait.
+//   - tokens: The estimated tokens of the call.
+//
+// Returns:
+//   - An error if the context is done before the call can proceed. The
+//     reservation is then returned to the budgets.
+func (l *RateLimiter) Wait(ctx context.Context, tokens int) error {
+	delay := l.reserve(tokens)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		l.release(tokens)
+		return fmt.Errorf("%w (while waiting for rate limit)", ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Reconcile corrects the tokens-per-minute budget once the actual usage of a call
+// is known: tokens reserved beyond the usage are returned, and usage beyond the
+// reservation is taken, delaying later calls.
+//
+// Parameters:
+//   - estimated: The tokens passed to Wait for the call.
+//   - actual: The tokens the call used, as reported by the provider.
+func (l *RateLimiter) Reconcile(estimated, actual int) {
+	if l.tokens == nil || actual == estimated {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens.take(l.now(), float64(actual-l.tokens.clamp(estimated)))
+}
+
+// Middleware returns middleware that makes the calls of a backend wait for this
+// limiter. Generations are reconciled with the usage in their result; embeddings
+// and streams keep their estimate.
+func (l *RateLimiter) Middleware() Middleware {
+	return Middleware{
+		Generate: func(next GenerateFunc) GenerateFunc {
+			return func(ctx context.Context, prompt *Prompt) (*GenerateResult, error) {
+				estimated := l.estimatePrompt(prompt)
+				if err := l.Wait(ctx, estimated); err != nil {
+					return nil, err
+				}
+				result, err := next(ctx, prompt)
+				if result != nil && result.Usage.TotalTokens > 0 {
+					l.Reconcile(estimated, result.Usage.TotalTokens)
+				}
+				return result, err
+			}
+		},
+		Stream: func(next StreamFunc) StreamFunc {
+			return func(ctx context.Context, prompt *Prompt) (<-chan StreamChunk, error) {
+				if err := l.Wait(ctx, l.estimatePrompt(prompt)); err != nil {
+					return nil, err
+				}
+				return next(ctx, prompt)
+			}
+		},
+		Embed: func(next EmbedFunc) EmbedFunc {
+			return func(ctx context.Context, inputs []string) ([][]float32, error) {
+				estimated := 0
+				for _, input := range inputs {
+					estimated += l.counter(input)
+				}
+				if err := l.Wait(ctx, estimated); err != nil {
+					return nil, err
+				}
+				return next(ctx, inputs)
+			}
+		},
+	}
+}
+
+// estimatePrompt returns the tokens a generation may use: its messages, with a
+// small overhead each, and its completion.
+func (l *RateLimiter) estimatePrompt(prompt *Prompt) int {
+	tokens := 0
+	for _, message := range prompt.Messages {
+		tokens += l.counter(message.Text()) + messageOverheadTokens
+	}
+	if prompt.Parameters.MaxTokens > 0 {
+		return tokens + prompt.Parameters.MaxTokens
+	}
+	return tokens + l.completionReserve
+}
+
+// reserve takes a request and tokens from the budgets and returns how long the
+// caller must wait before they are available.
+func (l *RateLimiter) reserve(tokens int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var delay time.Duration
+	if l.requests != nil {
+		delay = l.requests.take(now, 1)
+	}
+	if l.tokens != nil {
+		delay = max(delay, l.tokens.take(now, float64(l.tokens.clamp(tokens))))
+	}
+	return delay
+}
+
+// release returns a reservation that was not used to the budgets.
+func (l *RateLimiter) release(tokens int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if l.requests != nil {
+		l.requests.take(now, -1)
+	}
+	if l.tokens != nil {
+		l.tokens.take(now, -float64(l.tokens.clamp(tokens)))
+	}
+}
+
+// tokenBucket holds up to a minute's worth of a budget and refills continuously.
+// Its level goes negative when callers reserve more than it holds; they then
+// wait until it is refilled back to zero.
+type tokenBucket struct {
+	capacity float64
+	perSec   float64
+	level    float64
+	updated  time.Time
+}
+
+func newTokenBucket(perMinute int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		capacity: float64(perMinute),
+		perSec:   float64(perMinute) / 60,
+		level:    float64(perMinute),
+		updated:  now,
+	}
+}
+
+// take removes n from the bucket, or returns -n to it, and returns how long
+// until the level is back to zero.
+func (b *tokenBucket) take(now time.Time, n float64) time.Duration {
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.level = min(b.capacity, b.level+elapsed.Seconds()*b.perSec)
+		b.updated = now
+	}
+	b.level = min(b.capacity, b.level-n)
+	if b.level >= 0 {
+		return 0
+	}
+	return time.Duration(-b.level / b.perSec * float64(time.Second))
+}
+
+// clamp limits n to the capacity of the bucket, so that an oversized call waits
+// for a full bucket rather than forever.
+func (b *tokenBucket) clamp(n int) int {
+	return min(n, int(b.capacity))
+}
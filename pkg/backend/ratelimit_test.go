@@ -0,0 +1,159 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock returns a limiter clock that only moves when advanced.
+func fakeClock(l *RateLimiter) func(d time.Duration) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	for _, bucket := range []*tokenBucket{l.requests, l.tokens} {
+		if bucket != nil {
+			bucket.updated = now
+		}
+	}
+	return func(d time.Duration) { now = now.Add(d) }
+}
+
+// lockedBackend is a stubBackend that can be called concurrently.
+type lockedBackend struct {
+	mu sync.Mutex
+	stubBackend
+}
+
+func (b *lockedBackend) Generate(ctx context.Context, prompt *Prompt) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stubBackend.Generate(ctx, prompt)
+}
+
+func (b *lockedBackend) GenerateWithResult(ctx context.Context, prompt *Prompt) (*GenerateResult, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stubBackend.GenerateWithResult(ctx, prompt)
+}
+
+func (b *lockedBackend) Embed(ctx context.Context, input string) ([]float32, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stubBackend.Embed(ctx, input)
+}
+
+func (b *lockedBackend) EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stubBackend.EmbedBatch(ctx, inputs)
+}
+
+func TestRateLimiterBudgets(t *testing.T) {
+	t.Parallel()
+	limiter := NewRateLimiter(2, 600)
+	advance := fakeClock(limiter)
+
+	if delay := limiter.reserve(100); delay != 0 {
+		t.Errorf("Expected the first call to proceed, got a delay of %s", delay)
+	}
+	if delay := limiter.reserve(100); delay != 0 {
+		t.Errorf("Expected the second call to proceed, got a delay of %s", delay)
+	}
+	if delay := limiter.reserve(100); delay != 30*time.Second {
+		t.Errorf("Expected the third request to wait for the request budget, got %s", delay)
+	}
+	advance(time.Minute)
+	if delay := limiter.reserve(100); delay != 0 {
+		t.Errorf("Expected the request budget to have refilled, got a delay of %s", delay)
+	}
+
+	tokens := NewRateLimiter(0, 600)
+	fakeClock(tokens)
+	tokens.reserve(300)
+	if delay := tokens.reserve(700); delay != 30*time.Second {
+		t.Errorf("Expected an oversized call to wait for the full token budget, got %s", delay)
+	}
+}
+
+func TestRateLimiterReconcile(t *testing.T) {
+	t.Parallel()
+	limiter := NewRateLimiter(0, 600)
+	fakeClock(limiter)
+
+	limiter.reserve(600)
+	limiter.Reconcile(600, 60)
+	if delay := limiter.reserve(540); delay != 0 {
+		t.Errorf("Expected unused tokens to be returned, got a delay of %s", delay)
+	}
+	limiter.Reconcile(540, 640)
+	if delay := limiter.reserve(0); delay != 10*time.Second {
+		t.Errorf("Expected usage beyond the estimate to delay later calls, got %s", delay)
+	}
+}
+
+func TestRateLimiterWaitCancelled(t *testing.T) {
+	t.Parallel()
+	limiter := NewRateLimiter(1, 0)
+	if err := limiter.Wait(context.Background(), 0); err != nil {
+		t.Fatalf("Wait returned error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(ctx, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if limiter.requests.level < -0.1 {
+		t.Errorf("Expected the cancelled reservation to be returned, got level %f", limiter.requests.level)
+	}
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	t.Parallel()
+	limiter := NewRateLimiter(0, 1000, WithCompletionReserve(100), WithTokenCounter(wordCounter))
+	fakeClock(limiter)
+	inner := &lockedBackend{stubBackend: stubBackend{stubGenerator: stubGenerator{response: "Hi"}}}
+	wrapped := Wrap(inner, limiter.Middleware())
+
+	// Each worker estimates 3 words + 4 overhead + 100 reserved tokens.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := wrapped.Generate(context.Background(), NewPrompt().AddMessage("user", "one two three")); err != nil {
+				t.Errorf("Generate returned error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := wrapped.EmbedBatch(context.Background(), []string{"a b", "c"}); err != nil {
+		t.Fatalf("EmbedBatch returned error: %v", err)
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if limiter.tokens.level != 1000-5*107-3 {
+		t.Errorf("Expected %d tokens left, got %f", 1000-5*107-3, limiter.tokens.level)
+	}
+	if len(inner.prompts) != 5 {
+		t.Errorf("Expected 5 generations, got %d", len(inner.prompts))
+	}
+}
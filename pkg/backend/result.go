@@ -0,0 +1,87 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import "time"
+
+// FinishReason describes why the model stopped generating.
+type FinishReason string
+
+const (
+	// FinishReasonStop means the model finished its answer or hit a stop sequence.
+	FinishReasonStop FinishReason = "stop"
+	// FinishReasonLength means the answer was cut off by Parameters.MaxTokens or the context window.
+	FinishReasonLength FinishReason = "length"
+	// FinishReasonToolCalls means the model stopped to call one or more tools.
+	FinishReasonToolCalls FinishReason = "tool_calls"
+	// FinishReasonContentFilter means the answer was withheld or cut short by a content filter.
+	FinishReasonContentFilter FinishReason = "content_filter"
+)
+
+// Usage reports the number of tokens consumed by a request.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// GenerateResult holds a generated response together with the metadata the
+// provider reported about it.
+type GenerateResult struct {
+	// Message is the assistant message, including any tool calls.
+	Message Message
+	// FinishReason tells why generation stopped. It is empty if the provider did not say.
+	FinishReason FinishReason
+	// Usage holds the prompt and completion token counts.
+	Usage Usage
+	// Model is the model that served the request, as reported by the provider.
+	Model string
+	// Latency is the wall-clock time from sending the request to decoding the response.
+	Latency time.Duration
+	// RequestID is the provider's identifier for the request, if it returns one.
+	RequestID string
+	// PromptFilterResults and CompletionFilterResults hold the content filter
+	// verdicts for the prompt and the completion, keyed by category such as
+	// "hate" or "violence". Only Azure OpenAI reports them; they are nil otherwise.
+	PromptFilterResults     ContentFilterResults
+	CompletionFilterResults ContentFilterResults
+}
+
+// ContentFilterResults maps content filter categories to their verdicts.
+type ContentFilterResults map[string]ContentFilterResult
+
+// ContentFilterResult is a content filter's verdict for a single category.
+type ContentFilterResult struct {
+	// Filtered reports whether the content was blocked or cut short because of this category.
+	Filtered bool `json:"filtered"`
+	// Severity is the assessed severity, such as "safe", "low", "medium" or "high".
+	Severity string `json:"severity,omitempty"`
+	// Detected is set by detection categories such as "jailbreak" that have no severity.
+	Detected bool `json:"detected,omitempty"`
+}
+
+// Filtered reports whether any category was filtered.
+func (r ContentFilterResults) Filtered() bool {
+	for _, result := range r {
+		if result.Filtered {
+			return true
+		}
+	}
+	return false
+}
+
+// Content returns the text of the generated message.
+func (r *GenerateResult) Content() string {
+	return r.Message.Content
+}
@@ -0,0 +1,217 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy configures how backends retry requests that failed for transient
+// reasons: rate limits, server errors, dropped connections and models that are
+// still loading.
+//
+// Delays grow exponentially from InitialBackoff by Multiplier, capped at
+// MaxBackoff, and are randomised by Jitter. When the provider sends a Retry-After
+// header, its delay is used instead. Retrying stops after MaxAttempts attempts,
+// when waiting would exceed MaxElapsedTime, or when the context is done.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	// Values below 2 disable retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the exponential backoff delay.
+	MaxBackoff time.Duration
+	// Multiplier is the factor the delay grows by after each attempt.
+	Multiplier float64
+	// Jitter randomises each delay by up to this fraction in either direction.
+	Jitter float64
+	// MaxElapsedTime bounds the total time spent on a request, including waits.
+	// Zero means no limit beyond the context deadline.
+	MaxElapsedTime time.Duration
+}
+
+// DefaultRetryPolicy returns a retry policy suitable for most workloads: up to
+// five attempts with exponential backoff starting at half a second, over at most
+// two minutes.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+		MaxElapsedTime: 2 * time.Minute,
+	}
+}
+
+// IsRetryable reports whether err is a transient failure that may succeed if the
+// request is retried: rate limits, server-side errors, and dropped or timed out
+// connections, including client and per-attempt timeouts. Cancellation is never
+// retryable. A timeout cannot be told apart from the expiry of the caller's own
+// deadline, so callers must check their context before retrying.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var rateErr *RateLimitError
+	var serverErr *ServerUnavailableError
+	if errors.As(err, &rateErr) || errors.As(err, &serverErr) {
+		return true
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// backoff returns the delay before the given retry, starting at 1.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(p.InitialBackoff) * math.Pow(multiplier, float64(retry-1))
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		delay *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(delay)
+}
+
+// requestedDelay returns the delay the provider asked for in a Retry-After header.
+func requestedDelay(err error) time.Duration {
+	var rateErr *RateLimitError
+	if errors.As(err, &rateErr) {
+		return rateErr.RetryAfter
+	}
+	var serverErr *ServerUnavailableError
+	if errors.As(err, &serverErr) {
+		return serverErr.RetryAfter
+	}
+	return 0
+}
+
+// cancelOnClose releases the per-attempt context once the response body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// sendWithRetry sends the request built by newRequest and returns the response if
+// its status is 200 OK. Other statuses are converted into errors by toError. Failed
+// attempts are retried according to policy, which may be nil to disable retries.
+//
+// If attemptTimeout is non-zero, each attempt, including reading the response
+// body, is bounded by it. The caller must close the returned response body.
+func sendWithRetry(
+	ctx context.Context,
+	policy *RetryPolicy,
+	client *http.Client,
+	attemptTimeout time.Duration,
+	newRequest func(ctx context.Context) (*http.Request, error),
+	toError func(resp *http.Response, body []byte) error,
+) (*http.Response, error) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		resp, err := sendOnce(ctx, client, attemptTimeout, newRequest, toError)
+		if err == nil {
+			return resp, nil
+		}
+
+		if policy == nil || attempt >= policy.MaxAttempts || ctx.Err() != nil || !IsRetryable(err) {
+			return nil, err
+		}
+
+		delay := requestedDelay(err)
+		if delay == 0 {
+			delay = policy.backoff(attempt)
+		}
+		if policy.MaxElapsedTime > 0 && time.Since(start)+delay > policy.MaxElapsedTime {
+			return nil, err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("%w (while waiting to retry after: %v)", ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+}
+
+func sendOnce(
+	ctx context.Context,
+	client *http.Client,
+	attemptTimeout time.Duration,
+	newRequest func(ctx context.Context) (*http.Request, error),
+	toError func(resp *http.Response, body []byte) error,
+) (*http.Response, error) {
+	cancel := context.CancelFunc(func() {})
+	if attemptTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, attemptTimeout)
+	}
+
+	req, err := newRequest(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("HTTP request failed: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer cancel()
+		defer resp.Body.Close()
+		bodyBytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response body: %w", err)
+		}
+		return nil, toError(resp, bodyBytes)
+	}
+
+	resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
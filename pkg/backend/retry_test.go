@@ -0,0 +1,259 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+		Multiplier:     2,
+	}
+}
+
+func TestOpenAIRetriesTransientErrors(t *testing.T) {
+	t.Parallel()
+
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		switch attempts.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":{"message":"Rate limit reached","code":"rate_limit_exceeded"}}`))
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":{"message":"The server is overloaded"}}`))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}]}`))
+		}
+	}))
+	defer server.Close()
+
+	backend := NewOpenAIBackend("test-key", "gpt-4o", 10*time.Second)
+	backend.BaseURL = server.URL
+	backend.Retry = testRetryPolicy()
+
+	response, err := backend.Generate(context.Background(), NewPrompt().AddMessage("user", "Hi"))
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if response != "Hello" {
+		t.Errorf("Expected response 'Hello', got '%s'", response)
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("Expected 3 attempts, got %d", got)
+	}
+}
+
+func TestOpenAIDoesNotRetryPermanentErrors(t *testing.T) {
+	t.Parallel()
+
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":{"message":"Incorrect API key provided","code":"invalid_api_key"}}`))
+	}))
+	defer server.Close()
+
+	backend := NewOpenAIBackend("bad-key", "text-embedding-3-small", 10*time.Second)
+	backend.BaseURL = server.URL
+	backend.Retry = testRetryPolicy()
+
+	_, err := backend.Embed(context.Background(), "Hello")
+	var authErr *AuthenticationError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("Expected AuthenticationError, got %T: %v", err, err)
+	}
+	if got := attempts.Load(); got != 1 {
+		t.Errorf("Expected 1 attempt, got %d", got)
+	}
+}
+
+func TestRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	t.Parallel()
+
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		attempts.Add(1)
+		w.Header().Set("Retry-After-Ms", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":{"message":"Rate limit reached"}}`))
+	}))
+	defer server.Close()
+
+	backend := NewOpenAIBackend("test-key", "gpt-4o", 10*time.Second)
+	backend.BaseURL = server.URL
+	backend.Retry = testRetryPolicy()
+
+	_, err := backend.Generate(context.Background(), NewPrompt().AddMessage("user", "Hi"))
+	var rateErr *RateLimitError
+	if !errors.As(err, &rateErr) {
+		t.Fatalf("Expected RateLimitError, got %T: %v", err, err)
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("Expected 3 attempts, got %d", got)
+	}
+}
+
+func TestRetryHonoursRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.Header().Set("Retry-After-Ms", "100")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"Hello"}}]}`))
+	}))
+	defer server.Close()
+
+	backend := NewOpenAIBackend("test-key", "gpt-4o", 10*time.Second)
+	backend.BaseURL = server.URL
+	backend.Retry = testRetryPolicy()
+
+	start := time.Now()
+	if _, err := backend.Generate(context.Background(), NewPrompt().AddMessage("user", "Hi")); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected to wait at least 100ms before retrying, waited %v", elapsed)
+	}
+}
+
+func TestRetryStopsWhenContextIsCancelled(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	backend := NewOpenAIBackend("test-key", "gpt-4o", 10*time.Second)
+	backend.BaseURL = server.URL
+	backend.Retry = DefaultRetryPolicy()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := backend.Generate(ctx, NewPrompt().AddMessage("user", "Hi"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected to stop waiting when the context expired, waited %v", elapsed)
+	}
+}
+
+func TestOllamaRetriesWhileModelLoads(t *testing.T) {
+	t.Parallel()
+
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"model is loading, please retry"}`))
+			return
+		}
+		w.Write([]byte(`{"embedding":[0.1,0.2]}`))
+	}))
+	defer server.Close()
+
+	backend := NewOllamaBackend(server.URL, "all-minilm", 10*time.Second)
+	backend.Retry = testRetryPolicy()
+
+	embedding, err := backend.Embed(context.Background(), testEmbeddingText)
+	if err != nil {
+		t.Fatalf("Embed returned error: %v", err)
+	}
+	if len(embedding) != 2 {
+		t.Errorf("Expected 2 dimensions, got %d", len(embedding))
+	}
+	if got := attempts.Load(); got != 2 {
+		t.Errorf("Expected 2 attempts, got %d", got)
+	}
+}
+
+// timeoutErrors returns the errors of a request cut off by http.Client.Timeout
+// and of one cut off by a per-attempt context deadline.
+func timeoutErrors(t *testing.T) (clientTimeout, attemptDeadline error) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	client := &http.Client{Timeout: 10 * time.Millisecond}
+	if _, err := client.Get(server.URL); err != nil {
+		clientTimeout = fmt.Errorf("HTTP request failed: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if _, err := http.DefaultClient.Do(req); err != nil {
+		attemptDeadline = fmt.Errorf("HTTP request failed: %w", err)
+	}
+	if clientTimeout == nil || attemptDeadline == nil {
+		t.Fatalf("Expected both requests to time out, got %v and %v", clientTimeout, attemptDeadline)
+	}
+	return clientTimeout, attemptDeadline
+}
+
+func TestIsRetryable(t *testing.T) {
+	t.Parallel()
+	clientTimeout, attemptDeadline := timeoutErrors(t)
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"rate limit", &RateLimitError{}, true},
+		{"server unavailable", &ServerUnavailableError{}, true},
+		{"authentication", &AuthenticationError{}, false},
+		{"context length", &ContextLengthExceededError{}, false},
+		{"cancelled", context.Canceled, false},
+		{"client timeout", clientTimeout, true},
+		{"attempt deadline", attemptDeadline, true},
+	}
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.want {
+			t.Errorf("IsRetryable(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
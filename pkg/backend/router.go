@@ -0,0 +1,368 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultEjectAfter is the number of consecutive failures after which a
+	// backend is ejected.
+	defaultEjectAfter = 3
+	// defaultEjectFor is how long an ejected backend is skipped before a probe.
+	defaultEjectFor = 30 * time.Second
+	// latencyWeight is the weight of the latest call in the moving average of a
+	// backend's latency.
+	latencyWeight = 0.3
+)
+
+// Ensure Router implements the backend interfaces.
+var (
+	_ Backend  = (*Router)(nil)
+	_ Streamer = (*Router)(nil)
+)
+
+// RoutingStrategy selects the order in which a Router tries its backends.
+type RoutingStrategy int
+
+const (
+	// RouteFallback always tries the backends in the order they were given, so
+	// later backends only serve calls the earlier ones failed.
+	RouteFallback RoutingStrategy = iota
+	// RouteRoundRobin starts each call at the next backend in turn, spreading
+	// calls evenly.
+	RouteRoundRobin
+	// RouteLeastLatency starts each call at the backend with the lowest average
+	// latency. Backends that have not answered yet are tried first.
+	RouteLeastLatency
+)
+
+// RouterOption represents an option for NewRouter.
+type RouterOption func(*Router)
+
+// WithRoutingStrategy sets the order in which backends are tried. It defaults to RouteFallback.
+func WithRoutingStrategy(strategy RoutingStrategy) RouterOption {
+	return func(r *Router) {
+		r.strategy = strategy
+	}
+}
+
+// WithFallbackOn sets the function that decides whether a failed call is tried
+// on the next backend. It defaults to ShouldFallback.
+func WithFallbackOn(shouldFallback func(err error) bool) RouterOption {
+	return func(r *Router) {
+		r.shouldFallback = shouldFallback
+	}
+}
+
+// WithEjection sets after how many consecutive failures a backend is ejected,
+// and for how long. It defaults to 3 failures and 30 seconds.
+func WithEjection(failures int, duration time.Duration) RouterOption {
+	return func(r *Router) {
+		r.ejectAfter = failures
+		r.ejectFor = duration
+	}
+}
+
+// ShouldFallback reports whether a call that failed with err may succeed on
+// another backend: the backend is unavailable, rate limited, unreachable or
+// timed out, or does not have the model. Errors caused by the request itself, such as an
+// exceeded context length or a content filter, and cancellation of the caller's
+// context are returned to the caller.
+func ShouldFallback(err error) bool {
+	var notFound *ModelNotFoundError
+	return IsRetryable(err) || errors.As(err, &notFound)
+}
+
+// Router is a backend that spreads calls over several backends, falling back to
+// the next one when a call fails in a way ShouldFallback accepts.
+//
+// Backends that fail repeatedly are ejected: they are tried last for a while,
+// when all healthy ones have failed. Then a single call is sent first as a
+// probe, while concurrent calls still try the backend last. If the probe
+// succeeds the backend is healthy again, otherwise it is ejected once more.
+//
+// All backends of a router that embeds must use the same embedding model, or
+// the vectors they return cannot be compared. Routers created with
+// NewGeneratorRouter or NewEmbedderRouter fail the calls their backends do not
+// support.
+type Router struct {
+	mu             sync.Mutex
+	targets        []*routeTarget
+	strategy       RoutingStrategy
+	shouldFallback func(err error) bool
+	ejectAfter     int
+	ejectFor       time.Duration
+	next           int
+	now            func() time.Time
+}
+
+// routeTarget is a backend of a router and its health. Generator or embedder is
+// nil if the backend does not support it.
+type routeTarget struct {
+	generator    Generator
+	embedder     Embedder
+	failures     int
+	ejectedUntil time.Time
+	probing      bool
+	latency      time.Duration
+}
+
+// NewRouter creates a router over the given backends.
+//
+// Parameters:
+//   - backends: The backends to route calls to, in order of preference for RouteFallback.
+//   - opts: Options setting the strategy, the fallback errors and ejection.
+//
+// Returns:
+//   - A pointer to a new Router instance.
+//   - An error if no backends are given.
+func NewRouter(backends []Backend, opts ...RouterOption) (*Router, error) {
+	targets := make([]*routeTarget, len(backends))
+	for i, b := range backends {
+		targets[i] = &routeTarget{generator: b, embedder: b}
+	}
+	return newRouter(targets, opts)
+}
+
+// NewGeneratorRouter creates a router over backends that only generate, such as
+// AnthropicBackend. Its embedding calls fail.
+//
+// Parameters:
+//   - generators: The backends to route calls to, in order of preference for RouteFallback.
+//   - opts: Options setting the strategy, the fallback errors and ejection.
+//
+// Returns:
+//   - A pointer to a new Router instance.
+//   - An error if no backends are given.
+func NewGeneratorRouter(generators []Generator, opts ...RouterOption) (*Router, error) {
+	targets := make([]*routeTarget, len(generators))
+	for i, g := range generators {
+		targets[i] = &routeTarget{generator: g}
+	}
+	return newRouter(targets, opts)
+}
+
+// NewEmbedderRouter creates a router over backends that only embed, such as
+// TEIBackend. Its generation calls fail.
+//
+// Parameters:
+//   - embedders: The backends to route calls to, in order of preference for RouteFallback.
+//   - opts: Options setting the strategy, the fallback errors and ejection.
+//
+// Returns:
+//   - A pointer to a new Router instance.
+//   - An error if no backends are given.
+func NewEmbedderRouter(embedders []Embedder, opts ...RouterOption) (*Router, error) {
+	targets := make([]*routeTarget, len(embedders))
+	for i, e := range embedders {
+		targets[i] = &routeTarget{embedder: e}
+	}
+	return newRouter(targets, opts)
+}
+
+func newRouter(targets []*routeTarget, opts []RouterOption) (*Router, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("router needs at least one backend")
+	}
+	r := &Router{
+		strategy:       RouteFallback,
+		shouldFallback: ShouldFallback,
+		ejectAfter:     defaultEjectAfter,
+		ejectFor:       defaultEjectFor,
+		now:            time.Now,
+		targets:        targets,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r, nil
+}
+
+// Generate generates a response to the prompt on the first backend that succeeds.
+func (r *Router) Generate(ctx context.Context, prompt *Prompt) (string, error) {
+	return route(ctx, r, func(t *routeTarget) (string, error) {
+		if t.generator == nil {
+			return "", errNoGeneration
+		}
+		return t.generator.Generate(ctx, prompt)
+	})
+}
+
+// GenerateWithResult generates a response to the prompt on the first backend that succeeds.
+func (r *Router) GenerateWithResult(ctx context.Context, prompt *Prompt) (*GenerateResult, error) {
+	return route(ctx, r, func(t *routeTarget) (*GenerateResult, error) {
+		if t.generator == nil {
+			return nil, errNoGeneration
+		}
+		return t.generator.GenerateWithResult(ctx, prompt)
+	})
+}
+
+// GenerateStream starts streaming a response on the first backend that succeeds
+// in starting the stream. Errors in the middle of a stream are not retried.
+// Backends that do not implement Streamer are skipped.
+func (r *Router) GenerateStream(ctx context.Context, prompt *Prompt) (<-chan StreamChunk, error) {
+	return route(ctx, r, func(t *routeTarget) (<-chan StreamChunk, error) {
+		streamer, ok := t.generator.(Streamer)
+		if !ok {
+			return nil, errNoStreaming
+		}
+		return streamer.GenerateStream(ctx, prompt)
+	})
+}
+
+// Embed embeds the input on the first backend that succeeds.
+func (r *Router) Embed(ctx context.Context, input string) ([]float32, error) {
+	return route(ctx, r, func(t *routeTarget) ([]float32, error) {
+		if t.embedder == nil {
+			return nil, errNoEmbedding
+		}
+		return t.embedder.Embed(ctx, input)
+	})
+}
+
+// EmbedBatch embeds the inputs on the first backend that succeeds.
+func (r *Router) EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	return route(ctx, r, func(t *routeTarget) ([][]float32, error) {
+		if t.embedder == nil {
+			return nil, errNoEmbedding
+		}
+		return t.embedder.EmbedBatch(ctx, inputs)
+	})
+}
+
+// Errors reported for backends that do not support a call. They are never sent
+// the call, so they count neither as failures nor as successes.
+var (
+	errNoGeneration = errors.New("backend does not support generation")
+	errNoEmbedding  = errors.New("backend does not support embedding")
+	errNoStreaming  = errors.New("backend does not support streaming")
+)
+
+// unsupported reports whether err is the error of a backend that does not
+// support a call.
+func unsupported(err error) bool {
+	return errors.Is(err, errNoGeneration) || errors.Is(err, errNoEmbedding) || errors.Is(err, errNoStreaming)
+}
+
+// route calls the backends of r in the order of its strategy until one succeeds
+// or fails with an error that should not fall back.
+func route[T any](ctx context.Context, r *Router, call func(t *routeTarget) (T, error)) (T, error) {
+	var zero T
+	var errs []error
+	for _, target := range r.candidates() {
+		probe := r.startProbe(target)
+		start := r.now()
+		result, err := call(target)
+		r.record(ctx, target, probe, err, r.now().Sub(start))
+		if err == nil {
+			return result, nil
+		}
+		if !unsupported(err) && (ctx.Err() != nil || !r.shouldFallback(err)) {
+			return zero, err
+		}
+		errs = append(errs, err)
+	}
+	return zero, fmt.Errorf("all backends failed: %w", errors.Join(errs...))
+}
+
+// candidates returns the targets in the order of the strategy, with ejected
+// targets and targets being probed by another call moved to the end.
+func (r *Router) candidates() []*routeTarget {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ordered := make([]*routeTarget, 0, len(r.targets))
+	switch r.strategy {
+	case RouteRoundRobin:
+		start := r.next % len(r.targets)
+		r.next++
+		ordered = append(ordered, r.targets[start:]...)
+		ordered = append(ordered, r.targets[:start]...)
+	case RouteLeastLatency:
+		ordered = append(ordered, r.targets...)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].latency < ordered[j].latency
+		})
+	default:
+		ordered = append(ordered, r.targets...)
+	}
+
+	now := r.now()
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return !ordered[i].deferred(now) && ordered[j].deferred(now)
+	})
+	return ordered
+}
+
+// startProbe reports whether a call to target is its probe: the ejection of the
+// target has elapsed and no other call is probing it.
+func (r *Router) startProbe(target *routeTarget) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if target.ejectedUntil.IsZero() || target.ejected(r.now()) || target.probing {
+		return false
+	}
+	target.probing = true
+	return true
+}
+
+// record updates the health of target with the outcome of a call made with ctx.
+func (r *Router) record(ctx context.Context, target *routeTarget, probe bool, err error, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if probe {
+		target.probing = false
+	}
+
+	switch {
+	case err == nil:
+		if target.latency == 0 {
+			target.latency = latency
+		} else {
+			target.latency += time.Duration(latencyWeight * float64(latency-target.latency))
+		}
+		target.failures = 0
+		target.ejectedUntil = time.Time{}
+	case unsupported(err), ctx.Err() != nil:
+		// The call was not sent, or the caller gave up; this says nothing about
+		// the backend. A timeout of the backend's own does count as a failure.
+	case !r.shouldFallback(err):
+		// The backend answered, so it is healthy even though the request failed.
+		target.failures = 0
+		target.ejectedUntil = time.Time{}
+	default:
+		target.failures++
+		if probe || (r.ejectAfter > 0 && target.failures >= r.ejectAfter) {
+			target.ejectedUntil = r.now().Add(r.ejectFor)
+		}
+	}
+}
+
+// ejected reports whether the target is ejected and not yet due for a probe.
+func (t *routeTarget) ejected(now time.Time) bool {
+	return now.Before(t.ejectedUntil)
+}
+
+// deferred reports whether the target should be tried after the others.
+func (t *routeTarget) deferred(now time.Time) bool {
+	return t.ejected(now) || t.probing
+}
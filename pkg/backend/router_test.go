@@ -0,0 +1,304 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errUnavailable = &ServerUnavailableError{APIError: APIError{Provider: providerOpenAI, StatusCode: 503}}
+
+// slowBackend is a stubBackend whose generations take delay on the clock of a test.
+type slowBackend struct {
+	*stubBackend
+	delay   time.Duration
+	advance func(d time.Duration)
+}
+
+func (b *slowBackend) Generate(ctx context.Context, prompt *Prompt) (string, error) {
+	b.advance(b.delay)
+	return b.stubBackend.Generate(ctx, prompt)
+}
+
+// gatedBackend is a lockedBackend whose generations wait for release, after
+// announcing themselves on entered.
+type gatedBackend struct {
+	*lockedBackend
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *gatedBackend) Generate(ctx context.Context, prompt *Prompt) (string, error) {
+	b.entered <- struct{}{}
+	<-b.release
+	return b.lockedBackend.Generate(ctx, prompt)
+}
+
+// routerClock sets the clock of r to one that only moves when advanced.
+func routerClock(r *Router) func(d time.Duration) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+	return func(d time.Duration) { now = now.Add(d) }
+}
+
+func newTestRouter(t *testing.T, backends []Backend, opts ...RouterOption) *Router {
+	t.Helper()
+	router, err := NewRouter(backends, opts...)
+	if err != nil {
+		t.Fatalf("NewRouter returned error: %v", err)
+	}
+	return router
+}
+
+func TestRouterFallback(t *testing.T) {
+	t.Parallel()
+	primary := &stubBackend{stubGenerator: stubGenerator{err: errUnavailable}}
+	secondary := &stubBackend{stubGenerator: stubGenerator{response: "from secondary"}}
+	router := newTestRouter(t, []Backend{primary, secondary})
+
+	response, err := router.Generate(context.Background(), NewPrompt().AddMessage("user", "Hi"))
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if response != "from secondary" {
+		t.Errorf("Expected the secondary to answer, got %q", response)
+	}
+
+	filtered := &ContentFilterError{APIError: APIError{Provider: providerOpenAI, StatusCode: 400}}
+	primary.err = filtered
+	if _, err := router.Generate(context.Background(), NewPrompt().AddMessage("user", "Hi")); !errors.Is(err, filtered) {
+		t.Errorf("Expected the content filter error without fallback, got %v", err)
+	}
+	if len(secondary.prompts) != 1 {
+		t.Errorf("Expected the secondary to be called once, got %d", len(secondary.prompts))
+	}
+
+	secondary.err = errUnavailable
+	primary.err = errUnavailable
+	_, err = router.Generate(context.Background(), NewPrompt().AddMessage("user", "Hi"))
+	var unavailable *ServerUnavailableError
+	if !errors.As(err, &unavailable) {
+		t.Errorf("Expected the errors of all backends, got %v", err)
+	}
+}
+
+func TestRouterRoundRobin(t *testing.T) {
+	t.Parallel()
+	backends := []*stubBackend{{}, {}, {}}
+	router := newTestRouter(t, []Backend{backends[0], backends[1], backends[2]}, WithRoutingStrategy(RouteRoundRobin))
+
+	for i := 0; i < 6; i++ {
+		if _, err := router.Embed(context.Background(), "chunk"); err != nil {
+			t.Fatalf("Embed returned error: %v", err)
+		}
+	}
+	for i, b := range backends {
+		if len(b.inputs) != 2 {
+			t.Errorf("Expected backend %d to embed 2 inputs, got %d", i, len(b.inputs))
+		}
+	}
+}
+
+func TestRouterLeastLatency(t *testing.T) {
+	t.Parallel()
+	slow := &slowBackend{stubBackend: &stubBackend{}, delay: time.Second}
+	fast := &slowBackend{stubBackend: &stubBackend{}, delay: 100 * time.Millisecond}
+	router := newTestRouter(t, []Backend{slow, fast}, WithRoutingStrategy(RouteLeastLatency))
+	advance := routerClock(router)
+	slow.advance, fast.advance = advance, advance
+
+	for i := 0; i < 5; i++ {
+		if _, err := router.Generate(context.Background(), NewPrompt().AddMessage("user", "Hi")); err != nil {
+			t.Fatalf("Generate returned error: %v", err)
+		}
+	}
+	// Both are tried once while their latency is unknown, then the fast one wins.
+	if len(slow.prompts) != 1 || len(fast.prompts) != 4 {
+		t.Errorf("Expected 1 slow and 4 fast calls, got %d and %d", len(slow.prompts), len(fast.prompts))
+	}
+}
+
+func TestRouterEjectionAndProbe(t *testing.T) {
+	t.Parallel()
+	primary := &stubBackend{stubGenerator: stubGenerator{err: errUnavailable}}
+	secondary := &stubBackend{stubGenerator: stubGenerator{response: "from secondary"}}
+	router := newTestRouter(t, []Backend{primary, secondary}, WithEjection(2, time.Minute))
+	advance := routerClock(router)
+	generate := func() string {
+		response, err := router.Generate(context.Background(), NewPrompt().AddMessage("user", "Hi"))
+		if err != nil {
+			t.Fatalf("Generate returned error: %v", err)
+		}
+		return response
+	}
+
+	generate()
+	generate()
+	generate()
+	if len(primary.prompts) != 2 {
+		t.Errorf("Expected the primary to be ejected after 2 failures, got %d calls", len(primary.prompts))
+	}
+
+	advance(time.Minute)
+	generate()
+	if len(primary.prompts) != 3 {
+		t.Errorf("Expected a probe after the ejection elapsed, got %d calls", len(primary.prompts))
+	}
+	generate()
+	if len(primary.prompts) != 3 {
+		t.Errorf("Expected a failed probe to eject the primary again, got %d calls", len(primary.prompts))
+	}
+
+	advance(time.Minute)
+	primary.err = nil
+	primary.response = "from primary"
+	if response := generate(); response != "from primary" {
+		t.Errorf("Expected the recovered primary to answer, got %q", response)
+	}
+	if response := generate(); response != "from primary" {
+		t.Errorf("Expected the primary to stay healthy, got %q", response)
+	}
+}
+
+func TestRouterConcurrentProbe(t *testing.T) {
+	t.Parallel()
+	primary := &lockedBackend{stubBackend: stubBackend{stubGenerator: stubGenerator{err: errUnavailable}}}
+	secondary := &lockedBackend{stubBackend: stubBackend{stubGenerator: stubGenerator{err: errUnavailable}}}
+	gated := &gatedBackend{lockedBackend: primary, entered: make(chan struct{}, 1), release: make(chan struct{})}
+	router := newTestRouter(t, []Backend{gated, secondary}, WithEjection(1, time.Minute))
+	advance := routerClock(router)
+
+	close(gated.release)
+	if _, err := router.Generate(context.Background(), NewPrompt().AddMessage("user", "Hi")); err == nil {
+		t.Fatalf("Expected an error while both backends fail")
+	}
+	<-gated.entered
+
+	primary.err = nil
+	primary.response = "from primary"
+	gated.release = make(chan struct{})
+	advance(time.Minute)
+
+	// The first call probes the primary; the second tries it last instead of
+	// skipping it while the probe is in flight.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := router.Generate(context.Background(), NewPrompt().AddMessage("user", "Hi"))
+			if err != nil {
+				t.Errorf("Generate returned error: %v", err)
+			} else if response != "from primary" {
+				t.Errorf("Expected the primary to answer, got %q", response)
+			}
+		}()
+		select {
+		case <-gated.entered:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected call %d to reach the primary", i+1)
+		}
+	}
+	close(gated.release)
+	wg.Wait()
+	if router.targets[0].probing || !router.targets[0].ejectedUntil.IsZero() {
+		t.Errorf("Expected the primary to be healthy after the probe")
+	}
+}
+
+func TestRouterTimeouts(t *testing.T) {
+	t.Parallel()
+	// The backend's own client timeout fired, while the caller's context is live.
+	timedOut := fmt.Errorf("failed to send request: %w", context.DeadlineExceeded)
+	primary := &stubBackend{stubGenerator: stubGenerator{err: timedOut}}
+	secondary := &stubBackend{stubGenerator: stubGenerator{response: "from secondary"}}
+	router := newTestRouter(t, []Backend{primary, secondary}, WithEjection(2, time.Minute))
+	routerClock(router)
+
+	for i := 0; i < 3; i++ {
+		response, err := router.Generate(context.Background(), NewPrompt().AddMessage("user", "Hi"))
+		if err != nil {
+			t.Fatalf("Generate returned error: %v", err)
+		}
+		if response != "from secondary" {
+			t.Errorf("Expected a timeout to fall back to the secondary, got %q", response)
+		}
+	}
+	if len(primary.prompts) != 2 {
+		t.Errorf("Expected the timing out primary to be ejected after 2 failures, got %d calls", len(primary.prompts))
+	}
+
+	// A caller that gave up says nothing about the backend.
+	caller := newTestRouter(t, []Backend{primary}, WithEjection(1, time.Minute))
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	primary.err = ctx.Err()
+	if _, err := caller.Generate(ctx, NewPrompt().AddMessage("user", "Hi")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the caller's deadline, got %v", err)
+	}
+	if failures := caller.targets[0].failures; failures != 0 {
+		t.Errorf("Expected the caller's deadline not to count as a failure, got %d", failures)
+	}
+}
+
+func TestRouterOverGeneratorsAndEmbedders(t *testing.T) {
+	t.Parallel()
+	primary := &stubGenerator{err: errUnavailable}
+	secondary := &stubGenerator{response: "from secondary"}
+	generators, err := NewGeneratorRouter([]Generator{primary, secondary, &AnthropicBackend{}})
+	if err != nil {
+		t.Fatalf("NewGeneratorRouter returned error: %v", err)
+	}
+	response, err := generators.Generate(context.Background(), NewPrompt().AddMessage("user", "Hi"))
+	if err != nil || response != "from secondary" {
+		t.Errorf("Expected the secondary to answer, got %q, %v", response, err)
+	}
+	if _, err := generators.Embed(context.Background(), "chunk"); !errors.Is(err, errNoEmbedding) {
+		t.Errorf("Expected %v, got %v", errNoEmbedding, err)
+	}
+
+	inner := &stubBackend{}
+	embedders, err := NewEmbedderRouter([]Embedder{struct{ Embedder }{inner}})
+	if err != nil {
+		t.Fatalf("NewEmbedderRouter returned error: %v", err)
+	}
+	if _, err := embedders.EmbedBatch(context.Background(), []string{"a", "b"}); err != nil {
+		t.Fatalf("EmbedBatch returned error: %v", err)
+	}
+	if len(inner.inputs) != 2 {
+		t.Errorf("Expected 2 inputs to be embedded, got %d", len(inner.inputs))
+	}
+	if _, err := embedders.Generate(context.Background(), NewPrompt()); !errors.Is(err, errNoGeneration) {
+		t.Errorf("Expected %v, got %v", errNoGeneration, err)
+	}
+	if embedders.targets[0].failures != 0 {
+		t.Errorf("Expected an unsupported call not to count as a failure")
+	}
+}
+
+func TestRouterStreamSkipsNonStreamers(t *testing.T) {
+	t.Parallel()
+	router := newTestRouter(t, []Backend{&stubBackend{}})
+	if _, err := router.GenerateStream(context.Background(), NewPrompt()); err == nil {
+		t.Errorf("Expected an error when no backend can stream")
+	}
+	if _, err := NewRouter(nil); err == nil {
+		t.Errorf("Expected an error for a router without backends")
+	}
+}
@@ -0,0 +1,369 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// JSONSchemaFor derives a JSON Schema describing the JSON encoding of T.
+//
+// Struct fields are named after their json tags and are required unless tagged
+// with omitempty. Pointer fields additionally accept null, also when they have an
+// enum. Two extra struct tags
+// are understood:
+//   - description:"..." documents the field for the model.
+//   - enum:"a,b,c" restricts the field to the listed values.
+//
+// The resulting schema is also suitable for Tool.Parameters.
+func JSONSchemaFor[T any]() (map[string]interface{}, error) {
+	schema, _, err := buildSchema(reflect.TypeOf((*T)(nil)).Elem())
+	return schema, err
+}
+
+// buildSchema derives the JSON Schema for t. The boolean result reports whether the
+// schema satisfies the constraints of OpenAI's strict mode: the root is an object,
+// every object property is required and no object allows arbitrary keys.
+func buildSchema(t reflect.Type) (map[string]interface{}, bool, error) {
+	b := &schemaBuilder{strict: true, seen: map[reflect.Type]bool{}}
+	schema, err := b.build(t)
+	if err != nil {
+		return nil, false, err
+	}
+	return schema, b.strict && schema["type"] == "object", nil
+}
+
+type schemaBuilder struct {
+	strict bool
+	seen   map[reflect.Type]bool
+}
+
+func (b *schemaBuilder) build(t reflect.Type) (map[string]interface{}, error) {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema, err := b.build(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		if typ, ok := schema["type"].(string); ok {
+			schema["type"] = []interface{}{typ, "null"}
+		}
+		return schema, nil
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}, nil
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}, nil
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}, nil
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// []byte is encoded as a base64 string
+			return map[string]interface{}{"type": "string"}, nil
+		}
+		items, err := b.build(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "array", "items": items}, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("unsupported map key type %s", t.Key())
+		}
+		b.strict = false
+		values, err := b.build(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "object", "additionalProperties": values}, nil
+	case reflect.Interface:
+		b.strict = false
+		return map[string]interface{}{}, nil
+	case reflect.Struct:
+		return b.buildStruct(t)
+	default:
+		return nil, fmt.Errorf("unsupported type %s", t)
+	}
+}
+
+func (b *schemaBuilder) buildStruct(t reflect.Type) (map[string]interface{}, error) {
+	if b.seen[t] {
+		return nil, fmt.Errorf("recursive type %s is not supported", t)
+	}
+	b.seen[t] = true
+	defer delete(b.seen, t)
+
+	properties := map[string]interface{}{}
+	required := []string{}
+	if err := b.addFields(t, properties, &required); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}, nil
+}
+
+func (b *schemaBuilder) addFields(t reflect.Type, properties map[string]interface{}, required *[]string) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		// Flatten embedded structs without a json name, as encoding/json does
+		if field.Anonymous && name == "" {
+			ft := field.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if err := b.addFields(ft, properties, required); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema, err := b.build(field.Type)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		if description := field.Tag.Get("description"); description != "" {
+			schema["description"] = description
+		}
+		if enum := field.Tag.Get("enum"); enum != "" {
+			values, err := enumValues(field.Type, enum)
+			if err != nil {
+				return fmt.Errorf("field %s: %w", field.Name, err)
+			}
+			if field.Type.Kind() == reflect.Ptr {
+				values = append(values, nil)
+			}
+			schema["enum"] = values
+		}
+
+		properties[name] = schema
+		if strings.Contains(opts, "omitempty") {
+			b.strict = false
+		} else {
+			*required = append(*required, name)
+		}
+	}
+	return nil
+}
+
+// enumValues parses the comma separated values of an enum tag according to the field type.
+func enumValues(t reflect.Type, tag string) ([]interface{}, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var values []interface{}
+	for _, raw := range strings.Split(tag, ",") {
+		raw = strings.TrimSpace(raw)
+		switch t.Kind() {
+		case reflect.String:
+			values = append(values, raw)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid integer enum value %q", raw)
+			}
+			values = append(values, n)
+		default:
+			return nil, fmt.Errorf("enum is not supported for type %s", t)
+		}
+	}
+	return values, nil
+}
+
+// validateSchema checks a decoded JSON value against the subset of JSON Schema
+// produced by buildSchema. The returned error describes the first violation found
+// and is meant to be read by the model when asking it to correct its output.
+func validateSchema(value interface{}, schema map[string]interface{}, path string) error {
+	if !matchesType(value, schema["type"]) {
+		return fmt.Errorf("%s: expected %s, got %s", path, typeNames(schema["type"]), jsonTypeOf(value))
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok && !enumAllows(enum, value) {
+		return fmt.Errorf("%s: value %v is not one of %v", path, value, enum)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		if required, ok := schema["required"].([]string); ok {
+			for _, name := range required {
+				if _, ok := v[name]; !ok {
+					return fmt.Errorf("%s: missing required property %q", path, name)
+				}
+			}
+		}
+
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			propertyPath := path + "." + key
+			if propertySchema, ok := properties[key].(map[string]interface{}); ok {
+				if err := validateSchema(v[key], propertySchema, propertyPath); err != nil {
+					return err
+				}
+				continue
+			}
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					return fmt.Errorf("%s: unexpected property", propertyPath)
+				}
+			case map[string]interface{}:
+				if err := validateSchema(v[key], additional, propertyPath); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := validateSchema(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// enumAllows reports whether value is one of the values of enum.
+func enumAllows(enum []interface{}, value interface{}) bool {
+	for _, e := range enum {
+		if e == nil || value == nil {
+			if e == value {
+				return true
+			}
+			continue
+		}
+		if fmt.Sprint(e) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesType reports whether value is of the given JSON Schema type, which may be
+// absent, a single type name or a list of type names.
+func matchesType(value interface{}, typ interface{}) bool {
+	switch t := typ.(type) {
+	case nil:
+		return true
+	case string:
+		return matchesTypeName(value, t)
+	case []interface{}:
+		for _, name := range t {
+			if s, ok := name.(string); ok && matchesTypeName(value, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchesTypeName(value interface{}, name string) bool {
+	switch name {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "null":
+		return value == nil
+	default:
+		return false
+	}
+}
+
+func typeNames(typ interface{}) string {
+	if names, ok := typ.([]interface{}); ok {
+		parts := make([]string, 0, len(names))
+		for _, name := range names {
+			parts = append(parts, fmt.Sprint(name))
+		}
+		return strings.Join(parts, " or ")
+	}
+	return fmt.Sprint(typ)
+}
+
+func jsonTypeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64, json.Number:
+		return "number"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
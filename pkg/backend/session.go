@@ -0,0 +1,269 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// messageOverheadTokens approximates the tokens a chat format spends on the
+	// role and delimiters of every message.
+	messageOverheadTokens = 4
+
+	summarizerInstructions = "Summarize the conversation below for an assistant that will continue it. " +
+		"Keep facts, names, numbers, decisions and open questions. Reply with the summary only."
+	summaryPrefix = "Summary of the earlier conversation:\n"
+)
+
+// TokenCounter returns the number of tokens in text.
+type TokenCounter func(text string) int
+
+// EstimateTokens approximates the number of tokens in text at four characters
+// per token, which is close for English text with most tokenizers.
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// ChatSession keeps the message history of a multi-turn conversation within a
+// token budget.
+//
+// The system prompt is always kept. When the history exceeds MaxTokens the
+// oldest turns are dropped, or, if a Summarizer is set, condensed into a running
+// summary that is sent after the system prompt. A turn is a user message with
+// the replies and tool results that follow it, so tool calls are never separated
+// from their results. The latest turn is always kept, even if it alone exceeds
+// the budget.
+//
+// A ChatSession can be persisted with encoding/json; Counter and Summarizer are
+// not serialized and must be set again after decoding. It is not safe for
+// concurrent use.
+type ChatSession struct {
+	SystemPrompt string `json:"system_prompt,omitempty"`
+	// MaxTokens is the token budget of the prompt, including the system prompt
+	// and summary. If zero, the history is never trimmed.
+	MaxTokens int `json:"max_tokens,omitempty"`
+	// Parameters are the generation parameters of the prompts built by the session.
+	Parameters Parameters `json:"parameters"`
+	// Summary condenses the turns that no longer fit in the budget.
+	Summary string `json:"summary,omitempty"`
+	// Messages is the history of the conversation, oldest first, without the system prompt.
+	Messages []Message `json:"messages"`
+
+	// Counter counts the tokens of a message. If nil, EstimateTokens is used.
+	Counter TokenCounter `json:"-"`
+	// Summarizer condenses trimmed turns into Summary. If nil, they are dropped.
+	Summarizer Generator `json:"-"`
+	// SummaryMaxTokens bounds the length of the summary. If zero, a quarter of
+	// MaxTokens is used.
+	SummaryMaxTokens int `json:"summary_max_tokens,omitempty"`
+}
+
+// NewChatSession creates a new ChatSession with the given system prompt and
+// token budget.
+func NewChatSession(systemPrompt string, maxTokens int) *ChatSession {
+	return &ChatSession{SystemPrompt: systemPrompt, MaxTokens: maxTokens}
+}
+
+// AddMessage adds a message with a specific role to the history.
+func (s *ChatSession) AddMessage(role, content string) *ChatSession {
+	s.Messages = append(s.Messages, Message{Role: role, Content: content})
+	return s
+}
+
+// AppendMessage appends a complete message to the history, such as an assistant
+// reply carrying tool calls or a multimodal user message.
+func (s *ChatSession) AppendMessage(message Message) *ChatSession {
+	s.Messages = append(s.Messages, message)
+	return s
+}
+
+// Prompt fits the history into the token budget, summarizing or dropping the
+// oldest turns as needed, and returns a prompt with the system prompt, summary
+// and remaining history.
+//
+// Parameters:
+//   - ctx: The context for the summarizer requests, which can be used for cancellation.
+//
+// Returns:
+//   - A new prompt for the conversation.
+//   - An error if summarizing the trimmed turns fails; the history is then left unchanged.
+func (s *ChatSession) Prompt(ctx context.Context) (*Prompt, error) {
+	if err := s.compact(ctx); err != nil {
+		return nil, err
+	}
+
+	prompt := NewPrompt().SetParameters(s.Parameters)
+	if s.SystemPrompt != "" {
+		prompt.AddMessage("system", s.SystemPrompt)
+	}
+	if s.Summary != "" {
+		prompt.AddMessage("system", summaryPrefix+s.Summary)
+	}
+	prompt.Messages = append(prompt.Messages, s.Messages...)
+	return prompt, nil
+}
+
+// Send adds a user message to the history, generates the reply with g and adds
+// it to the history as well. If generation fails, the user message is removed
+// again so the call can be retried.
+//
+// Parameters:
+//   - ctx: The context for the API requests, which can be used for cancellation.
+//   - g: The backend used to generate the reply.
+//   - content: The user's message.
+//
+// Returns:
+//   - The result of the generation, whose Message has been added to the history.
+//   - An error if summarizing the history or generating the reply fails.
+func (s *ChatSession) Send(ctx context.Context, g Generator, content string) (*GenerateResult, error) {
+	s.AddMessage("user", content)
+
+	prompt, err := s.Prompt(ctx)
+	if err != nil {
+		s.Messages = s.Messages[:len(s.Messages)-1]
+		return nil, err
+	}
+	result, err := g.GenerateWithResult(ctx, prompt)
+	if err != nil {
+		s.Messages = s.Messages[:len(s.Messages)-1]
+		return nil, err
+	}
+
+	s.AppendMessage(result.Message)
+	return result, nil
+}
+
+// Tokens returns the number of tokens the prompt of the session currently takes.
+func (s *ChatSession) Tokens() int {
+	total := 0
+	if s.SystemPrompt != "" {
+		total += s.countMessage(Message{Content: s.SystemPrompt})
+	}
+	if s.Summary != "" {
+		total += s.countMessage(Message{Content: summaryPrefix + s.Summary})
+	}
+	for _, message := range s.Messages {
+		total += s.countMessage(message)
+	}
+	return total
+}
+
+// compact drops or summarizes the oldest turns until the history fits in the budget.
+func (s *ChatSession) compact(ctx context.Context) error {
+	if s.MaxTokens <= 0 {
+		return nil
+	}
+	budget := s.MaxTokens
+	if s.Summarizer != nil {
+		// leave room for a summary that grows as more turns are folded into it
+		budget -= s.countMessage(Message{Content: summaryPrefix}) + s.summaryMaxTokens()
+		if s.Summary != "" {
+			budget += s.countMessage(Message{Content: summaryPrefix + s.Summary})
+		}
+	}
+
+	total := s.Tokens()
+	if total <= s.MaxTokens {
+		return nil
+	}
+
+	lastTurn := lastTurnStart(s.Messages)
+	cut := 0
+	for cut < lastTurn && total > budget {
+		end := nextTurnStart(s.Messages, cut)
+		for _, message := range s.Messages[cut:end] {
+			total -= s.countMessage(message)
+		}
+		cut = end
+	}
+	if cut == 0 {
+		return nil
+	}
+
+	if s.Summarizer != nil {
+		summary, err := s.summarize(ctx, s.Messages[:cut])
+		if err != nil {
+			return fmt.Errorf("failed to summarize conversation: %w", err)
+		}
+		s.Summary = summary
+	}
+	s.Messages = append([]Message(nil), s.Messages[cut:]...)
+	return nil
+}
+
+// summarize folds messages into the running summary using the summarizer.
+func (s *ChatSession) summarize(ctx context.Context, messages []Message) (string, error) {
+	var conversation strings.Builder
+	if s.Summary != "" {
+		fmt.Fprintf(&conversation, "%s\n\n", summaryPrefix+s.Summary)
+	}
+	conversation.WriteString("Conversation:\n")
+	for _, message := range messages {
+		text := message.Text()
+		for _, call := range message.ToolCalls {
+			text = strings.TrimSpace(fmt.Sprintf("%s\n[called %s with %s]", text, call.Function.Name, call.Function.Arguments))
+		}
+		fmt.Fprintf(&conversation, "%s: %s\n", message.Role, text)
+	}
+
+	prompt := NewPrompt().
+		AddMessage("system", summarizerInstructions).
+		AddMessage("user", conversation.String()).
+		SetParameters(Parameters{MaxTokens: s.summaryMaxTokens()})
+	summary, err := s.Summarizer.Generate(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(summary), nil
+}
+
+func (s *ChatSession) summaryMaxTokens() int {
+	if s.SummaryMaxTokens > 0 {
+		return s.SummaryMaxTokens
+	}
+	return s.MaxTokens / 4
+}
+
+func (s *ChatSession) countMessage(message Message) int {
+	counter := s.Counter
+	if counter == nil {
+		counter = EstimateTokens
+	}
+	return counter(message.Text()) + messageOverheadTokens
+}
+
+// nextTurnStart returns the index of the first user message after index i, or
+// len(messages) if there is none.
+func nextTurnStart(messages []Message, i int) int {
+	for i++; i < len(messages); i++ {
+		if messages[i].Role == "user" {
+			return i
+		}
+	}
+	return len(messages)
+}
+
+// lastTurnStart returns the index of the last user message, or 0 if there is none.
+func lastTurnStart(messages []Message) int {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return i
+		}
+	}
+	return 0
+}
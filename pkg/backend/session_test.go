@@ -0,0 +1,170 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// stubGenerator replies with a fixed response and records the prompts it receives.
+type stubGenerator struct {
+	response string
+	err      error
+	prompts  []*Prompt
+}
+
+func (g *stubGenerator) Generate(ctx context.Context, prompt *Prompt) (string, error) {
+	result, err := g.GenerateWithResult(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	return result.Content(), nil
+}
+
+func (g *stubGenerator) GenerateWithResult(_ context.Context, prompt *Prompt) (*GenerateResult, error) {
+	g.prompts = append(g.prompts, prompt.Clone())
+	if g.err != nil {
+		return nil, g.err
+	}
+	return &GenerateResult{Message: Message{Role: "assistant", Content: g.response}}, nil
+}
+
+// wordCounter counts one token per word, which keeps budgets in tests readable.
+func wordCounter(text string) int {
+	return len(strings.Fields(text))
+}
+
+func TestChatSessionTrimsOldestTurns(t *testing.T) {
+	t.Parallel()
+	// every message costs its words plus 4 tokens of overhead
+	session := NewChatSession("Be brief.", 30)
+	session.Counter = wordCounter
+	session.
+		AddMessage("user", "one two three").
+		AddMessage("assistant", "four five six").
+		AddMessage("user", "seven eight").
+		AddMessage("assistant", "nine").
+		AddMessage("user", "ten")
+
+	prompt, err := session.Prompt(context.Background())
+	if err != nil {
+		t.Fatalf("Prompt returned error: %v", err)
+	}
+
+	var contents []string
+	for _, message := range prompt.Messages {
+		contents = append(contents, message.Content)
+	}
+	expected := []string{"Be brief.", "seven eight", "nine", "ten"}
+	if strings.Join(contents, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected messages %q, got %q", expected, contents)
+	}
+	if tokens := session.Tokens(); tokens > 30 {
+		t.Errorf("Expected the session to fit in 30 tokens, got %d", tokens)
+	}
+}
+
+func TestChatSessionKeepsLatestTurn(t *testing.T) {
+	t.Parallel()
+	session := NewChatSession("Be brief.", 5)
+	session.Counter = wordCounter
+	session.AddMessage("user", "a question that is far longer than the budget allows")
+
+	prompt, err := session.Prompt(context.Background())
+	if err != nil {
+		t.Fatalf("Prompt returned error: %v", err)
+	}
+	if len(prompt.Messages) != 2 {
+		t.Errorf("Expected the system prompt and latest turn to be kept, got %+v", prompt.Messages)
+	}
+}
+
+func TestChatSessionSummarizes(t *testing.T) {
+	t.Parallel()
+	summarizer := &stubGenerator{response: "The user is planning a trip to Lisbon."}
+	session := NewChatSession("You are a travel agent.", 40)
+	session.Counter = wordCounter
+	session.Summarizer = summarizer
+	session.SummaryMaxTokens = 12
+	session.
+		AddMessage("user", "I want to visit Lisbon in May with my family").
+		AddMessage("assistant", "Lisbon is lovely in May, how many travellers?").
+		AddMessage("user", "Four of us")
+
+	chat := &stubGenerator{response: "Here are some hotels."}
+	result, err := session.Send(context.Background(), chat, "Which hotels do you recommend?")
+	if err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	if result.Content() != "Here are some hotels." {
+		t.Errorf("Unexpected reply: %q", result.Content())
+	}
+
+	if len(summarizer.prompts) != 1 ||
+		!strings.Contains(summarizer.prompts[0].Messages[1].Content, "user: I want to visit Lisbon") {
+		t.Fatalf("Expected the oldest turns to be summarized, got %+v", summarizer.prompts)
+	}
+	if session.Summary != "The user is planning a trip to Lisbon." {
+		t.Errorf("Unexpected summary: %q", session.Summary)
+	}
+
+	sent := chat.prompts[0].Messages
+	if len(sent) != 3 || sent[0].Content != "You are a travel agent." ||
+		sent[1].Content != summaryPrefix+session.Summary || sent[2].Content != "Which hotels do you recommend?" {
+		t.Errorf("Unexpected prompt: %+v", sent)
+	}
+	if last := session.Messages[len(session.Messages)-1]; last.Role != "assistant" || last.Content != "Here are some hotels." {
+		t.Errorf("Expected the reply to be added to the history, got %+v", last)
+	}
+}
+
+func TestChatSessionSendError(t *testing.T) {
+	t.Parallel()
+	session := NewChatSession("", 0).AddMessage("user", "Hi").AddMessage("assistant", "Hello!")
+	failure := errors.New("boom")
+
+	if _, err := session.Send(context.Background(), &stubGenerator{err: failure}, "How are you?"); !errors.Is(err, failure) {
+		t.Fatalf("Expected %v, got %v", failure, err)
+	}
+	if len(session.Messages) != 2 {
+		t.Errorf("Expected the failed user message to be removed, got %+v", session.Messages)
+	}
+}
+
+func TestChatSessionJSON(t *testing.T) {
+	t.Parallel()
+	session := NewChatSession("Be brief.", 1000)
+	session.Summary = "Earlier, the user asked about RAG."
+	session.Parameters = Parameters{Temperature: 0.2}
+	session.AddMessage("user", "What is an embedding?").AddMessage("assistant", "A vector.")
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		t.Fatalf("Marshal returned error: %v", err)
+	}
+	var restored ChatSession
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("Unmarshal returned error: %v", err)
+	}
+
+	if restored.SystemPrompt != session.SystemPrompt || restored.MaxTokens != session.MaxTokens ||
+		restored.Summary != session.Summary || restored.Parameters != session.Parameters ||
+		len(restored.Messages) != 2 || restored.Messages[1].Content != "A vector." {
+		t.Errorf("Expected %+v, got %+v", session, restored)
+	}
+}
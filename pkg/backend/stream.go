@@ -0,0 +1,89 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+)
+
+// maxStreamLineSize bounds the size of a single NDJSON or SSE line read from a stream.
+const maxStreamLineSize = 1024 * 1024
+
+// StreamChunk is a single piece of a streamed generation.
+//
+// Content holds the text delta produced since the previous chunk. The last chunk
+// of a successful stream has Done set to true. If the stream fails, the final
+// chunk carries the error in Err.
+type StreamChunk struct {
+	Content string
+	Done    bool
+	Err     error
+}
+
+// streamingClient returns a copy of client without an overall timeout, so that
+// long generations are bounded by the request context rather than cut off
+// mid-stream by http.Client.Timeout.
+func streamingClient(client *http.Client) *http.Client {
+	if client == nil {
+		return &http.Client{}
+	}
+	c := *client
+	c.Timeout = 0
+	return &c
+}
+
+// sendChunk delivers chunk on ch unless ctx is cancelled first. It reports
+// whether the chunk was delivered.
+func sendChunk(ctx context.Context, ch chan<- StreamChunk, chunk StreamChunk) bool {
+	select {
+	case ch <- chunk:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// scanLines calls fn for every non-empty line read from r until fn returns
+// false or the reader is exhausted.
+func scanLines(r io.Reader, fn func(line []byte) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLineSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if !fn(line) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// scanSSE calls fn with the payload of every "data:" field in a server-sent
+// events stream until fn returns false or the reader is exhausted. Other SSE
+// fields (event, id, retry) and comments are ignored.
+func scanSSE(r io.Reader, fn func(data []byte) bool) error {
+	return scanLines(r, func(line []byte) bool {
+		data, ok := bytes.CutPrefix(line, []byte("data:"))
+		if !ok {
+			return true
+		}
+		return fn(bytes.TrimSpace(data))
+	})
+}
@@ -0,0 +1,163 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const defaultRepairAttempts = 2
+
+// Validator can be implemented by the target type of GenerateInto to apply checks
+// beyond what the JSON Schema expresses. A validation error is fed back to the
+// model like a schema violation.
+type Validator interface {
+	Validate() error
+}
+
+// StructuredOption represents an option for GenerateInto.
+type StructuredOption func(*structuredConfig)
+
+type structuredConfig struct {
+	maxRepairs int
+	schemaName string
+}
+
+// WithMaxRepairAttempts sets how many times the model is asked to correct an invalid
+// response before GenerateInto gives up. The default is 2.
+func WithMaxRepairAttempts(attempts int) StructuredOption {
+	return func(c *structuredConfig) {
+		c.maxRepairs = attempts
+	}
+}
+
+// WithSchemaName sets the name the schema is sent under. It defaults to the name
+// of the target type.
+func WithSchemaName(name string) StructuredOption {
+	return func(c *structuredConfig) {
+		c.schemaName = name
+	}
+}
+
+// GenerateInto generates a response that is decoded directly into out.
+//
+// A JSON Schema is derived from T (see JSONSchemaFor) and attached to the prompt as
+// its ResponseFormat, so backends that support it constrain the model's output. The
+// reply is then validated against the schema, decoded into out and, if T implements
+// Validator, checked with Validate. When any of these steps fail the model is shown
+// its previous reply together with the error and asked to try again.
+//
+// The given prompt is not modified.
+//
+// Parameters:
+//   - ctx: The context for the API requests, which can be used for cancellation.
+//   - g: The backend used to generate the response.
+//   - prompt: A structured prompt describing the task.
+//   - out: The value the response is decoded into.
+//   - opts: Options controlling repair attempts and the schema name.
+//
+// Returns:
+//   - An error if generation fails or no valid response is produced within the allowed repair attempts.
+func GenerateInto[T any](ctx context.Context, g Generator, prompt *Prompt, out *T, opts ...StructuredOption) error {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+
+	config := structuredConfig{
+		maxRepairs: defaultRepairAttempts,
+		schemaName: t.Name(),
+	}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if config.schemaName == "" {
+		config.schemaName = "response"
+	}
+
+	schema, strict, err := buildSchema(t)
+	if err != nil {
+		return fmt.Errorf("failed to derive JSON schema: %w", err)
+	}
+
+	attempt := prompt.Clone()
+	attempt.ResponseFormat = &ResponseFormat{
+		Name:   config.schemaName,
+		Schema: schema,
+		Strict: strict,
+	}
+
+	var lastErr error
+	for i := 0; i <= config.maxRepairs; i++ {
+		response, err := g.Generate(ctx, attempt)
+		if err != nil {
+			return err
+		}
+
+		var value T
+		if lastErr = decodeStructured(response, schema, &value); lastErr == nil {
+			*out = value
+			return nil
+		}
+
+		attempt.AddMessage("assistant", response)
+		attempt.AddMessage("user", fmt.Sprintf(
+			"Your previous response was invalid: %v. "+
+				"Respond again with only a JSON value that matches the schema.", lastErr))
+	}
+
+	return fmt.Errorf("no valid response after %d attempts: %w", config.maxRepairs+1, lastErr)
+}
+
+// decodeStructured validates a model response against schema and decodes it into out.
+func decodeStructured(response string, schema map[string]interface{}, out interface{}) error {
+	data := []byte(stripCodeFence(response))
+
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("response is not valid JSON: %w", err)
+	}
+	if err := validateSchema(raw, schema, "$"); err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(out); err != nil {
+		return fmt.Errorf("response does not match the expected structure: %w", err)
+	}
+
+	if v, ok := out.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("response failed validation: %w", err)
+		}
+	}
+	return nil
+}
+
+// stripCodeFence removes a surrounding Markdown code fence, which some models add
+// around JSON even when asked not to.
+func stripCodeFence(s string) string {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "```") {
+		return s
+	}
+	if i := strings.Index(s, "\n"); i >= 0 {
+		s = s[i+1:]
+	}
+	s = strings.TrimSuffix(strings.TrimSpace(s), "```")
+	return strings.TrimSpace(s)
+}
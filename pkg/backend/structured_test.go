@@ -0,0 +1,207 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type classification struct {
+	Label      string   `json:"label" enum:"bug,feature,question" description:"The issue category"`
+	Confidence float64  `json:"confidence"`
+	Tags       []string `json:"tags"`
+	Note       *string  `json:"note"`
+}
+
+func TestJSONSchemaFor(t *testing.T) {
+	t.Parallel()
+	schema, err := JSONSchemaFor[classification]()
+	if err != nil {
+		t.Fatalf("JSONSchemaFor returned error: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"label": map[string]interface{}{
+				"type":        "string",
+				"description": "The issue category",
+				"enum":        []interface{}{"bug", "feature", "question"},
+			},
+			"confidence": map[string]interface{}{"type": "number"},
+			"tags": map[string]interface{}{
+				"type":  "array",
+				"items": map[string]interface{}{"type": "string"},
+			},
+			"note": map[string]interface{}{"type": []interface{}{"string", "null"}},
+		},
+		"required":             []string{"label", "confidence", "tags", "note"},
+		"additionalProperties": false,
+	}
+	if !reflect.DeepEqual(schema, expected) {
+		t.Errorf("Unexpected schema:\n got: %v\nwant: %v", schema, expected)
+	}
+}
+
+func TestJSONSchemaForNullableEnum(t *testing.T) {
+	t.Parallel()
+	type triage struct {
+		Priority *string `json:"priority" enum:"low,high"`
+	}
+	schema, strict, err := buildSchema(reflect.TypeOf(triage{}))
+	if err != nil {
+		t.Fatalf("buildSchema returned error: %v", err)
+	}
+	priority := schema["properties"].(map[string]interface{})["priority"].(map[string]interface{})
+	if expected := []interface{}{"low", "high", nil}; !reflect.DeepEqual(priority["enum"], expected) {
+		t.Errorf("Expected the enum %v, got %v", expected, priority["enum"])
+	}
+	if !strict {
+		t.Errorf("Expected the schema to be strict")
+	}
+	for _, value := range []interface{}{nil, "low"} {
+		if err := validateSchema(map[string]interface{}{"priority": value}, schema, "$"); err != nil {
+			t.Errorf("Expected %v to be valid, got %v", value, err)
+		}
+	}
+	if err := validateSchema(map[string]interface{}{"priority": "urgent"}, schema, "$"); err == nil {
+		t.Errorf("Expected a value outside the enum to be invalid")
+	}
+
+	if _, strict, err := buildSchema(reflect.TypeOf([]triage{})); err != nil || strict {
+		t.Errorf("Expected a non-object root not to be strict, got %v, %v", strict, err)
+	}
+}
+
+func TestGenerateIntoRetriesInvalidResponse(t *testing.T) {
+	t.Parallel()
+	replies := []string{
+		`{"label": "enhancement", "confidence": 0.9, "tags": [], "note": null}`,
+		"```json\n{\"label\": \"feature\", \"confidence\": 0.9, \"tags\": [\"ui\"], \"note\": null}\n```",
+	}
+
+	var mu sync.Mutex
+	var requests []map[string]interface{}
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+
+		mu.Lock()
+		reply := replies[len(requests)]
+		requests = append(requests, reqBody)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(Response{
+			Message: Message{Role: "assistant", Content: reply},
+			Done:    true,
+		}); err != nil {
+			t.Errorf("Failed to encode mock response: %v", err)
+		}
+	}))
+	defer mockServer.Close()
+
+	backend := &OllamaBackend{
+		Model:   "test-model",
+		Client:  mockServer.Client(),
+		BaseURL: mockServer.URL,
+	}
+
+	prompt := NewPrompt().AddMessage("user", "Classify: the button should be blue")
+
+	var out classification
+	if err := GenerateInto(context.Background(), backend, prompt, &out); err != nil {
+		t.Fatalf("GenerateInto returned error: %v", err)
+	}
+
+	if out.Label != "feature" || len(out.Tags) != 1 || out.Tags[0] != "ui" {
+		t.Errorf("Unexpected result: %+v", out)
+	}
+	if len(prompt.Messages) != 1 || prompt.ResponseFormat != nil {
+		t.Error("Expected the original prompt to be left untouched")
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(requests))
+	}
+	if format, ok := requests[0]["format"].(map[string]interface{}); !ok || format["type"] != "object" {
+		t.Errorf("Expected the schema to be sent as format, got %v", requests[0]["format"])
+	}
+
+	// The retry must show the model its invalid reply and the validation error
+	messages := requests[1]["messages"].([]interface{})
+	if len(messages) != 3 {
+		t.Fatalf("Expected 3 messages in the retry, got %d", len(messages))
+	}
+	feedback := messages[2].(map[string]interface{})["content"].(string)
+	if !strings.Contains(feedback, "$.label") || !strings.Contains(feedback, "enhancement") {
+		t.Errorf("Expected feedback to describe the invalid label, got %q", feedback)
+	}
+}
+
+func TestGenerateIntoOpenAIResponseFormat(t *testing.T) {
+	t.Parallel()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody struct {
+			ResponseFormat struct {
+				Type       string `json:"type"`
+				JSONSchema struct {
+					Name   string                 `json:"name"`
+					Schema map[string]interface{} `json:"schema"`
+					Strict bool                   `json:"strict"`
+				} `json:"json_schema"`
+			} `json:"response_format"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+
+		format := reqBody.ResponseFormat
+		if format.Type != "json_schema" || format.JSONSchema.Name != "classification" ||
+			!format.JSONSchema.Strict || format.JSONSchema.Schema["type"] != "object" {
+			t.Errorf("Unexpected response_format: %+v", format)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[{"index":0,"message":{"role":"assistant",` +
+			`"content":"{\"label\":\"bug\",\"confidence\":0.5,\"tags\":[],\"note\":\"crash\"}"},` +
+			`"finish_reason":"stop"}]}`))
+	}))
+	defer mockServer.Close()
+
+	backend := &OpenAIBackend{
+		APIKey:     "test-api-key",
+		Model:      "gpt-4o",
+		HTTPClient: mockServer.Client(),
+		BaseURL:    mockServer.URL,
+	}
+
+	var out classification
+	err := GenerateInto(context.Background(), backend, NewPrompt().AddMessage("user", "The app crashes"), &out)
+	if err != nil {
+		t.Fatalf("GenerateInto returned error: %v", err)
+	}
+	if out.Label != "bug" || out.Note == nil || *out.Note != "crash" {
+		t.Errorf("Unexpected result: %+v", out)
+	}
+}
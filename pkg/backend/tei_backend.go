@@ -0,0 +1,159 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	teiEmbedEndpoint = "/embed"
+
+	// teiDefaultEmbedBatchSize matches the default --max-client-batch-size of TEI.
+	teiDefaultEmbedBatchSize = 32
+)
+
+// Ensure TEIBackend implements the embedding interface. TEI does not generate
+// text, so it is not a full Backend.
+var _ Embedder = (*TEIBackend)(nil)
+
+// TEIBackend represents a backend for computing embeddings with Hugging Face
+// Text Embeddings Inference. The server loads a single model, so requests do not
+// name one.
+type TEIBackend struct {
+	BaseURL string
+	Client  *http.Client
+	// APIKey, when set, is sent as a bearer token, as required by servers started
+	// with --api-key and by Hugging Face Inference Endpoints.
+	APIKey string
+	// Normalize asks the server to return unit-length embeddings.
+	// NewTEIBackend enables it, matching the server default.
+	Normalize bool
+	// Truncate asks the server to truncate inputs longer than the model's maximum
+	// sequence length instead of rejecting them.
+	Truncate bool
+	// EmbedBatchSize is the maximum number of inputs sent in a single request by
+	// EmbedBatch. If zero, the TEI default of 32 is used.
+	EmbedBatchSize int
+	// Retry configures retries of transient failures. If nil, requests are not retried.
+	Retry *RetryPolicy
+}
+
+// NewTEIBackend creates a new TEIBackend instance that normalizes embeddings.
+//
+// Parameters:
+//   - baseURL: The URL of the Text Embeddings Inference server.
+//   - timeout: The duration for the HTTP client timeout.
+//
+// Returns:
+//   - A pointer to a new TEIBackend instance.
+func NewTEIBackend(baseURL string, timeout time.Duration) *TEIBackend {
+	return &TEIBackend{
+		BaseURL:   baseURL,
+		Normalize: true,
+		Client: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+// Embed generates embeddings for the given input text using the TEI /embed endpoint.
+//
+// Parameters:
+//   - ctx: The context for the API request, which can be used for cancellation.
+//   - input: The input text to be embedded.
+//
+// Returns:
+//   - A slice of float32 values representing the embedding vector.
+//   - An error if the API request fails or if there's an issue processing the response.
+func (t *TEIBackend) Embed(ctx context.Context, input string) ([]float32, error) {
+	embeddings, err := t.embedBatch(ctx, []string{input})
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddings) != 1 {
+		return nil, fmt.Errorf("expected 1 embedding from TEI, got %d", len(embeddings))
+	}
+	return embeddings[0], nil
+}
+
+// EmbedBatch generates embeddings for several input texts using the TEI /embed
+// endpoint, which accepts an array of inputs. Large inputs are split into batches
+// of EmbedBatchSize inputs.
+//
+// Parameters:
+//   - ctx: The context for the API requests, which can be used for cancellation.
+//   - inputs: The input texts to be embedded.
+//
+// Returns:
+//   - The embedding vectors, in the same order as the input texts.
+//   - An error if any of the API requests fail or if there's an issue processing the responses.
+func (t *TEIBackend) EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	batchSize := t.EmbedBatchSize
+	if batchSize <= 0 {
+		batchSize = teiDefaultEmbedBatchSize
+	}
+	return embedInBatches(ctx, inputs, batchSize, t.embedBatch)
+}
+
+// embedBatch sends a single /embed request for the given inputs.
+func (t *TEIBackend) embedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	reqBody := map[string]interface{}{
+		"inputs":    inputs,
+		"normalize": t.Normalize,
+		"truncate":  t.Truncate,
+	}
+
+	reqBodyBytes, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	resp, err := sendHF(ctx, t.Retry, t.Client, t.BaseURL+teiEmbedEndpoint, t.APIKey, reqBodyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate embeddings from TEI: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var embeddings [][]float32
+	if err := json.NewDecoder(resp.Body).Decode(&embeddings); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return embeddings, nil
+}
+
+// sendHF posts body to a Hugging Face inference server and returns the successful
+// response, retrying transient failures according to policy.
+func sendHF(
+	ctx context.Context, policy *RetryPolicy, client *http.Client, url, apiKey string, body []byte,
+) (*http.Response, error) {
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		return req, nil
+	}
+	return sendWithRetry(ctx, policy, client, 0, newRequest, newHFError)
+}
@@ -0,0 +1,112 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTEIEmbedBatch(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var batchSizes []int
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != teiEmbedEndpoint {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer hf-token" {
+			t.Errorf("Expected Authorization Bearer hf-token, got %s", r.Header.Get("Authorization"))
+		}
+
+		var reqBody struct {
+			Inputs    []string `json:"inputs"`
+			Normalize bool     `json:"normalize"`
+			Truncate  bool     `json:"truncate"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		if !reqBody.Normalize || !reqBody.Truncate {
+			t.Errorf("Expected normalize and truncate to be true, got %+v", reqBody)
+		}
+
+		mu.Lock()
+		batchSizes = append(batchSizes, len(reqBody.Inputs))
+		mu.Unlock()
+
+		embeddings := make([][]float32, len(reqBody.Inputs))
+		for i, input := range reqBody.Inputs {
+			embeddings[i] = []float32{float32(len(input)), 1}
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		if err := json.NewEncoder(w).Encode(embeddings); err != nil {
+			t.Errorf("Failed to encode mock response: %v", err)
+		}
+	}))
+	defer mockServer.Close()
+
+	backend := NewTEIBackend(mockServer.URL, 10*time.Second)
+	backend.APIKey = "hf-token"
+	backend.Truncate = true
+	backend.EmbedBatchSize = 2
+
+	inputs := []string{"a", "bb", "ccc"}
+	embeddings, err := backend.EmbedBatch(context.Background(), inputs)
+	if err != nil {
+		t.Fatalf("EmbedBatch returned error: %v", err)
+	}
+
+	if len(embeddings) != len(inputs) {
+		t.Fatalf("Expected %d embeddings, got %d", len(inputs), len(embeddings))
+	}
+	for i, input := range inputs {
+		if embeddings[i][0] != float32(len(input)) {
+			t.Errorf("Embedding %d is out of order: %v", i, embeddings[i])
+		}
+	}
+	if fmt.Sprint(batchSizes) != "[2 1]" {
+		t.Errorf("Expected batches of [2 1], got %v", batchSizes)
+	}
+}
+
+func TestTEIErrors(t *testing.T) {
+	t.Parallel()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprint(w, `{"error":"Input validation error: `+"`inputs`"+` must have less than 512 tokens. Given: 600",`+
+			`"error_type":"Validation"}`)
+	}))
+	defer mockServer.Close()
+
+	backend := NewTEIBackend(mockServer.URL, 10*time.Second)
+
+	_, err := backend.Embed(context.Background(), testEmbeddingText)
+
+	var lengthErr *ContextLengthExceededError
+	if !errors.As(err, &lengthErr) {
+		t.Fatalf("Expected ContextLengthExceededError, got %T: %v", err, err)
+	}
+	if lengthErr.Provider != "huggingface" || lengthErr.Type != "Validation" {
+		t.Errorf("Unexpected error details: %+v", lengthErr.APIError)
+	}
+}
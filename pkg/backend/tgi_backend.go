@@ -0,0 +1,302 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	tgiGenerateEndpoint       = "/generate"
+	tgiGenerateStreamEndpoint = "/generate_stream"
+)
+
+// Ensure TGIBackend implements the generation interfaces. TGI does not compute
+// embeddings, so it is not a full Backend; pair it with TEIBackend.
+var (
+	_ Generator = (*TGIBackend)(nil)
+	_ Streamer  = (*TGIBackend)(nil)
+)
+
+// TGIBackend represents a backend for generating responses with Hugging Face Text
+// Generation Inference. The server loads a single model, so requests do not name one.
+//
+// The /generate endpoint takes a raw prompt string, which is rendered from the
+// prompt messages with Template. Tools are not supported.
+type TGIBackend struct {
+	BaseURL string
+	Client  *http.Client
+	// APIKey, when set, is sent as a bearer token, as required by Hugging Face
+	// Inference Endpoints.
+	APIKey string
+	// Template renders the prompt messages for the loaded model. It must match
+	// the model's training format; if nil, Llama3Template is used.
+	Template ChatTemplate
+	// Retry configures retries of transient failures. If nil, requests are not retried.
+	Retry *RetryPolicy
+}
+
+// TGIResponse represents the response of the TGI /generate endpoint.
+type TGIResponse struct {
+	GeneratedText string `json:"generated_text"`
+	Details       *struct {
+		FinishReason    string `json:"finish_reason"`
+		GeneratedTokens int    `json:"generated_tokens"`
+	} `json:"details"`
+}
+
+// tgiStreamEvent represents a single server-sent event of the TGI /generate_stream endpoint.
+type tgiStreamEvent struct {
+	Token struct {
+		Text    string `json:"text"`
+		Special bool   `json:"special"`
+	} `json:"token"`
+	GeneratedText *string `json:"generated_text"`
+	Error         string  `json:"error"`
+}
+
+// NewTGIBackend creates a new TGIBackend instance.
+//
+// Parameters:
+//   - baseURL: The URL of the Text Generation Inference server.
+//   - template: The chat template of the loaded model. If nil, Llama3Template is used.
+//   - timeout: The duration for the HTTP client timeout.
+//
+// Returns:
+//   - A pointer to a new TGIBackend instance.
+func NewTGIBackend(baseURL string, template ChatTemplate, timeout time.Duration) *TGIBackend {
+	return &TGIBackend{
+		BaseURL:  baseURL,
+		Template: template,
+		Client: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+// Generate renders the prompt with the backend's chat template and returns the
+// text generated by the TGI server.
+//
+// Parameters:
+//   - ctx: The context for the API request, which can be used for cancellation.
+//   - prompt: A structured prompt containing messages and parameters.
+//
+// Returns:
+//   - A string containing the generated response.
+//   - An error if the API request fails or if there's an issue processing the response.
+func (t *TGIBackend) Generate(ctx context.Context, prompt *Prompt) (string, error) {
+	result, err := t.GenerateWithResult(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	return result.Content(), nil
+}
+
+// GenerateWithResult renders the prompt with the backend's chat template and
+// returns the generated text together with the finish reason, the number of
+// generated tokens and the latency. TGI does not report prompt tokens.
+//
+// Parameters:
+//   - ctx: The context for the API request, which can be used for cancellation.
+//   - prompt: A structured prompt containing messages and parameters.
+//
+// Returns:
+//   - The generation result, including the assistant message.
+//   - An error if the API request fails or if there's an issue processing the response.
+func (t *TGIBackend) GenerateWithResult(ctx context.Context, prompt *Prompt) (*GenerateResult, error) {
+	reqBody, stop, err := t.generateRequestBody(prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := sendHF(ctx, t.Retry, t.Client, t.BaseURL+tgiGenerateEndpoint, t.APIKey, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate response from TGI: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result TGIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	generated := &GenerateResult{
+		Message: Message{Role: "assistant", Content: trimStopSequence(result.GeneratedText, stop)},
+		Latency: time.Since(start),
+	}
+	if result.Details != nil {
+		generated.FinishReason = tgiFinishReason(result.Details.FinishReason)
+		generated.Usage = Usage{
+			CompletionTokens: result.Details.GeneratedTokens,
+			TotalTokens:      result.Details.GeneratedTokens,
+		}
+	}
+	return generated, nil
+}
+
+// tgiFinishReason maps TGI's finish reason onto a FinishReason.
+func tgiFinishReason(reason string) FinishReason {
+	switch reason {
+	case "":
+		return ""
+	case "length":
+		return FinishReasonLength
+	default:
+		return FinishReasonStop
+	}
+}
+
+// trimStopSequence removes the stop sequence that ended the generation, which TGI
+// includes in the generated text.
+func trimStopSequence(text string, stop []string) string {
+	for _, s := range stop {
+		if trimmed, ok := strings.CutSuffix(text, s); ok {
+			return trimmed
+		}
+	}
+	return text
+}
+
+// GenerateStream renders the prompt with the backend's chat template and delivers
+// the generated text in chunks as it is produced. TGI streams server-sent events,
+// each carrying the next token; the last one also carries the full generated text.
+//
+// The request is bounded by ctx only; the client timeout is not applied so that
+// long generations are not cut off mid-stream.
+//
+// Parameters:
+//   - ctx: The context for the API request, which can be used for cancellation.
+//   - prompt: A structured prompt containing messages and parameters.
+//
+// Returns:
+//   - A channel receiving the response chunks, closed when the stream ends.
+//   - An error if the request could not be started.
+func (t *TGIBackend) GenerateStream(ctx context.Context, prompt *Prompt) (<-chan StreamChunk, error) {
+	reqBody, stop, err := t.generateRequestBody(prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := sendHF(ctx, t.Retry, streamingClient(t.Client), t.BaseURL+tgiGenerateStreamEndpoint, t.APIKey, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate response from TGI: %w", err)
+	}
+
+	chunks := make(chan StreamChunk)
+	go func() {
+		defer close(chunks)
+		defer resp.Body.Close()
+
+		done := false
+		err := scanSSE(resp.Body, func(data []byte) bool {
+			var event tgiStreamEvent
+			if err := json.Unmarshal(data, &event); err != nil {
+				sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("failed to decode stream chunk: %w", err)})
+				return false
+			}
+			if event.Error != "" {
+				apiErr := hfErrorBody(data)
+				sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("tgi stream error: %w", classifyError(apiErr, 0))})
+				return false
+			}
+
+			content := event.Token.Text
+			if event.Token.Special || slices.Contains(stop, content) {
+				content = ""
+			}
+			done = event.GeneratedText != nil
+			return sendChunk(ctx, chunks, StreamChunk{Content: content, Done: done}) && !done
+		})
+		if err != nil {
+			sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("failed to read stream: %w", err)})
+			return
+		}
+		if !done && ctx.Err() == nil {
+			sendChunk(ctx, chunks, StreamChunk{Err: fmt.Errorf("stream ended before completion: %w", io.ErrUnexpectedEOF)})
+		}
+	}()
+
+	return chunks, nil
+}
+
+// generateRequestBody builds the JSON body of a /generate request for the given
+// prompt, and returns it together with the stop sequences of the chat template.
+func (t *TGIBackend) generateRequestBody(prompt *Prompt) ([]byte, []string, error) {
+	if len(prompt.Tools) > 0 {
+		return nil, nil, fmt.Errorf("tools are not supported by the TGI generate endpoint")
+	}
+	if err := checkTextOnly(prompt.Messages, "TGI"); err != nil {
+		return nil, nil, err
+	}
+
+	template := t.Template
+	if template == nil {
+		template = Llama3Template
+	}
+	text, err := template.Render(prompt.Messages)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to render prompt: %w", err)
+	}
+	stop := template.StopSequences()
+
+	// TGI rejects out-of-range values, such as a temperature of zero, so only the
+	// parameters that were set are sent
+	parameters := map[string]interface{}{
+		"details": true,
+		"stop":    stop,
+	}
+	params := prompt.Parameters
+	if params.MaxTokens != 0 {
+		parameters["max_new_tokens"] = params.MaxTokens
+	}
+	if params.Temperature > 0 {
+		parameters["temperature"] = params.Temperature
+	}
+	if params.TopP > 0 && params.TopP < 1 {
+		parameters["top_p"] = params.TopP
+	}
+	if params.FrequencyPenalty != 0 {
+		parameters["frequency_penalty"] = params.FrequencyPenalty
+	}
+	if params.RepeatPenalty != 0 {
+		parameters["repetition_penalty"] = params.RepeatPenalty
+	}
+	if params.Seed != 0 {
+		parameters["seed"] = params.Seed
+	}
+	if prompt.ResponseFormat != nil {
+		parameters["grammar"] = map[string]interface{}{
+			"type":  "json",
+			"value": prompt.ResponseFormat.Schema,
+		}
+	}
+
+	reqBodyBytes, err := json.Marshal(map[string]interface{}{
+		"inputs":     text,
+		"parameters": parameters,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	return reqBodyBytes, stop, nil
+}
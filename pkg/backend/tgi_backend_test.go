@@ -0,0 +1,119 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTGIGenerate(t *testing.T) {
+	t.Parallel()
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != tgiGenerateEndpoint {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+
+		var reqBody struct {
+			Inputs     string                 `json:"inputs"`
+			Parameters map[string]interface{} `json:"parameters"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		if expected := "<|im_start|>user\nHi<|im_end|>\n<|im_start|>assistant\n"; reqBody.Inputs != expected {
+			t.Errorf("Expected inputs %q, got %q", expected, reqBody.Inputs)
+		}
+		if reqBody.Parameters["max_new_tokens"] != float64(32) {
+			t.Errorf("Expected max_new_tokens 32, got %v", reqBody.Parameters["max_new_tokens"])
+		}
+		if _, ok := reqBody.Parameters["temperature"]; ok {
+			t.Error("Expected a zero temperature not to be sent")
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		fmt.Fprint(w, `{"generated_text":"Hello there<|im_end|>",`+
+			`"details":{"finish_reason":"stop_sequence","generated_tokens":3}}`)
+	}))
+	defer mockServer.Close()
+
+	backend := NewTGIBackend(mockServer.URL, ChatMLTemplate, 10*time.Second)
+
+	prompt := NewPrompt().AddMessage("user", "Hi").SetParameters(Parameters{MaxTokens: 32})
+
+	result, err := backend.GenerateWithResult(context.Background(), prompt)
+	if err != nil {
+		t.Fatalf("GenerateWithResult returned error: %v", err)
+	}
+	if result.Content() != "Hello there" {
+		t.Errorf("Expected response 'Hello there', got '%s'", result.Content())
+	}
+	if result.FinishReason != FinishReasonStop {
+		t.Errorf("Expected finish reason stop, got %s", result.FinishReason)
+	}
+	if result.Usage.CompletionTokens != 3 {
+		t.Errorf("Expected 3 completion tokens, got %d", result.Usage.CompletionTokens)
+	}
+}
+
+func TestTGIGenerateStream(t *testing.T) {
+	t.Parallel()
+	events := []string{
+		`{"token":{"id":1,"text":"This is ","special":false},"generated_text":null,"details":null}`,
+		`{"token":{"id":2,"text":"a test response.","special":false},"generated_text":null,"details":null}`,
+		`{"token":{"id":3,"text":"<|eot_id|>","special":true},"generated_text":"This is a test response.",` +
+			`"details":{"finish_reason":"eos_token","generated_tokens":3}}`,
+	}
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != tgiGenerateStreamEndpoint {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			fmt.Fprintf(w, "data:%s\n\n", event)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer mockServer.Close()
+
+	backend := NewTGIBackend(mockServer.URL, nil, 10*time.Second)
+
+	stream, err := backend.GenerateStream(context.Background(), NewPrompt().AddMessage("user", "Hi"))
+	if err != nil {
+		t.Fatalf("GenerateStream returned error: %v", err)
+	}
+
+	var response string
+	var done bool
+	for chunk := range stream {
+		if chunk.Err != nil {
+			t.Fatalf("Stream returned error: %v", chunk.Err)
+		}
+		response += chunk.Content
+		done = chunk.Done
+	}
+
+	if !done {
+		t.Error("Expected the last chunk to be marked as done")
+	}
+	if expected := "This is a test response."; response != expected {
+		t.Errorf("Expected response '%s', got '%s'", expected, response)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Tool describes a function that the model may decide to call.
+type Tool struct {
+	// Name is the name the model uses to refer to the tool.
+	Name string `json:"name"`
+	// Description tells the model what the tool does and when to use it.
+	Description string `json:"description,omitempty"`
+	// Parameters is a JSON Schema object describing the tool's arguments.
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// ToolCall represents a request from the model to invoke a tool.
+type ToolCall struct {
+	ID       string       `json:"id,omitempty"`
+	Type     string       `json:"type,omitempty"`
+	Function FunctionCall `json:"function"`
+}
+
+// FunctionCall holds the name of the tool to call and the arguments the model chose for it.
+type FunctionCall struct {
+	Name string `json:"name"`
+	// Arguments is the JSON object of arguments, suitable for json.Unmarshal.
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// toolsPayload converts tool declarations into the function tool format shared
+// by the OpenAI and Ollama chat APIs.
+func toolsPayload(tools []Tool) []map[string]interface{} {
+	payload := make([]map[string]interface{}, 0, len(tools))
+	for _, tool := range tools {
+		function := map[string]interface{}{
+			"name": tool.Name,
+		}
+		if tool.Description != "" {
+			function["description"] = tool.Description
+		}
+		if tool.Parameters != nil {
+			function["parameters"] = tool.Parameters
+		}
+		payload = append(payload, map[string]interface{}{
+			"type":     "function",
+			"function": function,
+		})
+	}
+	return payload
+}
+
+// InvalidToolArgumentsError is returned when the model calls a tool with
+// arguments that are not valid JSON, which models occasionally produce. The
+// raw arguments are kept so that the caller can log them or re-prompt.
+type InvalidToolArgumentsError struct {
+	// ToolCallID and Name identify the call.
+	ToolCallID string
+	Name       string
+	// Arguments is the text the model produced as arguments.
+	Arguments string
+}
+
+// Error implements the error interface.
+func (e *InvalidToolArgumentsError) Error() string {
+	return fmt.Sprintf("model called tool %q with invalid JSON arguments: %s", e.Name, e.Arguments)
+}
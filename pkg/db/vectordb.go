@@ -48,3 +48,24 @@ func CombineQueryWithContext(query string, retrievedDocs []Document) string {
 	// Construct the augmented query with the retrieved context and the user's query
 	return fmt.Sprintf("Context: %s\n\nQuery: %s", context, query)
 }
+
+// CombineQueryWithContextLimit combines the user's query with the content of as many
+// retrieved documents as fit in maxTokens, in the order they were retrieved. Tokens are
+// counted with count, for example the Count method of a tokenizer.Counter. Documents
+// that do not fit are left out whole rather than cut off.
+func CombineQueryWithContextLimit(
+	query string, retrievedDocs []Document, maxTokens int, count func(text string) int,
+) string {
+	var context string
+	used := count(fmt.Sprintf("Context: \n\nQuery: %s", query))
+	for _, doc := range retrievedDocs {
+		content := fmt.Sprintf("%s\n", doc.Metadata["content"])
+		tokens := count(content)
+		if used+tokens > maxTokens {
+			continue
+		}
+		context += content
+		used += tokens
+	}
+	return fmt.Sprintf("Context: %s\n\nQuery: %s", context, query)
+}
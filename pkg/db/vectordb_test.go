@@ -0,0 +1,43 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCombineQueryWithContextLimit(t *testing.T) {
+	t.Parallel()
+	docs := []Document{
+		{ID: "1", Metadata: map[string]interface{}{"content": "Mickey Mouse is a cartoon character."}},
+		{ID: "2", Metadata: map[string]interface{}{
+			"content": "He was created by Walt Disney and Ub Iwerks in 1928 at the Walt Disney Studios.",
+		}},
+		{ID: "3", Metadata: map[string]interface{}{"content": "He has red shorts."}},
+	}
+	words := func(text string) int { return len(strings.Fields(text)) }
+
+	// the template and query take 5 words, leaving 12 for the documents
+	combined := CombineQueryWithContextLimit("Who is Mickey?", docs, 17, words)
+	expected := "Context: Mickey Mouse is a cartoon character.\nHe has red shorts.\n\n\nQuery: Who is Mickey?"
+	if combined != expected {
+		t.Errorf("Expected %q, got %q", expected, combined)
+	}
+
+	combined = CombineQueryWithContextLimit("Who is Mickey?", docs, 1000, words)
+	if combined != CombineQueryWithContext("Who is Mickey?", docs) {
+		t.Errorf("Expected all documents to be included when they fit, got %q", combined)
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tokenizer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// Cl100kBase is the encoding of GPT-4, GPT-3.5 and the text-embedding-3 models.
+	Cl100kBase = "cl100k_base"
+	// O200kBase is the encoding of GPT-4o and the o-series models.
+	O200kBase = "o200k_base"
+)
+
+// The pre-tokenization patterns of the encodings, without the `\s+(?!\S)`
+// alternative: Go regular expressions have no lookahead, so splitPieces applies
+// it by hand.
+var patterns = map[string]*regexp.Regexp{
+	Cl100kBase: compilePattern(`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}|` +
+		` ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`),
+	O200kBase: compilePattern(
+		`[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?|` +
+			`[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?|` +
+			`\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n/]*|\s*[\r\n]+|\s+`),
+}
+
+// unicodeSpaces is the class of Unicode whitespace, which \s matches in tiktoken
+// but only covers ASCII whitespace in Go.
+const unicodeSpaces = `\t\n\v\f\r \x{85}\p{Z}`
+
+// compilePattern compiles a tiktoken pattern with \s widened to Unicode whitespace.
+func compilePattern(pattern string) *regexp.Regexp {
+	pattern = strings.ReplaceAll(pattern, `[^\s`, `[^`+unicodeSpaces)
+	pattern = strings.ReplaceAll(pattern, `\s`, `[`+unicodeSpaces+`]`)
+	return regexp.MustCompile(pattern)
+}
+
+// BPE is a byte pair encoding tokenizer compatible with tiktoken. It is safe for
+// concurrent use.
+//
+// Special tokens such as <|endoftext|> are encoded as ordinary text.
+type BPE struct {
+	encoding string
+	pattern  *regexp.Regexp
+	ranks    map[string]int
+	tokens   map[int]string
+}
+
+// LoadFile loads a tiktoken rank file, such as o200k_base.tiktoken, for the
+// named encoding.
+func LoadFile(path, encoding string) (*BPE, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rank file: %w", err)
+	}
+	defer f.Close()
+	return Load(f, encoding)
+}
+
+// Load reads a tiktoken rank file for the named encoding, which must be
+// Cl100kBase or O200kBase. Each line of the file holds a base64-encoded token
+// and its rank, separated by a space.
+func Load(r io.Reader, encoding string) (*BPE, error) {
+	pattern, ok := patterns[encoding]
+	if !ok {
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+
+	bpe := &BPE{
+		encoding: encoding,
+		pattern:  pattern,
+		ranks:    make(map[string]int),
+		tokens:   make(map[int]string),
+	}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := bytes.Fields(scanner.Bytes())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid rank file line %d", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(string(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode token on line %d: %w", line, err)
+		}
+		rank, err := strconv.Atoi(string(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse rank on line %d: %w", line, err)
+		}
+		bpe.ranks[string(token)] = rank
+		bpe.tokens[rank] = string(token)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read rank file: %w", err)
+	}
+
+	// every byte must be a token, so that any text can be encoded
+	for b := 0; b < 256; b++ {
+		if _, ok := bpe.ranks[string([]byte{byte(b)})]; !ok {
+			return nil, fmt.Errorf("rank file has no token for byte %#x", b)
+		}
+	}
+	return bpe, nil
+}
+
+// Encoding returns the name of the encoding.
+func (b *BPE) Encoding() string {
+	return b.encoding
+}
+
+// Encode returns the tokens of text.
+func (b *BPE) Encode(text string) []int {
+	tokens, _ := b.encode(text)
+	return tokens
+}
+
+// Decode returns the text of tokens. Unknown tokens are skipped.
+func (b *BPE) Decode(tokens []int) string {
+	var buf bytes.Buffer
+	for _, token := range tokens {
+		buf.WriteString(b.tokens[token])
+	}
+	return buf.String()
+}
+
+// Count returns the number of tokens in text.
+func (b *BPE) Count(text string) int {
+	tokens, _ := b.encode(text)
+	return len(tokens)
+}
+
+// Truncate returns the longest prefix of text with at most maxTokens tokens that
+// does not end inside a UTF-8 character.
+func (b *BPE) Truncate(text string, maxTokens int) string {
+	if maxTokens <= 0 {
+		return ""
+	}
+	_, ends := b.encode(text)
+	if len(ends) <= maxTokens {
+		return text
+	}
+	return text[:runeStart(text, ends[maxTokens-1])]
+}
+
+// Split cuts text into consecutive chunks of at most maxTokens tokens each,
+// without splitting UTF-8 characters. A character that alone takes more than
+// maxTokens tokens becomes a chunk of its own.
+func (b *BPE) Split(text string, maxTokens int) []string {
+	maxTokens = max(maxTokens, 1)
+	_, ends := b.encode(text)
+
+	var chunks []string
+	start, count := 0, 0
+	for i, end := range ends {
+		count++
+		if count < maxTokens && i < len(ends)-1 {
+			continue
+		}
+		cut := runeStart(text, end)
+		if cut <= start {
+			continue
+		}
+		chunks = append(chunks, text[start:cut])
+		start, count = cut, 0
+		if cut < end {
+			// the token that was cut through belongs to the next chunk
+			count = 1
+		}
+	}
+	return chunks
+}
+
+// encode returns the tokens of text together with the byte offset in text at
+// which each token ends.
+func (b *BPE) encode(text string) ([]int, []int) {
+	var tokens, ends []int
+	offset := 0
+	for _, piece := range splitPieces(b.pattern, text) {
+		for _, part := range b.mergePiece(piece) {
+			offset += len(part)
+			tokens = append(tokens, b.ranks[part])
+			ends = append(ends, offset)
+		}
+	}
+	return tokens, ends
+}
+
+// mergePiece splits a piece into tokens by repeatedly merging the adjacent pair
+// of parts with the lowest rank, starting from single bytes.
+func (b *BPE) mergePiece(piece string) []string {
+	if _, ok := b.ranks[piece]; ok {
+		return []string{piece}
+	}
+
+	bounds := make([]int, len(piece)+1)
+	for i := range bounds {
+		bounds[i] = i
+	}
+	for len(bounds) > 2 {
+		best, bestRank := -1, math.MaxInt
+		for i := 0; i+2 < len(bounds); i++ {
+			if rank, ok := b.ranks[piece[bounds[i]:bounds[i+2]]]; ok && rank < bestRank {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		bounds = append(bounds[:best+1], bounds[best+2:]...)
+	}
+
+	parts := make([]string, 0, len(bounds)-1)
+	for i := 0; i+1 < len(bounds); i++ {
+		parts = append(parts, piece[bounds[i]:bounds[i+1]])
+	}
+	return parts
+}
+
+// splitPieces splits text with the pre-tokenization pattern of an encoding. A run
+// of whitespace followed by other text gives up its last character to that text,
+// as the `\s+(?!\S)` alternative of the original patterns does.
+func splitPieces(pattern *regexp.Regexp, text string) []string {
+	var pieces []string
+	for len(text) > 0 {
+		end := 0
+		if loc := pattern.FindStringIndex(text); loc != nil && loc[0] == 0 {
+			end = loc[1]
+		}
+		if end == 0 {
+			_, end = utf8.DecodeRuneInString(text)
+		}
+
+		piece := text[:end]
+		if end < len(text) && isSpace(piece) && utf8.RuneCountInString(piece) > 1 {
+			last, size := utf8.DecodeLastRuneInString(piece)
+			if last != '\r' && last != '\n' {
+				end -= size
+			}
+		}
+		pieces = append(pieces, text[:end])
+		text = text[end:]
+	}
+	return pieces
+}
+
+func isSpace(s string) bool {
+	for _, r := range s {
+		if !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// runeStart moves offset back to the start of the UTF-8 character it falls in.
+func runeStart(text string, offset int) int {
+	for offset > 0 && offset < len(text) && !utf8.RuneStart(text[offset]) {
+		offset--
+	}
+	return offset
+}
@@ -0,0 +1,121 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tokenizer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testRanks builds a rank file with every byte followed by the given merges.
+func testRanks(merges ...string) string {
+	var b strings.Builder
+	for i := 0; i < 256; i++ {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(i)}), i)
+	}
+	for i, merge := range merges {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(merge)), 256+i)
+	}
+	return b.String()
+}
+
+func loadTestBPE(t *testing.T, encoding string) *BPE {
+	t.Helper()
+	bpe, err := Load(strings.NewReader(testRanks(" w", "or", "ld", " wor", " world", "Hello")), encoding)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	return bpe
+}
+
+func TestSplitPieces(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		encoding string
+		text     string
+		expected []string
+	}{
+		{Cl100kBase, "Hello world", []string{"Hello", " world"}},
+		{Cl100kBase, "I'm  here\n\n  ok 12345", []string{"I", "'m", " ", " here", "\n\n", " ", " ok", " ", "123", "45"}},
+		{Cl100kBase, "end.  ", []string{"end", ".", "  "}},
+		{Cl100kBase, "a  b", []string{"a", " ", " b"}},
+		{O200kBase, "HelloWorld's path/to", []string{"Hello", "World's", " path", "/to"}},
+	}
+	for _, tt := range tests {
+		pieces := splitPieces(patterns[tt.encoding], tt.text)
+		if !reflect.DeepEqual(pieces, tt.expected) {
+			t.Errorf("%s: expected pieces %q for %q, got %q", tt.encoding, tt.expected, tt.text, pieces)
+		}
+	}
+}
+
+func TestBPEEncode(t *testing.T) {
+	t.Parallel()
+	bpe := loadTestBPE(t, Cl100kBase)
+
+	tokens := bpe.Encode("Hello worlds")
+	expected := []int{261, 260, 's'}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("Expected tokens %v, got %v", expected, tokens)
+	}
+	if text := bpe.Decode(tokens); text != "Hello worlds" {
+		t.Errorf("Expected the tokens to decode to the text, got %q", text)
+	}
+	if count := bpe.Count("Hello world, héllo"); count != 10 {
+		t.Errorf("Expected 10 tokens, got %d", count)
+	}
+}
+
+func TestBPETruncateAndSplit(t *testing.T) {
+	t.Parallel()
+	bpe := loadTestBPE(t, Cl100kBase)
+
+	if got := bpe.Truncate("Hello worlds", 2); got != "Hello world" {
+		t.Errorf("Expected 'Hello world', got %q", got)
+	}
+	if got := bpe.Truncate("Hello worlds", 10); got != "Hello worlds" {
+		t.Errorf("Expected the text to be unchanged, got %q", got)
+	}
+	// é takes two byte tokens, so a single token cannot hold it
+	if got := bpe.Truncate("é", 1); got != "" {
+		t.Errorf("Expected truncation not to split a character, got %q", got)
+	}
+
+	chunks := bpe.Split("Hello world worlds world", 2)
+	expected := []string{"Hello world", " worlds", " world"}
+	if !reflect.DeepEqual(chunks, expected) {
+		t.Errorf("Expected chunks %q, got %q", expected, chunks)
+	}
+	chunks = bpe.Split("aéb", 2)
+	expected = []string{"a", "é", "b"}
+	if !reflect.DeepEqual(chunks, expected) {
+		t.Errorf("Expected chunks %q, got %q", expected, chunks)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Parallel()
+	if _, err := Load(strings.NewReader(testRanks()), "p50k_base"); err == nil {
+		t.Errorf("Expected an error for an unsupported encoding")
+	}
+	if _, err := Load(strings.NewReader("SGk= 0\n"), Cl100kBase); err == nil {
+		t.Errorf("Expected an error for a rank file without byte tokens")
+	}
+	if _, err := Load(strings.NewReader("not-base64! 1\n"), Cl100kBase); err == nil {
+		t.Errorf("Expected an error for an invalid token")
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tokenizer counts, truncates and splits text in model tokens without
+// calling a model. It implements byte pair encoding (BPE) with the rank files of
+// OpenAI's cl100k_base and o200k_base encodings, and falls back to a character
+// ratio estimate for models whose tokenizer is not available.
+//
+// Rank files are not bundled. Load them once and register them, after which
+// ForModel returns an exact counter for the models that use them:
+//
+//	bpe, err := tokenizer.LoadFile("o200k_base.tiktoken", tokenizer.O200kBase)
+//	...
+//	tokenizer.Register(bpe)
+//	counter := tokenizer.ForModel("gpt-4o-mini")
+//	n := counter.Count(text)
+package tokenizer
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/stackloklabs/gorag/pkg/backend"
+)
+
+const (
+	// DefaultCharsPerToken is the ratio used by ForModel for models without a
+	// registered encoding. It is typical of English text.
+	DefaultCharsPerToken = 4.0
+
+	// tokensPerMessage and tokensPerReply are the tokens OpenAI chat models spend
+	// on the role and delimiters of each message, and on priming the reply.
+	tokensPerMessage = 3
+	tokensPerReply   = 3
+)
+
+// Counter counts tokens and cuts text on token boundaries.
+//
+// Count can be used directly as a backend.TokenCounter, for example for
+// backend.ChatSession.Counter.
+type Counter interface {
+	// Count returns the number of tokens in text.
+	Count(text string) int
+	// Truncate returns the longest prefix of text with at most maxTokens tokens.
+	Truncate(text string, maxTokens int) string
+	// Split cuts text into consecutive chunks of at most maxTokens tokens each.
+	Split(text string, maxTokens int) []string
+}
+
+// Ensure the tokenizers implement Counter.
+var (
+	_ Counter = (*BPE)(nil)
+	_ Counter = Ratio{}
+)
+
+// Ratio is a Counter that estimates tokens from the number of characters. Cuts
+// fall on character boundaries.
+type Ratio struct {
+	// CharsPerToken is the average number of characters per token. If not
+	// positive, DefaultCharsPerToken is used.
+	CharsPerToken float64
+}
+
+func (r Ratio) charsPerToken() float64 {
+	if r.CharsPerToken <= 0 {
+		return DefaultCharsPerToken
+	}
+	return r.CharsPerToken
+}
+
+// Count returns the estimated number of tokens in text, rounded up.
+func (r Ratio) Count(text string) int {
+	return int(math.Ceil(float64(utf8.RuneCountInString(text)) / r.charsPerToken()))
+}
+
+// Truncate returns the prefix of text with the number of characters that maxTokens
+// tokens are estimated to hold.
+func (r Ratio) Truncate(text string, maxTokens int) string {
+	if maxTokens <= 0 {
+		return ""
+	}
+	limit := r.runesFor(maxTokens)
+	for i := range text {
+		if limit == 0 {
+			return text[:i]
+		}
+		limit--
+	}
+	return text
+}
+
+// Split cuts text into chunks of the number of characters that maxTokens tokens
+// are estimated to hold.
+func (r Ratio) Split(text string, maxTokens int) []string {
+	size := r.runesFor(maxTokens)
+	var chunks []string
+	start, count := 0, 0
+	for i := range text {
+		if count == size {
+			chunks = append(chunks, text[start:i])
+			start, count = i, 0
+		}
+		count++
+	}
+	if start < len(text) {
+		chunks = append(chunks, text[start:])
+	}
+	return chunks
+}
+
+// runesFor returns the number of characters in maxTokens tokens, at least one.
+func (r Ratio) runesFor(maxTokens int) int {
+	return max(int(float64(maxTokens)*r.charsPerToken()), 1)
+}
+
+// CountPrompt returns the number of tokens the messages of prompt take, including
+// the per-message overhead of chat models and the tokens priming the reply. Tool
+// calls are counted by their names and arguments; images and tool declarations
+// are not counted.
+func CountPrompt(c Counter, prompt *backend.Prompt) int {
+	total := tokensPerReply
+	for _, message := range prompt.Messages {
+		total += tokensPerMessage + c.Count(message.Role) + c.Count(message.Text())
+		for _, call := range message.ToolCalls {
+			total += c.Count(call.Function.Name) + c.Count(string(call.Function.Arguments))
+		}
+	}
+	return total
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]*BPE{}
+)
+
+// Register makes bpe available to ForModel for the models that use its encoding.
+// Registering an encoding again replaces it.
+func Register(bpe *BPE) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[bpe.Encoding()] = bpe
+}
+
+// Registered returns the tokenizer registered for the named encoding, or nil.
+func Registered(encoding string) *BPE {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return registry[encoding]
+}
+
+// ForModel returns the registered BPE tokenizer of the model's encoding, or a
+// Ratio estimate with DefaultCharsPerToken when the model is unknown or its
+// encoding has not been registered.
+func ForModel(model string) Counter {
+	if bpe := Registered(EncodingForModel(model)); bpe != nil {
+		return bpe
+	}
+	return Ratio{CharsPerToken: DefaultCharsPerToken}
+}
+
+// EncodingForModel returns the name of the encoding used by an OpenAI model, or
+// an empty string if the model is unknown. Provider prefixes such as "openai/"
+// and date suffixes are ignored.
+func EncodingForModel(model string) string {
+	model = strings.ToLower(model)
+	if i := strings.LastIndex(model, "/"); i >= 0 {
+		model = model[i+1:]
+	}
+
+	for _, prefix := range []string{"gpt-4o", "chatgpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "o1", "o3", "o4"} {
+		if strings.HasPrefix(model, prefix) {
+			return O200kBase
+		}
+	}
+	for _, prefix := range []string{"gpt-4", "gpt-3.5", "gpt-35", "text-embedding-3", "text-embedding-ada-002"} {
+		if strings.HasPrefix(model, prefix) {
+			return Cl100kBase
+		}
+	}
+	return ""
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tokenizer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stackloklabs/gorag/pkg/backend"
+)
+
+func TestRatio(t *testing.T) {
+	t.Parallel()
+	ratio := Ratio{}
+
+	if count := ratio.Count("abcdefghi"); count != 3 {
+		t.Errorf("Expected 9 characters to count as 3 tokens, got %d", count)
+	}
+	if got := ratio.Truncate("añbcdefghi", 2); got != "añbcdefg" {
+		t.Errorf("Expected the first 8 characters, got %q", got)
+	}
+	chunks := Ratio{CharsPerToken: 2}.Split("añbcdefghi", 2)
+	expected := []string{"añbc", "defg", "hi"}
+	if !reflect.DeepEqual(chunks, expected) {
+		t.Errorf("Expected chunks %q, got %q", expected, chunks)
+	}
+}
+
+func TestCountPrompt(t *testing.T) {
+	t.Parallel()
+	prompt := backend.NewPrompt().
+		AddMessage("system", "Be brief.").
+		AddMessage("user", "What is RAG?")
+
+	counter := Ratio{CharsPerToken: 1}
+	// 3 for the reply, 3 per message, plus the characters of roles and contents
+	expected := 3 + (3 + 6 + 9) + (3 + 4 + 12)
+	if count := CountPrompt(counter, prompt); count != expected {
+		t.Errorf("Expected %d tokens, got %d", expected, count)
+	}
+}
+
+func TestForModel(t *testing.T) {
+	t.Parallel()
+	tests := map[string]string{
+		"gpt-4o-mini":            O200kBase,
+		"openai/gpt-4o":          O200kBase,
+		"o3-mini":                O200kBase,
+		"gpt-4-turbo":            Cl100kBase,
+		"gpt-3.5-turbo-0125":     Cl100kBase,
+		"text-embedding-3-small": Cl100kBase,
+		"llama3":                 "",
+	}
+	for model, expected := range tests {
+		if encoding := EncodingForModel(model); encoding != expected {
+			t.Errorf("Expected encoding %q for %s, got %q", expected, model, encoding)
+		}
+	}
+
+	if _, ok := ForModel("llama3").(Ratio); !ok {
+		t.Errorf("Expected the ratio fallback for an unknown model")
+	}
+
+	bpe, err := Load(strings.NewReader(testRanks("Hello")), O200kBase)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	Register(bpe)
+	if counter := ForModel("gpt-4o"); counter != Counter(bpe) {
+		t.Errorf("Expected the registered tokenizer for gpt-4o, got %T", counter)
+	}
+	if _, ok := ForModel("gpt-4").(Ratio); !ok {
+		t.Errorf("Expected the ratio fallback for an unregistered encoding")
+	}
+}